@@ -0,0 +1,302 @@
+package distdb
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/internal/hashing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Anti-entropy catches followers that have silently diverged from their leader, e.g. after a write that failed to
+	replicate was dropped, or a corrupted disk. Every node keeps a Merkle tree over its entries: keys are spread over
+	MERKLE_LEAVES ranges by hash, a leaf's hash is the XOR of the hashes of the entries in its range (so that it can be
+	kept up to date on every write), and every inner node hashes its two children. Nodes are numbered like a heap,
+	the root is 1 and node i's children are 2i and 2i+1.
+
+	Every RepairInterval a follower asks the leader for the root, then for the children of every node that
+	differs from its own, down to the leaves. It fetches the leader's entries in the differing leaves only, in batches
+	of MERKLE_RANGE_BATCH_SIZE leaves, and takes them over: missing and different keys are put, extra ones deleted.
+	The repairs are logged like any write but carry no sequence number.
+
+	Having none, they aren't passed down the chain either: a chained replica would have no place in the write order to
+	apply them at. Instead it compares itself with the follower it replicates from (its own leader) in its own rounds,
+	and takes the repairs over from there.
+
+	A follower that is behind the leader differs from it by the writes it has yet to get, which is fine: they still
+	arrive in order and leave it with the leader's state. One that is ahead of what the leader sent back has newer
+	writes, so it skips the repair until the next round rather than go back in time. CHECK_REPLICA runs the comparison
+	on demand, optionally without repairing anything, and flags the result as lagging when the follower was behind:
+	then not every difference it reports is divergence.
+*/
+
+const (
+	MERKLE_DEPTH            = 10
+	MERKLE_LEAVES           = 1 << MERKLE_DEPTH
+	MERKLE_RANGE_BATCH_SIZE = 64
+	DEFAULT_REPAIR_INTERVAL = 30 * time.Second
+)
+
+/* The leaf of the Merkle tree key falls in, numbered 0 to MERKLE_LEAVES-1 */
+func merkleLeaf(key []byte) int {
+	h := fnv.New64a()
+	h.Write(key)
+	return int(hashing.Mix(h.Sum64()) >> (64 - MERKLE_DEPTH))
+}
+
+func entryHash(key, val []byte) uint64 {
+	h := fnv.New64a()
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	h.Write(key)
+	h.Write(val)
+	return hashing.Mix(h.Sum64())
+}
+
+/* Account for key being set to val, or unset if it had val. Call this only with db.Mutex held */
+func (db *DB) toggleMerkle(key, val []byte) {
+	db.merkleLeaves[merkleLeaf(key)] ^= entryHash(key, val)
+}
+
+/* Every node of the tree, indexed as described at the top of the file (0 is unused). Call this only with db.Mutex held */
+func (db *DB) merkleTree() []uint64 {
+	tree := make([]uint64, 2*MERKLE_LEAVES)
+	copy(tree[MERKLE_LEAVES:], db.merkleLeaves)
+
+	var children [16]byte
+	for i := MERKLE_LEAVES - 1; i > 0; i-- {
+		binary.BigEndian.PutUint64(children[:8], tree[2*i])
+		binary.BigEndian.PutUint64(children[8:], tree[2*i+1])
+		h := fnv.New64a()
+		h.Write(children[:])
+		tree[i] = hashing.Mix(h.Sum64())
+	}
+	return tree
+}
+
+/* Hashes of the tree's nodes, along with the last sequence number we applied */
+func (db *DB) merkleHashes(nodes []uint64) ([]uint64, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	tree := db.merkleTree()
+	hashes := make([]uint64, 0, len(nodes))
+	for _, node := range nodes {
+		if node == 0 || node >= uint64(len(tree)) {
+			return nil, 0, fmt.Errorf("%w: no Merkle tree node %d", ErrInvalidOperation, node)
+		}
+		hashes = append(hashes, tree[node])
+	}
+	return hashes, db.seq, nil
+}
+
+/* Every entry in the leaves (tree nodes, not leaf numbers) as a PUT, along with the last sequence number we applied */
+func (db *DB) merkleRange(nodes []uint64) ([]*communication.LogRecord, uint64, error) {
+	leaves, err := leafSet(nodes)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var records []*communication.LogRecord
+	for _, entry := range db.Entries {
+		if leaves[merkleLeaf(entry.Key)] {
+			records = append(records, entryRecord(entry))
+		}
+	}
+	return records, db.seq, nil
+}
+
+func leafSet(nodes []uint64) (map[int]bool, error) {
+	leaves := map[int]bool{}
+	for _, node := range nodes {
+		if node < MERKLE_LEAVES || node >= 2*MERKLE_LEAVES {
+			return nil, fmt.Errorf("%w: Merkle tree node %d isn't a leaf", ErrInvalidOperation, node)
+		}
+		leaves[int(node-MERKLE_LEAVES)] = true
+	}
+	return leaves, nil
+}
+
+/* Compare our entries with the leader's, and take the leader's for the ones that differ if repair is set */
+func (db *DB) CheckReplica(ctx context.Context, repair bool) (*communication.Divergence, error) {
+	if db.config.LeaderConfig == nil {
+		return nil, fmt.Errorf("%w: no leader to compare with", ErrInvalidOperation)
+	}
+
+	config := *db.config.LeaderConfig
+	config.LazyConnect = true
+	client, err := distdbclient.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return db.checkReplica(ctx, client, repair)
+}
+
+func (db *DB) checkReplica(ctx context.Context, client *distdbclient.Client, repair bool) (*communication.Divergence, error) {
+	divergence := &communication.Divergence{}
+
+	/* Walk down the tree wherever it differs */
+	nodes := []uint64{1}
+	for len(nodes) > 0 {
+		resp, err := db.leaderRequest(ctx, client, &communication.Request{Op: communication.Operation_MERKLE, Nodes: nodes})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Hashes) != len(nodes) {
+			return nil, fmt.Errorf("leader sent %d Merkle tree hashes for %d nodes", len(resp.Hashes), len(nodes))
+		}
+		divergence.LeaderSeq = resp.Seq
+
+		db.mu.RLock()
+		tree := db.merkleTree()
+		divergence.Seq = db.seq
+		db.mu.RUnlock()
+		divergence.Lagging = divergence.Lagging || divergence.Seq < divergence.LeaderSeq
+
+		var differing []uint64
+		for i, node := range nodes {
+			if resp.Hashes[i] == tree[node] {
+				continue
+			}
+			if node >= MERKLE_LEAVES {
+				divergence.Ranges = append(divergence.Ranges, node)
+				continue
+			}
+			differing = append(differing, 2*node, 2*node+1)
+		}
+		nodes = differing
+	}
+
+	divergence.Repaired = repair
+	for start := 0; start < len(divergence.Ranges); start += MERKLE_RANGE_BATCH_SIZE {
+		end := start + MERKLE_RANGE_BATCH_SIZE
+		if end > len(divergence.Ranges) {
+			end = len(divergence.Ranges)
+		}
+		err := db.compareRanges(ctx, client, divergence, divergence.Ranges[start:end], repair)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return divergence, nil
+}
+
+/* Compare the entries in leaves with the leader's, adding what differs to divergence and repairing it if asked to */
+func (db *DB) compareRanges(ctx context.Context, client *distdbclient.Client, divergence *communication.Divergence, leaves []uint64, repair bool) error {
+	resp, err := db.leaderRequest(ctx, client, &communication.Request{Op: communication.Operation_MERKLE_RANGE, Nodes: leaves})
+	if err != nil {
+		return err
+	}
+	records, err := decodeRecords(resp.Records)
+	if err != nil {
+		return err
+	}
+	inRange, err := leafSet(leaves)
+	if err != nil {
+		return err
+	}
+
+	if repair {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	} else {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+
+	if db.seq < resp.Seq {
+		divergence.Lagging = true
+	}
+
+	var repairs []*communication.LogRecord
+	leader := map[string]bool{}
+	for _, record := range records {
+		leader[string(record.Key)] = true
+		entry, err := db.get(record.Key)
+		switch {
+		case err != nil:
+			divergence.Missing = append(divergence.Missing, record.Key)
+		case string(entry.Val) != string(record.Val):
+			divergence.Different = append(divergence.Different, record.Key)
+		default:
+			continue
+		}
+		repairs = append(repairs, record)
+	}
+	var extra [][]byte
+	for _, entry := range db.Entries {
+		if inRange[merkleLeaf(entry.Key)] && !leader[string(entry.Key)] {
+			extra = append(extra, entry.Key)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool { return string(extra[i]) < string(extra[j]) })
+	for _, key := range extra {
+		divergence.Extra = append(divergence.Extra, key)
+		repairs = append(repairs, &communication.LogRecord{Op: communication.Operation_DELETE, Key: key})
+	}
+
+	if !repair || len(repairs) == 0 {
+		return nil
+	}
+	if db.seq > resp.Seq {
+		divergence.Repaired = false
+		return nil
+	}
+	fmt.Printf("\nRepairing %d keys that differ from the leader", len(repairs))
+	/* Committed without queueing them for our own replicas, see the top of the file */
+	for _, record := range repairs {
+		err := db.commit(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) leaderRequest(ctx context.Context, client *distdbclient.Client, req *communication.Request) (*communication.Response, error) {
+	req.Token = db.config.ReplicationToken
+	resp, err := client.DoContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != communication.Status_SUCCESS {
+		return nil, fmt.Errorf("%s refused: %s", req.Op, resp.Error)
+	}
+	return resp, nil
+}
+
+/* Serve MERKLE, MERKLE_RANGE and CHECK_REPLICA */
+func (db *DB) handleAntiEntropy(clientRequest *communication.Request, resp *communication.Response) error {
+	var err error
+	switch clientRequest.Op {
+	case communication.Operation_MERKLE:
+		resp.Hashes, resp.Seq, err = db.merkleHashes(clientRequest.Nodes)
+	case communication.Operation_MERKLE_RANGE:
+		var records []*communication.LogRecord
+		records, resp.Seq, err = db.merkleRange(clientRequest.Nodes)
+		if err == nil {
+			resp.Records, err = encodeRecords(records)
+		}
+	case communication.Operation_CHECK_REPLICA:
+		var divergence *communication.Divergence
+		divergence, err = db.CheckReplica(context.Background(), clientRequest.Repair)
+		if err == nil {
+			resp.Divergence, err = proto.Marshal(divergence)
+		}
+	default:
+		err = ErrInvalidOperation
+	}
+	return err
+}
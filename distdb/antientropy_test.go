@@ -0,0 +1,246 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+/* Leaves kept up to date write by write match ones computed from scratch */
+func TestMerkleLeaves(t *testing.T) {
+	db, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := []byte(fmt.Sprintf("key%d", r.Intn(500)))
+		if r.Intn(4) == 0 {
+			db.Delete(key)
+			continue
+		}
+		require.NoError(t, db.Put(key, []byte(fmt.Sprint(r.Int()))))
+	}
+
+	want := make([]uint64, MERKLE_LEAVES)
+	for _, entry := range db.Entries {
+		want[merkleLeaf(entry.Key)] ^= entryHash(entry.Key, entry.Val)
+	}
+	require.Equal(t, want, db.merkleLeaves)
+
+	/* Equal entries, equal trees, whatever order they were written in */
+	other, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+	for i := len(db.Entries) - 1; i >= 0; i-- {
+		require.NoError(t, other.Put(db.Entries[i].Key, db.Entries[i].Val))
+	}
+	require.Equal(t, db.merkleTree(), other.merkleTree())
+	require.NoError(t, other.Put([]byte("key0"), []byte("changed")))
+	require.NotEqual(t, db.merkleTree()[1], other.merkleTree()[1])
+}
+
+/* Corrupt the follower behind the leader's back */
+func diverge(db *DB, records ...*communication.LogRecord) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, record := range records {
+		db.apply(record)
+	}
+}
+
+func TestCheckReplica(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3138"}
+	follower := startDB(t, DBConfig{Persist: true, DiskFileName: t.TempDir() + "/dbdump", Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3139",
+		LeaderConfig: &leaderConfig, ReplicationToken: "secret", RepairInterval: -1})
+	leader := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3138", ReplicationToken: "secret",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3139"}}, ReplicationMode: REPLICATION_SYNC_ALL})
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3139", MaxRedirects: -1})
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* In sync */
+	divergence, err := client.CheckReplica(context.Background(), false, "secret")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2000), divergence.LeaderSeq)
+	require.Equal(t, uint64(2000), divergence.Seq)
+	require.Empty(t, divergence.Ranges)
+
+	diverge(follower,
+		&communication.LogRecord{Op: communication.Operation_PUT, Key: []byte("key1"), Val: []byte("corrupted")},
+		&communication.LogRecord{Op: communication.Operation_DELETE, Key: []byte("key2")},
+		&communication.LogRecord{Op: communication.Operation_PUT, Key: []byte("stray"), Val: []byte("val")},
+	)
+
+	/* Reported, and left as is */
+	divergence, err = client.CheckReplica(context.Background(), false, "secret")
+	require.NoError(t, err)
+	require.Len(t, divergence.Ranges, 3)
+	require.Equal(t, [][]byte{[]byte("key1")}, divergence.Different)
+	require.Equal(t, [][]byte{[]byte("key2")}, divergence.Missing)
+	require.Equal(t, [][]byte{[]byte("stray")}, divergence.Extra)
+	require.False(t, divergence.Repaired)
+	val, err := follower.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("corrupted"), val)
+
+	/* Repaired */
+	divergence, err = client.CheckReplica(context.Background(), true, "secret")
+	require.NoError(t, err)
+	require.Len(t, divergence.Ranges, 3)
+	require.True(t, divergence.Repaired)
+	divergence, err = client.CheckReplica(context.Background(), false, "secret")
+	require.NoError(t, err)
+	require.Empty(t, divergence.Ranges)
+	val, err = follower.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+	_, err = follower.Get([]byte("stray"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	require.Equal(t, uint64(2000), follower.AppliedSeq())
+
+	/* Replication carries on as before */
+	require.NoError(t, leader.Put([]byte("key2"), []byte("new")))
+	val, err = follower.Get([]byte("key2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), val)
+
+	/* Only for followers, and only with the token */
+	_, err = client.CheckReplica(context.Background(), false, "guess")
+	require.ErrorContains(t, err, ErrUnauthorized.Error())
+	leaderClient, err := distdbclient.NewClient(leaderConfig)
+	require.NoError(t, err)
+	defer leaderClient.Close()
+	_, err = leaderClient.CheckReplica(context.Background(), false, "secret")
+	require.ErrorContains(t, err, ErrInvalidOperation.Error())
+}
+
+/* The repairs are logged, a restarted follower still has them */
+func TestCheckReplicaPersists(t *testing.T) {
+	fileName := t.TempDir() + "/dbdump"
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3140"}
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3140"})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+
+	follower, err := NewDB(DBConfig{ReplicationToken: "secret", Persist: true, DiskFileName: fileName, Role: FOLLOWER, LeaderConfig: &leaderConfig, RepairInterval: -1})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == 100 }, time.Second, 10*time.Millisecond)
+	diverge(follower, &communication.LogRecord{Op: communication.Operation_DELETE, Key: []byte("key7")})
+	_, err = follower.CheckReplica(context.Background(), true)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, follower.Shutdown(ctx))
+
+	follower, err = NewDB(DBConfig{ReplicationToken: "secret", Persist: true, DiskFileName: fileName, Role: FOLLOWER})
+	require.NoError(t, err)
+	defer follower.Close()
+	val, err := follower.Get([]byte("key7"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+	require.Equal(t, uint64(100), follower.AppliedSeq())
+}
+
+/* Followers find and repair divergence on their own */
+func TestAntiEntropy(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3141"}
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3141"})
+	follower, err := NewDB(DBConfig{ReplicationToken: "secret", Role: FOLLOWER, LeaderConfig: &leaderConfig, CatchUpInterval: 10 * time.Millisecond, RepairInterval: 20 * time.Millisecond})
+	require.NoError(t, err)
+	defer follower.Shutdown(context.Background())
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == 100 }, time.Second, 10*time.Millisecond)
+
+	diverge(follower, &communication.LogRecord{Op: communication.Operation_PUT, Key: []byte("key3"), Val: []byte("corrupted")})
+	require.Eventually(t, func() bool {
+		val, err := follower.Get([]byte("key3"))
+		return err == nil && string(val) == "val"
+	}, time.Second, 10*time.Millisecond)
+}
+
+/* Differences found while the follower is behind are flagged, they may just be writes it has yet to get */
+func TestCheckReplicaLagging(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3159"}
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3159"})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+
+	follower, err := NewDB(DBConfig{ReplicationToken: "secret", Role: FOLLOWER, LeaderConfig: &leaderConfig, CatchUpInterval: time.Hour, RepairInterval: -1})
+	require.NoError(t, err)
+	defer follower.Shutdown(context.Background())
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == 100 }, time.Second, 10*time.Millisecond)
+
+	divergence, err := follower.CheckReplica(context.Background(), false)
+	require.NoError(t, err)
+	require.Empty(t, divergence.Ranges)
+	require.False(t, divergence.Lagging)
+
+	/* Not replicated, and not fetched before the next hour */
+	require.NoError(t, leader.Put([]byte("late"), []byte("val")))
+	divergence, err = follower.CheckReplica(context.Background(), false)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("late")}, divergence.Missing)
+	require.Equal(t, uint64(100), divergence.Seq)
+	require.Equal(t, uint64(101), divergence.LeaderSeq)
+	require.True(t, divergence.Lagging)
+}
+
+/* Repairs aren't passed down the chain, a chained replica repairs against the follower it replicates from */
+func TestCheckReplicaChained(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3160"}
+	middleConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3161"}
+	tailConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3162"}
+	tail := startDB(t, DBConfig{ReplicationToken: "secret", Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3162",
+		LeaderConfig: &middleConfig, RepairInterval: -1})
+	middle := startDB(t, DBConfig{ReplicationToken: "secret", Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3161",
+		LeaderConfig: &leaderConfig, ReplicaConfigs: []distdbclient.ClientConfig{tailConfig}, RepairInterval: -1})
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3160",
+		ReplicaConfigs: []distdbclient.ClientConfig{middleConfig}})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	require.Eventually(t, func() bool { return tail.AppliedSeq() == 100 }, time.Second, 10*time.Millisecond)
+
+	/* As if the write never made it to the middle, and so never went on down */
+	lost := &communication.LogRecord{Op: communication.Operation_DELETE, Key: []byte("key5")}
+	diverge(middle, lost)
+	diverge(tail, lost)
+
+	_, err := middle.CheckReplica(context.Background(), true)
+	require.NoError(t, err)
+	val, err := middle.Get([]byte("key5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+	_, err = tail.Get([]byte("key5"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	divergence, err := tail.CheckReplica(context.Background(), true)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("key5")}, divergence.Missing)
+	require.False(t, divergence.Lagging)
+	require.True(t, divergence.Repaired)
+	val, err = tail.Get([]byte("key5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+
+	/* And replication down the chain carries on as before */
+	require.NoError(t, leader.Put([]byte("key5"), []byte("new")))
+	require.Eventually(t, func() bool {
+		val, err := tail.Get([]byte("key5"))
+		return err == nil && string(val) == "new"
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,42 @@
+package distdb
+
+import (
+	"fmt"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	A batch is a single BATCH LogRecord carrying its PUTs and DELETEs. It is written like any other write: one
+	sequence number, one log append (and fsync), one replication or raft entry, and it is applied under one hold of
+	db.mu. So either every write in it survives a crash and reaches the followers, or none does, and readers never
+	see part of it. Within a batch later writes to a key win over earlier ones.
+
+	DELETEs of keys that don't exist are skipped rather than failing the batch.
+*/
+
+/* Apply the PUTs and DELETEs in batch atomically, replicating them as a single write. An empty batch is a no-op */
+func (db *DB) WriteBatch(batch []*communication.LogRecord) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.write(&communication.LogRecord{Op: communication.Operation_BATCH, Batch: batch})
+}
+
+/* Check that record's writes can all be applied, so that none is applied if one can't */
+func checkBatch(record *communication.LogRecord) error {
+	for _, write := range record.Batch {
+		if write.Op != communication.Operation_PUT && write.Op != communication.Operation_DELETE {
+			return fmt.Errorf("%w: %s in a batch", ErrInvalidOperation, write.Op)
+		}
+	}
+	return nil
+}
+
+/* The PUTs and DELETEs record is made of, itself unless it is a batch */
+func batchWrites(record *communication.LogRecord) []*communication.LogRecord {
+	if record.Op == communication.Operation_BATCH {
+		return record.Batch
+	}
+	return []*communication.LogRecord{record}
+}
@@ -0,0 +1,138 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: t.TempDir() + "/dbdump"}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("gone"), []byte("val")))
+
+	/* One write, later writes to a key win, missing keys are no trouble to delete */
+	require.NoError(t, db.WriteBatch([]*communication.LogRecord{
+		{Op: communication.Operation_PUT, Key: []byte("key1"), Val: []byte("val1")},
+		{Op: communication.Operation_PUT, Key: []byte("key2"), Val: []byte("old")},
+		{Op: communication.Operation_PUT, Key: []byte("key2"), Val: []byte("val2")},
+		{Op: communication.Operation_DELETE, Key: []byte("gone")},
+		{Op: communication.Operation_DELETE, Key: []byte("missing")},
+	}))
+	require.Equal(t, uint64(2), db.AppliedSeq())
+
+	/* All or nothing */
+	err = db.WriteBatch([]*communication.LogRecord{
+		{Op: communication.Operation_PUT, Key: []byte("key3"), Val: []byte("val3")},
+		{Op: communication.Operation_ADD_MEMBER, Key: []byte("n1"), Val: []byte("localhost:1")},
+	})
+	require.ErrorIs(t, err, ErrInvalidOperation)
+	require.Equal(t, uint64(2), db.AppliedSeq())
+	_, err = db.Get([]byte("key3"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	require.NoError(t, db.WriteBatch(nil))
+	require.Equal(t, uint64(2), db.AppliedSeq())
+
+	/* Replayed from the log as it was applied */
+	require.NoError(t, db.Close())
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, uint64(2), db.AppliedSeq())
+	require.Equal(t, []DBEntry{newDBEntry([]byte("key1"), []byte("val1"), 2), newDBEntry([]byte("key2"), []byte("val2"), 2)}, db.Scan(nil, nil, 0))
+}
+
+/* A batch reaches followers as the single write it is */
+func TestBatchReplication(t *testing.T) {
+	follower := startDB(t, DBConfig{ReplicationToken: "secret", Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3145"})
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3144",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3145"}}, ReplicationMode: REPLICATION_SYNC_ALL})
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3144"})
+	require.NoError(t, err)
+	defer client.Close()
+
+	var batch distdbclient.Batch
+	for i := 0; i < 1000; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val"))
+	}
+	batch.Delete([]byte("key0"))
+	require.NoError(t, client.WriteBatch(context.Background(), &batch))
+
+	for _, db := range []*DB{leader, follower} {
+		require.Equal(t, uint64(1), db.AppliedSeq())
+		require.Len(t, db.Entries, 999)
+		_, err := db.Get([]byte("key0"))
+		require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	}
+
+	/* Followers turn batches away like any other write */
+	followerClient, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3145", MaxRedirects: -1})
+	require.NoError(t, err)
+	defer followerClient.Close()
+	var notLeader *distdbclient.NotLeaderError
+	require.ErrorAs(t, followerClient.WriteBatch(context.Background(), &batch), &notLeader)
+}
+
+/* Batches stay within a group */
+func TestShardedBatch(t *testing.T) {
+	groups := []sharding.Group{{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3146"}}, {ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3147"}}}
+	shardMap, err := sharding.NewShardMap(1, groups, 0)
+	require.NoError(t, err)
+	dbs := map[string]*DB{
+		"g0": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3146", ShardMap: shardMap, ShardGroup: "g0"}),
+		"g1": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3147", ShardMap: shardMap, ShardGroup: "g1"}),
+	}
+
+	keys := map[string][][]byte{}
+	for i := 0; len(keys["g0"]) < 10 || len(keys["g1"]) < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		owner := shardMap.Owner(key).ID
+		keys[owner] = append(keys[owner], key)
+	}
+
+	client, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, shardMap)
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* Each group's keys go to it */
+	for id, groupKeys := range keys {
+		var batch distdbclient.Batch
+		for _, key := range groupKeys {
+			batch.Put(key, key)
+		}
+		require.NoError(t, client.WriteBatch(context.Background(), &batch))
+		require.Len(t, dbs[id].Entries, len(groupKeys))
+	}
+
+	/* Mixed batches are turned away, by the client and by the server if it gets one anyway */
+	var mixed distdbclient.Batch
+	mixed.Put(keys["g0"][0], []byte("mixed"))
+	mixed.Put(keys["g1"][0], []byte("mixed"))
+	require.ErrorIs(t, client.WriteBatch(context.Background(), &mixed), distdbclient.ErrWrongShard)
+
+	plain, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3146"})
+	require.NoError(t, err)
+	defer plain.Close()
+	require.ErrorIs(t, plain.WriteBatch(context.Background(), &mixed), distdbclient.ErrWrongShard)
+
+	/* The redirect is for the key that isn't ours, not the batch's first */
+	err = dbs["g0"].shardedWrite(&communication.LogRecord{Op: communication.Operation_BATCH, Batch: []*communication.LogRecord{
+		{Op: communication.Operation_PUT, Key: keys["g0"][1], Val: []byte("mixed")},
+		{Op: communication.Operation_PUT, Key: keys["g1"][1], Val: []byte("mixed")},
+	}})
+	var wrongShard *wrongShardError
+	require.ErrorAs(t, err, &wrongShard)
+	require.ErrorIs(t, err, ErrWrongShard)
+	require.Equal(t, keys["g1"][1], wrongShard.key)
+	val, err := dbs["g0"].Get(keys["g0"][0])
+	require.NoError(t, err)
+	require.Equal(t, keys["g0"][0], val)
+}
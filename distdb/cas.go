@@ -0,0 +1,106 @@
+package distdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	Every key has a version: that of the write that last set it, which is the write's sequence number unless that
+	isn't above the version floor, the highest version given out so far. Then it is one above the floor. It goes up
+	with every write to the key, and a key that is deleted and put again doesn't get an old version back. Versions
+	travel with their entries in snapshots and repairs (LogRecord.KeyVersion), and with keys handed over to another
+	shard group: the SHARD_TRANSFER record applying them carries the sending group's floor, and raises ours to it, so
+	that versions at the new owner never go back to one the key had at the old. A key written while it is being handed
+	over gets a version of the new owner's there, a CAS by the version read from the old owner fails once it has moved.
+	The floor is kept in snapshots as a SHARD_TRANSFER record of no writes. Keys written before versions existed have
+	version 0.
+
+	A CAS puts a value only if a condition on its key holds, for optimistic updates: read the key along with its
+	version, and put the new value if the version is still the same. Outside of raft the condition is checked under
+	db.mu right before the write is given its sequence number, and the write is logged and replicated as a plain PUT.
+	A raft leader can't know what the key will be by the time a write commits, so CAS records are logged as they are
+	and every node checks the condition as it applies them, all coming to the same answer. One that doesn't hold is
+	applied as a no-op.
+*/
+
+var ErrConditionFailed = errors.New("condition failed")
+
+/* Get along with key's version */
+func (db *DB) GetWithVersion(key []byte) (val []byte, version uint64, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	entry, err := db.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return entry.Val, entry.Version, nil
+}
+
+/* Put key if it is at version, returning its new version. ErrConditionFailed if it isn't, or doesn't exist */
+func (db *DB) PutIfVersion(key, val []byte, version uint64) (uint64, error) {
+	return db.compareAndSwap(&communication.LogRecord{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VERSION_EQUALS, ExpectedVersion: version}, db.write)
+}
+
+/* Put key if it doesn't exist, returning its version. ErrConditionFailed if it does */
+func (db *DB) PutIfAbsent(key, val []byte) (uint64, error) {
+	return db.compareAndSwap(&communication.LogRecord{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_ABSENT}, db.write)
+}
+
+/* Put key if its value is expected, returning its new version. ErrConditionFailed if it isn't, or doesn't exist */
+func (db *DB) PutIfValue(key, val, expected []byte) (uint64, error) {
+	return db.compareAndSwap(&communication.LogRecord{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VALUE_EQUALS, ExpectedVal: expected}, db.write)
+}
+
+/* Write the CAS record with write, returning the version it gave the key */
+func (db *DB) compareAndSwap(record *communication.LogRecord, write func(record *communication.LogRecord) error) (uint64, error) {
+	switch record.Condition {
+	case communication.Condition_VERSION_EQUALS, communication.Condition_ABSENT, communication.Condition_VALUE_EQUALS:
+	default:
+		/* Checked before anything is logged, an unknown condition would fail every node applying it */
+		return 0, fmt.Errorf("%w: condition %s", ErrInvalidOperation, record.Condition)
+	}
+
+	/* The version depends on the floor when the record is applied, which is only known then */
+	db.mu.Lock()
+	db.casVersions[record] = 0
+	db.mu.Unlock()
+	err := write(record)
+	db.mu.Lock()
+	version := db.casVersions[record]
+	delete(db.casVersions, record)
+	db.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+/* The record carrying the version floor in a snapshot, nil if the floor isn't above seq and the snapshot needs none */
+func versionFloorRecord(floor, seq uint64) *communication.LogRecord {
+	if floor <= seq {
+		return nil
+	}
+	return &communication.LogRecord{Op: communication.Operation_SHARD_TRANSFER, KeyVersion: floor}
+}
+
+/* ErrConditionFailed unless the CAS record's condition holds. Call this only with db.Mutex held */
+func (db *DB) checkCondition(record *communication.LogRecord) error {
+	entry, err := db.get(record.Key)
+	exists := err == nil
+
+	switch {
+	case record.Condition == communication.Condition_ABSENT && !exists:
+		return nil
+	case record.Condition == communication.Condition_VERSION_EQUALS && exists && entry.Version == record.ExpectedVersion:
+		return nil
+	case record.Condition == communication.Condition_VALUE_EQUALS && exists && bytes.Equal(entry.Val, record.ExpectedVal):
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrConditionFailed, record.Condition)
+}
@@ -0,0 +1,168 @@
+package distdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: t.TempDir() + "/dbdump"}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	version, err := db.PutIfAbsent([]byte("key"), []byte("val1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), version)
+	_, err = db.PutIfAbsent([]byte("key"), []byte("val2"))
+	require.ErrorIs(t, err, ErrConditionFailed)
+
+	/* Versions go up with every write to the key */
+	require.NoError(t, db.Put([]byte("other"), []byte("val")))
+	require.NoError(t, db.Put([]byte("key"), []byte("val2")))
+	val, version, err := db.GetWithVersion([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val2"), val)
+	require.Equal(t, uint64(3), version)
+
+	_, err = db.PutIfVersion([]byte("key"), []byte("stale"), 1)
+	require.ErrorIs(t, err, ErrConditionFailed)
+	version, err = db.PutIfVersion([]byte("key"), []byte("val3"), version)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), version)
+
+	_, err = db.PutIfValue([]byte("key"), []byte("val4"), []byte("val2"))
+	require.ErrorIs(t, err, ErrConditionFailed)
+	_, err = db.PutIfValue([]byte("key"), []byte("val4"), []byte("val3"))
+	require.NoError(t, err)
+
+	/* Missing keys are at no version, and don't have any value */
+	_, err = db.PutIfVersion([]byte("missing"), []byte("val"), 0)
+	require.ErrorIs(t, err, ErrConditionFailed)
+	_, err = db.PutIfValue([]byte("missing"), []byte("val"), nil)
+	require.ErrorIs(t, err, ErrConditionFailed)
+
+	/* Put again after a delete, the key doesn't go back to an old version */
+	require.NoError(t, db.Delete([]byte("key")))
+	version, err = db.PutIfAbsent([]byte("key"), []byte("val5"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), version)
+
+	/* Failed conditions write nothing */
+	require.Equal(t, uint64(7), db.AppliedSeq())
+	_, err = db.compareAndSwap(&communication.LogRecord{Op: communication.Operation_CAS, Key: []byte("key")}, db.write)
+	require.ErrorIs(t, err, ErrInvalidOperation)
+
+	/* Versions survive the log being replayed, and snapshots */
+	require.NoError(t, db.Close())
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	_, version, err = db.GetWithVersion([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), version)
+	db.mu.Lock()
+	require.NoError(t, db.compact())
+	db.mu.Unlock()
+	require.NoError(t, db.Close())
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	_, version, err = db.GetWithVersion([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), version)
+	_, version, err = db.GetWithVersion([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), version)
+}
+
+/* Clients racing to increment a counter with optimistic updates lose none of them */
+func TestClientCompareAndSwap(t *testing.T) {
+	follower := startDB(t, DBConfig{ReplicationToken: "secret", Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3152"})
+	startDB(t, DBConfig{ReplicationToken: "secret", Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3151",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3152"}}, ReplicationMode: REPLICATION_SYNC_ALL})
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3151"})
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx := context.Background()
+	counter := []byte("counter")
+	_, err = client.PutIfAbsent(ctx, counter, binary.BigEndian.AppendUint64(nil, 0))
+	require.NoError(t, err)
+	_, err = client.PutIfAbsent(ctx, counter, binary.BigEndian.AppendUint64(nil, 0))
+	require.ErrorIs(t, err, distdbclient.ErrConditionFailed)
+
+	const workers, increments = 5, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				val, version, err := client.GetWithVersion(ctx, counter)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, err = client.PutIfVersion(ctx, counter, binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(val)+1), version)
+				if errors.Is(err, distdbclient.ErrConditionFailed) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				done++
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, version, err := client.GetWithVersion(ctx, counter)
+	require.NoError(t, err)
+	require.Equal(t, uint64(workers*increments), binary.BigEndian.Uint64(val))
+
+	/* Followers get the same versions */
+	val, followerVersion, err := follower.GetWithVersion(counter)
+	require.NoError(t, err)
+	require.Equal(t, uint64(workers*increments), binary.BigEndian.Uint64(val))
+	require.Equal(t, version, followerVersion)
+
+	_, err = client.PutIfValue(ctx, counter, []byte("reset"), []byte("wrong"))
+	require.ErrorIs(t, err, distdbclient.ErrConditionFailed)
+	_, err = client.PutIfValue(ctx, counter, []byte("reset"), val)
+	require.NoError(t, err)
+}
+
+/* The version floor survives compaction, versions given after a restart are still above keys handed over to us */
+func TestVersionFloorSnapshot(t *testing.T) {
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: t.TempDir() + "/dbdump"}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	record, err := proto.Marshal(&communication.LogRecord{Op: communication.Operation_PUT, Key: []byte("moved"), Val: []byte("val"), KeyVersion: 500})
+	require.NoError(t, err)
+	require.NoError(t, db.applyTransfer([][]byte{record}, 1000))
+	_, version, err := db.GetWithVersion([]byte("moved"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(500), version)
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	version, err = db.PutIfAbsent([]byte("key"), []byte("val"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1001), version)
+	_, got, err := db.GetWithVersion([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, version, got)
+}
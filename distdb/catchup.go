@@ -0,0 +1,326 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Followers catch up by pulling from the leader: on startup, every CatchUpInterval and whenever the leader pushes a
+	write that skips ahead of them, a follower sends FETCH with the last sequence number it applied and applies the
+	writes that come back, until it has everything the leader has.
+
+	The leader answers out of its replication log, the last ReplicationLogSize writes kept in memory (refilled from the
+	write-ahead log on startup). A follower that is further behind than that gets a snapshot of every live entry instead,
+	which replaces its state wholesale. Snapshots go out a page at a time in key order, the follower sends back the
+	continuation of each page as key to get the next one.
+*/
+
+const (
+	DEFAULT_REPLICATION_LOG_SIZE = 10000
+	DEFAULT_CATCH_UP_INTERVAL    = time.Second
+	FETCH_BATCH_SIZE             = 1000    /* Most writes or snapshot entries returned by a single FETCH */
+	FETCH_PAGE_BYTES             = 4 << 20 /* Most encoded bytes of writes or snapshot entries returned by a single FETCH, see fitsFetchPage */
+)
+
+/* Keep record in the replication log, dropping the oldest writes past ReplicationLogSize. Call this only with db.Mutex held */
+func (db *DB) retain(record *communication.LogRecord) {
+	if record.Seq == 0 {
+		return
+	}
+
+	/* The log has to be contiguous for fetch to index into it */
+	if len(db.replLog) > 0 && db.replLog[len(db.replLog)-1].Seq+1 != record.Seq {
+		db.replLog = nil
+	}
+	db.replLog = append(db.replLog, record)
+
+	size := db.config.ReplicationLogSize
+	if size <= 0 {
+		size = DEFAULT_REPLICATION_LOG_SIZE
+	}
+	if len(db.replLog) > size {
+		db.replLog = db.replLog[len(db.replLog)-size:]
+	}
+}
+
+/*
+	Writes after sequence number after, a page of them (see fitsFetchPage), along with the last sequence number we applied.
+	If the replication log no longer goes back that far the first page of a snapshot is returned instead, the live entries
+	as PUTs with snapshot set and next the key to ask for the next page from (nil on the last one). Pages after the first
+	are asked for with from set, regardless of after.
+*/
+func (db *DB) fetch(after uint64, from []byte) (records []*communication.LogRecord, seq uint64, snapshot bool, next []byte) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if from != nil {
+		records, next = db.snapshotPage(from)
+		return records, db.seq, true, next
+	}
+
+	if after >= db.seq {
+		return nil, db.seq, false, nil
+	}
+
+	if len(db.replLog) > 0 && db.replLog[0].Seq <= after+1 {
+		start := int(after + 1 - db.replLog[0].Seq)
+		size, end := 0, start
+		for ; end < len(db.replLog) && db.fitsFetchPage(end-start, size, db.replLog[end]); end++ {
+			size += proto.Size(db.replLog[end])
+		}
+		return db.replLog[start:end], db.seq, false, nil
+	}
+
+	records, next = db.snapshotPage(nil)
+	return records, db.seq, true, next
+}
+
+/*
+	Live entries from key from on as PUTs, and the key the next page starts from if there is one. The first page starts
+	with the version floor if the snapshot needs it, its few bytes are left out of the page's cap. Call this only with
+	db.Mutex held
+*/
+func (db *DB) snapshotPage(from []byte) (records []*communication.LogRecord, next []byte) {
+	size := 0
+	more := db.walk(from, nil, func(entry *DBEntry) bool {
+		record := entryRecord(entry)
+		if !db.fitsFetchPage(len(records), size, record) {
+			return false
+		}
+		records = append(records, record)
+		size += proto.Size(record)
+		return true
+	})
+	if more {
+		next = after(records[len(records)-1].Key)
+	}
+	if floor := versionFloorRecord(db.versionFloor, db.seq); floor != nil && from == nil {
+		records = append([]*communication.LogRecord{floor}, records...)
+	}
+	return records, next
+}
+
+/*
+	Whether record can go in a FETCH page that has count records of size encoded bytes so far. Pages are capped at
+	FETCH_BATCH_SIZE records and FETCH_PAGE_BYTES (or half of MaxMessageSize if that is smaller, leaving room for the
+	rest of the response), but always take their first record.
+*/
+func (db *DB) fitsFetchPage(count, size int, record *communication.LogRecord) bool {
+	if count == 0 {
+		return true
+	}
+	maxBytes := FETCH_PAGE_BYTES
+	if db.config.MaxMessageSize > 0 && db.config.MaxMessageSize/2 < maxBytes {
+		maxBytes = db.config.MaxMessageSize / 2
+	}
+	return count < FETCH_BATCH_SIZE && size+proto.Size(record) <= maxBytes
+}
+
+/*
+	Replace our state with a snapshot as of sequence number seq, unless we are already past it. A snapshot that isn't all
+	PUTs, bar the version floor (see cas.go), is refused untouched
+*/
+func (db *DB) installSnapshot(records []*communication.LogRecord, seq uint64) error {
+	for _, record := range records {
+		if record.Op != communication.Operation_PUT && (record.Op != communication.Operation_SHARD_TRANSFER || len(record.Batch) > 0) {
+			return fmt.Errorf("%w: %s in snapshot", ErrInvalidOperation, record.Op)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if seq <= db.seq {
+		return nil
+	}
+
+	db.Entries, db.index, db.sorted, db.merkleLeaves = []*DBEntry{}, map[string]*DBEntry{}, newSkipList(), make([]uint64, MERKLE_LEAVES)
+	db.versionFloor = 0
+	for _, record := range records {
+		if record.Op == communication.Operation_SHARD_TRANSFER {
+			db.versionFloor = record.KeyVersion
+			continue
+		}
+		db.set(record.Key, record.Val, record.KeyVersion)
+	}
+	db.seq = seq
+	db.replLog = nil
+
+	/* The log no longer leads up to our state, start over from a fresh snapshot */
+	if db.config.Persist {
+		return db.compact()
+	}
+	return nil
+}
+
+/* Start pulling from LeaderConfig if we have one */
+func initCatchUp(db *DB) error {
+	if db.config.LeaderConfig == nil {
+		return nil
+	}
+
+	/* The leader may well not be up yet, we'll keep trying */
+	config := *db.config.LeaderConfig
+	config.LazyConnect = true
+	client, err := distdbclient.NewClient(config)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db.behind = make(chan struct{}, 1)
+	db.catchUpCancel = cancel
+	db.catchUpDone = make(chan struct{})
+	go db.catchUp(ctx, client)
+
+	return nil
+}
+
+func (db *DB) catchUp(ctx context.Context, client *distdbclient.Client) {
+	defer close(db.catchUpDone)
+	defer client.Close()
+
+	interval := db.config.CatchUpInterval
+	if interval <= 0 {
+		interval = DEFAULT_CATCH_UP_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	/* Anti-entropy runs in between fetches, see antientropy.go */
+	var antiEntropy <-chan time.Time
+	repairInterval := db.config.RepairInterval
+	if repairInterval == 0 {
+		repairInterval = DEFAULT_REPAIR_INTERVAL
+	}
+	if repairInterval > 0 {
+		antiEntropyTicker := time.NewTicker(repairInterval)
+		defer antiEntropyTicker.Stop()
+		antiEntropy = antiEntropyTicker.C
+	}
+
+	for {
+		err := db.syncFromLeader(ctx, client)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("\nError catching up from leader (last applied %d): %v", db.AppliedSeq(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-db.behind:
+		case <-antiEntropy:
+			_, err := db.checkReplica(ctx, client, true)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("\nError comparing with leader: %v", err)
+			}
+		}
+	}
+}
+
+/*
+	Fetch and apply until we have every write the leader had when we asked.
+
+	Snapshot pages are gathered until the last one is in and then installed as of the first page's seq. The leader keeps
+	taking writes meanwhile so later pages may already have some of the writes after that, which are fetched and applied
+	again on top of the snapshot right after: puts and deletes end up the same however many times they are applied.
+*/
+func (db *DB) syncFromLeader(ctx context.Context, client *distdbclient.Client) error {
+	var snapshot []*communication.LogRecord
+	var snapshotSeq uint64
+	var from []byte
+	for {
+		resp, err := client.DoContext(ctx, &communication.Request{Op: communication.Operation_FETCH, Seq: db.AppliedSeq(), Key: from, Token: db.config.ReplicationToken})
+		if err != nil {
+			return err
+		}
+		if resp.Status != communication.Status_SUCCESS {
+			return fmt.Errorf("fetch refused: %s", resp.Error)
+		}
+
+		records, err := decodeRecords(resp.Records)
+		if err != nil {
+			return err
+		}
+		if resp.Snapshot {
+			if from == nil {
+				snapshot, snapshotSeq = nil, resp.Seq
+			}
+			snapshot = append(snapshot, records...)
+			if len(resp.Continuation) > 0 {
+				from = resp.Continuation
+				continue
+			}
+
+			fmt.Printf("\nInstalling snapshot from leader as of seq %d", snapshotSeq)
+			err := db.installSnapshot(snapshot, snapshotSeq)
+			if err != nil {
+				return err
+			}
+			snapshot, from = nil, nil
+			continue
+		}
+		for _, record := range records {
+			err := db.applyReplicated(record)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(records) == 0 || db.AppliedSeq() >= resp.Seq {
+			return nil
+		}
+	}
+}
+
+/* Ask the catch-up loop to fetch right away, a no-op if we have no leader to fetch from */
+func (db *DB) signalBehind() {
+	if db.behind == nil {
+		return
+	}
+	select {
+	case db.behind <- struct{}{}:
+	default:
+	}
+}
+
+/* Stop pulling from the leader, waiting for an in-progress fetch to be abandoned */
+func (db *DB) stopCatchUp(ctx context.Context) error {
+	if db.catchUpCancel == nil {
+		return nil
+	}
+	db.catchUpCancel()
+	return waitContext(ctx, func() { <-db.catchUpDone })
+}
+
+func encodeRecords(records []*communication.LogRecord) ([][]byte, error) {
+	var encoded [][]byte
+	for _, record := range records {
+		data, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, data)
+	}
+	return encoded, nil
+}
+
+func decodeRecords(encoded [][]byte) ([]*communication.LogRecord, error) {
+	var records []*communication.LogRecord
+	for _, data := range encoded {
+		var record communication.LogRecord
+		err := proto.Unmarshal(data, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+	return records, nil
+}
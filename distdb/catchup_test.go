@@ -0,0 +1,192 @@
+package distdb
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+func requireCaughtUp(t *testing.T, follower, leader *DB, keys int) {
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == leader.AppliedSeq() }, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < keys; i++ {
+		k := []byte(fmt.Sprintf("key%d", i))
+		vLeader, err := leader.Get(k)
+		require.NoError(t, err)
+		vFollower, err := follower.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, vLeader, vFollower)
+	}
+}
+
+/* A follower that is down when the leader starts, and again later, gets every write it missed once it is back */
+func TestFollowerCatchUp(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3122"}
+	followerConfig := DBConfig{ReplicationToken: "secret", Persist: true, Role: FOLLOWER, DiskFileName: filepath.Join(t.TempDir(), "dbdump"),
+		ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3123", LeaderConfig: &leaderConfig, CatchUpInterval: 50 * time.Millisecond}
+
+	/* Follower isn't up yet */
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3122",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3123"}}})
+	for i := 0; i < 10; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1")))
+	}
+
+	follower := startDB(t, followerConfig)
+	requireCaughtUp(t, follower, leader, 10)
+
+	/* Follower goes down, misses writes, comes back from disk */
+	require.NoError(t, follower.Shutdown(contextWithTimeout(t, time.Second)))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v2")))
+	}
+	require.NoError(t, leader.Delete([]byte("key19")))
+
+	follower = startDB(t, followerConfig)
+	requireCaughtUp(t, follower, leader, 19)
+	_, err := follower.Get([]byte("key19"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	/* And keeps up with new writes */
+	require.NoError(t, leader.Put([]byte("key0"), []byte("v3")))
+	requireCaughtUp(t, follower, leader, 19)
+}
+
+/* A follower behind the start of the leader's replication log is sent a snapshot, a page at a time */
+func TestFollowerSnapshotCatchUp(t *testing.T) {
+	keys := 2*FETCH_BATCH_SIZE + 20
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3124", ReplicationLogSize: 5})
+	for i := 0; i < keys; i++ {
+		require.NoError(t, leader.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1")))
+	}
+
+	/* Stale state that the snapshot has to replace */
+	followerConfig := DBConfig{ReplicationToken: "secret", Persist: true, Role: FOLLOWER, DiskFileName: filepath.Join(t.TempDir(), "dbdump")}
+	follower, err := NewDB(followerConfig)
+	require.NoError(t, err)
+	require.NoError(t, follower.Put([]byte("stale"), []byte("v0")))
+	require.NoError(t, follower.Close())
+
+	followerConfig.LeaderConfig = &distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3124"}
+	follower, err = NewDB(followerConfig)
+	require.NoError(t, err)
+	defer follower.Shutdown(contextWithTimeout(t, time.Second))
+
+	requireCaughtUp(t, follower, leader, keys)
+	_, err = follower.Get([]byte("stale"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	/* The snapshot made it to disk */
+	require.NoError(t, follower.Shutdown(contextWithTimeout(t, time.Second)))
+	followerConfig.LeaderConfig = nil
+	follower, err = NewDB(followerConfig)
+	require.NoError(t, err)
+	defer follower.Close()
+	require.Equal(t, leader.AppliedSeq(), follower.AppliedSeq())
+	_, err = follower.Get([]byte("stale"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+}
+
+func TestFetch(t *testing.T) {
+	db, err := NewDB(DBConfig{Persist: false, Role: LEADER, ReplicationLogSize: 5})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i%8)), []byte("val")))
+	}
+
+	tcs := []struct {
+		after        uint64
+		seqsWant     []uint64
+		snapshotWant bool
+	}{
+		{after: 10, seqsWant: nil},
+		{after: 12, seqsWant: nil},
+		{after: 8, seqsWant: []uint64{9, 10}},
+		{after: 5, seqsWant: []uint64{6, 7, 8, 9, 10}},
+		{after: 4, snapshotWant: true},
+		{after: 0, snapshotWant: true},
+	}
+
+	for _, tc := range tcs {
+		records, seq, snapshot, next := db.fetch(tc.after, nil)
+		require.Equal(t, uint64(10), seq)
+		require.Equal(t, tc.snapshotWant, snapshot, "after %d", tc.after)
+		require.Nil(t, next)
+		if tc.snapshotWant {
+			require.Len(t, records, 8)
+			continue
+		}
+		var seqs []uint64
+		for _, record := range records {
+			seqs = append(seqs, record.Seq)
+		}
+		require.Equal(t, tc.seqsWant, seqs, "after %d", tc.after)
+	}
+
+	/* Later snapshot pages pick up from where the last one left off, whatever after is */
+	records, seq, snapshot, next := db.fetch(10, []byte("key4"))
+	require.Equal(t, uint64(10), seq)
+	require.True(t, snapshot)
+	require.Nil(t, next)
+	require.Len(t, records, 4)
+	require.Equal(t, []byte("key4"), records[0].Key)
+}
+
+/* Pages are cut short once they hold half of MaxMessageSize, so that large values still fit in a response */
+func TestFetchPageBytes(t *testing.T) {
+	db, err := NewDB(DBConfig{Persist: false, Role: LEADER, ReplicationLogSize: 5, MaxMessageSize: 1000})
+	require.NoError(t, err)
+	val := bytes.Repeat([]byte("v"), 300)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+	}
+
+	/* Out of the replication log */
+	var seqs []uint64
+	for after := uint64(5); after < 10; {
+		records, _, snapshot, _ := db.fetch(after, nil)
+		require.False(t, snapshot)
+		require.Len(t, records, 1)
+		seqs = append(seqs, records[0].Seq)
+		after = records[0].Seq
+	}
+	require.Equal(t, []uint64{6, 7, 8, 9, 10}, seqs)
+
+	/* And as a snapshot */
+	var keys []string
+	records, _, snapshot, next := db.fetch(0, nil)
+	for {
+		require.True(t, snapshot)
+		require.Len(t, records, 1)
+		keys = append(keys, string(records[0].Key))
+		if next == nil {
+			break
+		}
+		records, _, snapshot, next = db.fetch(0, next)
+	}
+	require.Len(t, keys, 10)
+}
+
+/* A snapshot with anything but PUTs in it is refused before it touches our state */
+func TestInstallSnapshotInvalid(t *testing.T) {
+	db, err := NewDB(DBConfig{Persist: false, Role: FOLLOWER})
+	require.NoError(t, err)
+	require.NoError(t, db.applyReplicated(&communication.LogRecord{Seq: 1, Op: communication.Operation_PUT, Key: []byte("k"), Val: []byte("v")}))
+
+	records := []*communication.LogRecord{
+		{Op: communication.Operation_PUT, Key: []byte("k2"), Val: []byte("v2")},
+		{Op: communication.Operation_DELETE, Key: []byte("k")},
+	}
+	require.ErrorIs(t, db.installSnapshot(records, 5), ErrInvalidOperation)
+	require.Equal(t, uint64(1), db.AppliedSeq())
+	v, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+	_, err = db.Get([]byte("k2"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+}
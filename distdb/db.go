@@ -1,22 +1,33 @@
 package distdb
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sync"
+	"time"
 
-	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
 	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
 var ErrKeyDoesNotExist = errors.New("this key does not exist")
 var ErrInvalidOperation = errors.New("invalid operation")
+var ErrServerClosed = errors.New("server closed")
+var ErrOutOfOrder = errors.New("replicated write out of order")
+var ErrNotLeader = errors.New("not the leader")
+var ErrNotFollower = errors.New("replicated write sent to the leader")
+var ErrUnauthorized = errors.New("invalid replication token")
+var ErrNoReplicationToken = errors.New("no replication token configured, replication and admin requests are refused")
 
 /* Roles for the DB */
 const (
@@ -25,66 +36,116 @@ const (
 	FOLLOWER
 )
 
-type ReplicaWorker struct {
-	receiver chan DBEntry
-	config distdbclient.ClientConfig
-	done chan struct{}
-}
+const MAX_PIPELINED_REQUESTS = 128 /* Requests handled at once per connection, further requests aren't read until one is done */
 
 type DBEntry struct {
 	Key, Val []byte
+	Version  uint64 /* Version the write that set Val gave it, see cas.go */
+	pos      int    /* Index in DB.Entries */
 }
 
 type DB struct {
-	Entries []*DBEntry
-	f       *os.File
-	mu      *sync.Mutex
-	config  DBConfig
-	broadcaster chan DBEntry
+	Entries        []*DBEntry
+	index          map[string]*DBEntry /* Key -> entry lookup, entries are shared with Entries */
+	sorted         *skipList           /* Entries in key order, shared with Entries too */
+	wal            *wal
+	snapshotSize   int64
+	seq            uint64                              /* Sequence number of the last applied write */
+	versionFloor   uint64                              /* Versions given from now on are above it, see cas.go */
+	casVersions    map[*communication.LogRecord]uint64 /* CAS records we are writing -> the version they gave their key, see compareAndSwap */
+	mu             *sync.RWMutex
+	config         DBConfig
+	broadcaster    chan *replicatedWrite
+	replicating    bool /* False once the broadcaster is closed, guarded by mu */
 	replicaWorkers []*ReplicaWorker
+	replLog        []*communication.LogRecord /* Most recent writes, in sequence order, for followers to catch up from */
+	merkleLeaves   []uint64                   /* Leaf hashes of the Merkle tree over Entries, see antientropy.go */
+
+	/* Follower catch-up, see catchup.go */
+	behind        chan struct{}
+	catchUpCancel context.CancelFunc
+	catchUpDone   chan struct{}
+
+	/* Raft, nil unless RaftID is set, see raft.go */
+	raft          *raftNode
+	raftTransport *networkTransport
+
+	/* Sharding, see shard.go. Guarded by shardMu, which client requests hold shared */
+	shardMu     *sync.RWMutex
+	shardMap    *sharding.ShardMap /* Nil unless ShardMap is set */
+	shardTarget *sharding.ShardMap /* The map a rebalance is moving to, nil if none is underway */
+	handedOff   map[string]bool    /* Groups that have handed their keys over to their owners in shardTarget */
+	migration   *migration         /* Our keys being handed over, nil if we aren't */
+
+	/* Server state, guarded by connsMu */
+	listener     net.Listener
+	conns        map[net.Conn]struct{}
+	connsMu      *sync.Mutex
+	connsWG      *sync.WaitGroup /* One per open connection */
+	shuttingDown bool
+	shutdownOnce *sync.Once
+	shutdownErr  error
 }
 
 type DBConfig struct {
-	Persist        bool
-	Role           int
-	DiskFileName   string
-	ServerProtocol string
-	ServerHost     string
-	ServerPort     string
-	ReplicaConfigs []distdbclient.ClientConfig
+	Persist            bool
+	Role               int
+	DiskFileName       string
+	ServerProtocol     string
+	ServerHost         string
+	ServerPort         string
+	MaxMessageSize     int /* Largest request or response in bytes, defaults to framing.DEFAULT_MAX_MESSAGE_SIZE */
+	ReplicaConfigs     []distdbclient.ClientConfig
+	LeaderConfig       *distdbclient.ClientConfig /* Followers only, where to fetch missed writes from */
+	ReplicationLogSize int                        /* Recent writes kept for followers to catch up from, defaults to DEFAULT_REPLICATION_LOG_SIZE */
+	CatchUpInterval    time.Duration              /* How often a follower checks for missed writes, defaults to DEFAULT_CATCH_UP_INTERVAL */
+	ReplicationToken   string                     /* Shared secret that replication, raft, anti-entropy, membership and rebalancing requests must carry, empty refuses them all */
+	FollowerReads      bool                       /* Followers serve GETs and scans, possibly stale, instead of redirecting them to the leader */
+	RepairInterval     time.Duration              /* How often a follower compares its entries with the leader's and repairs what differs, defaults to DEFAULT_REPAIR_INTERVAL, negative disables */
 
-}
+	/* Raft, replaces Role, ReplicaConfigs and LeaderConfig when RaftID is set */
+	RaftID             string                               /* This node's ID in RaftPeers */
+	RaftPeers          map[string]distdbclient.ClientConfig /* Every node in the cluster by ID, this one included. Only the initial membership, after that the raft log has the say */
+	RaftJoin           bool                                 /* Start out with no members and wait for the cluster's leader to add us, instead of forming a cluster out of RaftPeers */
+	ElectionTimeout    time.Duration                        /* Defaults to DEFAULT_ELECTION_TIMEOUT, the actual timeout is randomized between this and twice this */
+	HeartbeatInterval  time.Duration                        /* Defaults to DEFAULT_HEARTBEAT_INTERVAL */
+	ReplicationMode    int                                  /* One of REPLICATION_ASYNC (default), REPLICATION_SYNC_ALL or REPLICATION_QUORUM */
+	ReplicationTimeout time.Duration                        /* How long a synchronous write waits for acknowledgements, defaults to DEFAULT_REPLICATION_TIMEOUT */
+	CompactionMinSize  int64                                /* Write-ahead log size in bytes below which the log is never compacted, defaults to DEFAULT_COMPACTION_MIN_SIZE */
+	CompactionRatio    float64                              /* Compact once the log is this many times the size of the snapshot, defaults to DEFAULT_COMPACTION_RATIO */
 
-func (w *ReplicaWorker) String() string {
-	return fmt.Sprintf("Worker: \n Protocol: %s; Host: %s; Port: %s", w.config.ServerProtocol, w.config.ServerHost, w.config.ServerPort)
+	/* Sharding, the whole keyspace is ours when ShardMap is nil */
+	ShardMap   *sharding.ShardMap /* How the keyspace is split between replica groups */
+	ShardGroup string             /* The group in ShardMap this node belongs to */
 }
 
 func NewDB(config DBConfig) (*DB, error) {
-	/* If db is not persistant */
-	db := &DB{Entries: []*DBEntry{}, mu: &sync.Mutex{}, config: config}
-	if !config.Persist {
-		return db, nil
-	}
+	db := &DB{Entries: []*DBEntry{}, index: map[string]*DBEntry{}, sorted: newSkipList(), merkleLeaves: make([]uint64, MERKLE_LEAVES), mu: &sync.RWMutex{}, config: config,
+		casVersions: map[*communication.LogRecord]uint64{}, conns: map[net.Conn]struct{}{}, connsMu: &sync.Mutex{}, connsWG: &sync.WaitGroup{}, shutdownOnce: &sync.Once{}}
 
 	/* Initialize DB */
-
-	/* If persistant open file, get data and keep it in memory */
-	f, err := os.OpenFile(config.DiskFileName, os.O_RDWR|os.O_CREATE, 0777)
+	err := initShards(db)
 	if err != nil {
 		return nil, err
 	}
 
-	var entries []*DBEntry
-	decoder := json.NewDecoder(f)
-	err = decoder.Decode(&entries)
-	if err != nil {
-		if err != io.EOF {
+	/* If persistant get data from disk and keep it in memory */
+	if config.Persist {
+		err = db.loadFromDisk()
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	db.f = f
-	db.Entries = append(db.Entries, entries...)
+	/* Join the raft cluster, which takes care of replication */
+	if config.RaftID != "" {
+		err = initRaft(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return db, nil
+	}
 
 	/* Initialize replicas */
 	err = initReplicas(db)
@@ -92,142 +153,671 @@ func NewDB(config DBConfig) (*DB, error) {
 		return nil, err
 	}
 
+	/* Catch up with the leader */
+	err = initCatchUp(db)
+	if err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
-func initReplicas(db *DB) error {
-
-	/* Initialize a worker + goroutine + client for each worker - to replicate the broadcast k-v */
-	for _, replicaConfig := range db.config.ReplicaConfigs {
-		worker := ReplicaWorker{receiver: make(chan DBEntry, 10), config: replicaConfig}
-		db.replicaWorkers = append(db.replicaWorkers, &worker)
-		client, err := distdbclient.NewClient(replicaConfig)
-		if err != nil {
-			return err
-		}
-
-		go replicate(&worker, client)
+/* Load the last snapshot and replay the write-ahead log on top of it */
+func (db *DB) loadFromDisk() error {
+	legacySnapshot, err := db.loadSnapshot()
+	if err != nil {
+		return err
 	}
 
-	/* Initialize and start broadcast channel */
-	db.broadcaster = make(chan DBEntry, 10)
-	go broadcast(db)
-
-	return nil
-}
+	w, err := openWAL(db.config.DiskFileName + WAL_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
 
-func broadcast(db *DB) {
-	for entry := range db.broadcaster {
-		for _, worker := range db.replicaWorkers {
-			worker.receiver <- entry
+	err = w.replay(func(record *communication.LogRecord) error {
+		err := db.apply(record)
+		if err != nil && !errors.Is(err, ErrConditionFailed) {
+			return err
 		}
+		db.retain(record)
+		return nil
+	})
+	if err != nil {
+		w.close()
+		return err
 	}
-}
+	db.wal = w
 
-func replicate(worker *ReplicaWorker, client *distdbclient.Client) {
-	defer close(worker.done)
-	for entry := range worker.receiver {
-		err := client.Put(entry.Key, entry.Val)
+	/* Migrate legacy JSON snapshots to the protobuf format in place */
+	if legacySnapshot {
+		fmt.Printf("\nMigrating %s to the protobuf on-disk format", db.config.DiskFileName)
+		err = db.compact()
 		if err != nil {
-			fmt.Printf("Error replicating Key: %s; Val: %s; to %s", entry.Key, entry.Val, worker)
+			w.close()
+			return err
 		}
 	}
-	worker.done <- struct{}{}
+
+	return nil
+}
+
+func newDBEntry(key, val []byte, version uint64) DBEntry {
+	return DBEntry{Key: key, Val: val, Version: version}
 }
 
-func newDBEntry(key, val []byte) DBEntry {
-	return DBEntry{Key: key, Val: val}
+/* entry as a PUT that gives it back its version, for snapshots and the like */
+func entryRecord(entry *DBEntry) *communication.LogRecord {
+	return &communication.LogRecord{Op: communication.Operation_PUT, Key: entry.Key, Val: entry.Val, KeyVersion: entry.Version}
 }
 
+/* Serve until Shutdown is called, after which ErrServerClosed is returned */
 func (db *DB) Listen() error {
 	server, err := net.Listen(db.config.ServerProtocol, db.config.ServerHost+":"+db.config.ServerPort)
 	if err != nil {
 		return err
 	}
+
+	db.connsMu.Lock()
+	if db.shuttingDown {
+		db.connsMu.Unlock()
+		server.Close()
+		return ErrServerClosed
+	}
+	db.listener = server
+	db.connsMu.Unlock()
+
 	fmt.Println("Listening...")
 	defer server.Close()
 
 	for {
 		clientConn, err := server.Accept()
 		if err != nil {
+			if db.isShuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		fmt.Println("Accepted Connection...")
 
-		go db.handleConn(clientConn)
+		if !db.trackConn(clientConn) {
+			clientConn.Close()
+			continue
+		}
+		go func() {
+			defer db.untrackConn(clientConn)
+			db.handleConn(clientConn)
+		}()
 	}
 }
 
+func (db *DB) isShuttingDown() bool {
+	db.connsMu.Lock()
+	defer db.connsMu.Unlock()
+	return db.shuttingDown
+}
+
+/* Register an accepted connection so that Shutdown can drain it, false if we are already shutting down */
+func (db *DB) trackConn(conn net.Conn) bool {
+	db.connsMu.Lock()
+	defer db.connsMu.Unlock()
+	if db.shuttingDown {
+		return false
+	}
+	db.conns[conn] = struct{}{}
+	db.connsWG.Add(1)
+	return true
+}
+
+func (db *DB) untrackConn(conn net.Conn) {
+	db.connsMu.Lock()
+	defer db.connsMu.Unlock()
+	delete(db.conns, conn)
+	db.connsWG.Done()
+}
+
+/*
+	Shutdown stops accepting connections and new requests, waits for in-flight requests to be answered,
+	flushes the broadcaster and every replica queue, then fsyncs and closes storage.
+	If ctx is done first the remaining connections are cut and ctx's error is returned, storage is still closed.
+*/
+func (db *DB) Shutdown(ctx context.Context) error {
+	db.shutdownOnce.Do(func() {
+		db.shutdownErr = db.shutdown(ctx)
+	})
+	return db.shutdownErr
+}
+
+func (db *DB) shutdown(ctx context.Context) error {
+	db.connsMu.Lock()
+	db.shuttingDown = true
+	if db.listener != nil {
+		db.listener.Close()
+	}
+	for conn := range db.conns {
+		/* Unblock reads so that no new request is picked up, requests already read still get their responses */
+		conn.SetReadDeadline(time.Now())
+	}
+	db.connsMu.Unlock()
+
+	/* Drain in-flight requests */
+	err := waitContext(ctx, db.connsWG.Wait)
+
+	/* Stop fetching from the leader */
+	catchUpErr := db.stopCatchUp(ctx)
+	if err == nil {
+		err = catchUpErr
+	}
+
+	/* Stop handing keys over */
+	migrationErr := db.stopMigration(ctx)
+	if err == nil {
+		err = migrationErr
+	}
+
+	/* Leave the raft cluster */
+	raftErr := db.stopRaft()
+	if err == nil {
+		err = raftErr
+	}
+
+	/* Flush the replica queues, writes are queued under db.mu so none can be on its way once it is closed */
+	db.mu.Lock()
+	db.stopReplication()
+	db.mu.Unlock()
+	if err == nil {
+		for _, worker := range db.replicaWorkers {
+			err = waitContext(ctx, func() { <-worker.done })
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		db.connsMu.Lock()
+		for conn := range db.conns {
+			conn.Close()
+		}
+		db.connsMu.Unlock()
+	}
+
+	/* Writes are serialized on db.mu, take it so that we don't close the log under an in-progress write */
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/* Run fn and wait for it to return or ctx to be done, whichever is first */
+func waitContext(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+	Requests on a connection are pipelined: each one is handled in its own goroutine and its response is written
+	as soon as it is ready, tagged with the request's ID, so responses can come back in a different order. Writes are
+	the exception, they are handled one at a time in the order they arrived so that pipelined writes to a key land in
+	order. At most MAX_PIPELINED_REQUESTS are handled or queued at once.
+*/
 func (db *DB) handleConn(conn net.Conn) error {
-	for {
-		buffer := make([]byte, 1024)
+	var writeMu sync.Mutex
+	var inFlight sync.WaitGroup
+	slots := make(chan struct{}, MAX_PIPELINED_REQUESTS)
+	writes := make(chan *communication.Request, MAX_PIPELINED_REQUESTS)
+	defer func() {
+		close(writes)
+		inFlight.Wait()
+		conn.Close()
+	}()
 
+	respond := func(resp *communication.Response) error {
+		respData, err := proto.Marshal(resp)
+		if err != nil {
+			return err
+		}
+
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		err = framing.WriteMessage(conn, respData, db.config.MaxMessageSize)
+		/* Nothing was written, let the client know rather than leave it waiting for a response that never comes */
+		if errors.Is(err, framing.ErrMessageTooLarge) {
+			respData, err = proto.Marshal(&communication.Response{RequestId: resp.RequestId, Status: communication.Status_FAILURE, Error: err.Error()})
+			if err != nil {
+				return err
+			}
+			return framing.WriteMessage(conn, respData, db.config.MaxMessageSize)
+		}
+		return err
+	}
+
+	handle := func(req *communication.Request) {
+		defer func() {
+			<-slots
+			inFlight.Done()
+		}()
+		resp := db.handleRequest(req)
+		resp.RequestId = req.RequestId
+		if err := respond(resp); err != nil {
+			fmt.Printf("\nError responding to request %d: %v", req.RequestId, err)
+		}
+	}
+	go func() {
+		for req := range writes {
+			handle(req)
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
 		/* Read client request */
-		clientMessageLen, err := conn.Read(buffer)
+		var oversizedID uint64
+		clientMessage, err := framing.ReadMessageOrSkip(reader, db.config.MaxMessageSize, func(payload io.Reader) {
+			oversizedID = readRequestID(payload)
+		})
 		if err != nil {
+			if db.isShuttingDown() {
+				return nil
+			}
+			/* Oversized requests have already been skipped over, reject them and carry on with the next one */
+			if errors.Is(err, framing.ErrMessageTooLarge) {
+				if err := respond(&communication.Response{RequestId: oversizedID, Status: communication.Status_FAILURE, Error: err.Error()}); err != nil {
+					return err
+				}
+				continue
+			}
 			return err
 		}
 
-		/* Unmarshal request sent as JSON */
+		/* Unmarshal request */
 		var clientRequest communication.Request
-		clientMessage := buffer[:clientMessageLen]
 		err = proto.Unmarshal(clientMessage, &clientRequest)
 		if err != nil {
 			return err
 		}
 
-		/* Formulate response according to the operation requested */
-		var resp communication.Response
-		switch clientRequest.Op {
-		case communication.Operation_GET:
-			fmt.Println("Handling GET request...")
-			val, err := db.Get(clientRequest.Key)
+		slots <- struct{}{}
+		inFlight.Add(1)
+		if isWrite(clientRequest.Op) {
+			writes <- &clientRequest
+			continue
+		}
+		go handle(&clientRequest)
+	}
+}
+
+/* Requests that change our data, see handleConn */
+func isWrite(op communication.Operation) bool {
+	switch op {
+	case communication.Operation_PUT, communication.Operation_DELETE, communication.Operation_BATCH, communication.Operation_CAS, communication.Operation_REPLICATE:
+		return true
+	}
+	return false
+}
+
+/*
+	Request ID of the encoded communication.Request read from r, reading no further than it has to. 0 if it can't be
+	found, which the client takes as an error against the whole connection.
+*/
+func readRequestID(r io.Reader) uint64 {
+	idField := (&communication.Request{}).ProtoReflect().Descriptor().Fields().ByName("request_id").Number()
+	reader := byteReader{r}
+	for {
+		tag, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0
+		}
+		num, typ := protowire.Number(tag>>3), protowire.Type(tag&7)
+
+		var skip uint64
+		switch typ {
+		case protowire.VarintType:
+			v, err := binary.ReadUvarint(reader)
 			if err != nil {
-				resp.Error = err.Error()
-				resp.Status = communication.Status_FAILURE
-				break
+				return 0
+			}
+			if num == idField {
+				return v
 			}
-			resp.Val = val
-			resp.Status = communication.Status_SUCCESS
-		case communication.Operation_PUT:
-			fmt.Println("Handling PUT request...")
-			err := db.Put(clientRequest.Key, clientRequest.Val)
+		case protowire.Fixed32Type:
+			skip = 4
+		case protowire.Fixed64Type:
+			skip = 8
+		case protowire.BytesType:
+			skip, err = binary.ReadUvarint(reader)
 			if err != nil {
-				resp.Error = err.Error()
-				resp.Status = communication.Status_FAILURE
-				break
+				return 0
 			}
-			resp.Status = communication.Status_SUCCESS
 		default:
-			resp.Error = ErrInvalidOperation.Error()
-			resp.Status = communication.Status_FAILURE
+			return 0
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(skip)); err != nil {
+			return 0
 		}
+	}
+}
+
+/* io.ByteReader picking varints off r a byte at a time, rather than buffering the fields skipped after them */
+type byteReader struct {
+	io.Reader
+}
 
-		/* Send to broadcaster */
-		if resp.Status == communication.Status_SUCCESS {
-			go func(k, v []byte) {
-				fmt.Printf("\nSending %s : %s to broadcaster", k, v)
-				db.broadcaster <- DBEntry{Key: k, Val: v}
-				fmt.Printf("\nSent %s : %s to broadcaster", k, v)
-			}(clientRequest.Key, clientRequest.Val)
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+/*
+	Refuse requests our role doesn't allow: followers only take writes over the replication channel and redirect client
+	writes (and reads, unless FollowerReads is set) to the leader, leaders never take replicated writes. Raft leaders
+	confirm they still lead before serving reads. Replication and rebalancing requests must carry ReplicationToken.
+	Returns nil if the request may go ahead.
+*/
+func (db *DB) authorize(clientRequest *communication.Request) *communication.Response {
+	switch clientRequest.Op {
+	case communication.Operation_REPLICATE, communication.Operation_FETCH, communication.Operation_RAFT, communication.Operation_MERKLE,
+		communication.Operation_MERKLE_RANGE, communication.Operation_CHECK_REPLICA:
+		if resp := db.authenticate(clientRequest); resp != nil {
+			return resp
+		}
+		if clientRequest.Op == communication.Operation_REPLICATE && db.config.Role != FOLLOWER {
+			return &communication.Response{Status: communication.Status_FAILURE, Error: ErrNotFollower.Error()}
+		}
+	case communication.Operation_ADD_MEMBER, communication.Operation_REMOVE_MEMBER, communication.Operation_SHARD_MIGRATE,
+		communication.Operation_SHARD_MIGRATE_STATUS, communication.Operation_SHARD_TRANSFER, communication.Operation_SHARD_HANDED_OFF:
+		if resp := db.authenticate(clientRequest); resp != nil {
+			return resp
+		}
+		if !db.IsLeader() {
+			return db.notLeader()
+		}
+	case communication.Operation_SHARD_PREPARE, communication.Operation_SHARD_COMMIT:
+		if resp := db.authenticate(clientRequest); resp != nil {
+			return resp
+		}
+	case communication.Operation_PUT, communication.Operation_DELETE, communication.Operation_BATCH, communication.Operation_CAS:
+		if !db.IsLeader() {
+			return db.notLeader()
+		}
+	case communication.Operation_GET, communication.Operation_MGET, communication.Operation_SCAN, communication.Operation_PREFIX_SCAN:
+		if !db.IsLeader() {
+			if !db.config.FollowerReads {
+				return db.notLeader()
+			}
+			break
 		}
+		/* A raft leader may have been replaced without knowing it yet */
+		if db.raft != nil {
+			err := db.raftRead()
+			if errors.Is(err, ErrNotLeader) {
+				return db.notLeader()
+			}
+			if err != nil {
+				return &communication.Response{Status: communication.Status_FAILURE, Error: err.Error()}
+			}
+		}
+	}
 
-		/* Marshal response to JSON */
-		respData, err := proto.Marshal(&resp)
+	return nil
+}
+
+/* Refuse requests that don't carry ReplicationToken, or all of them if there is no token to carry */
+func (db *DB) authenticate(clientRequest *communication.Request) *communication.Response {
+	if db.config.ReplicationToken == "" {
+		return &communication.Response{Status: communication.Status_FAILURE, Error: ErrNoReplicationToken.Error()}
+	}
+	if subtle.ConstantTimeCompare([]byte(clientRequest.Token), []byte(db.config.ReplicationToken)) != 1 {
+		return &communication.Response{Status: communication.Status_FAILURE, Error: ErrUnauthorized.Error()}
+	}
+	return nil
+}
+
+/* Whether we take client writes: our raft state if we are in a raft cluster, otherwise our configured role */
+func (db *DB) IsLeader() bool {
+	if db.raft != nil {
+		return db.raft.isLeader()
+	}
+	return db.config.Role != FOLLOWER
+}
+
+func (db *DB) notLeader() *communication.Response {
+	resp := &communication.Response{Status: communication.Status_NOT_LEADER, Error: ErrNotLeader.Error()}
+	if db.raft != nil {
+		resp.Leader = db.raft.memberAddr(db.raft.leaderID())
+	} else if db.config.LeaderConfig != nil {
+		resp.Leader = db.config.LeaderConfig.ServerHost + ":" + db.config.LeaderConfig.ServerPort
+	}
+	return resp
+}
+
+/* Formulate response according to the operation requested */
+func (db *DB) handleRequest(clientRequest *communication.Request) *communication.Response {
+	if resp := db.authorize(clientRequest); resp != nil {
+		return resp
+	}
+
+	var resp communication.Response
+	switch clientRequest.Op {
+	case communication.Operation_GET:
+		fmt.Println("Handling GET request...")
+		val, version, err := db.shardedGet(clientRequest.Key)
+		if errors.Is(err, ErrWrongShard) {
+			return db.wrongShard(clientRequest.Key)
+		}
 		if err != nil {
-			return err
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
 		}
-
-		/* Send response */
-		if _, err = conn.Write(respData); err != nil {
-			return err
+		resp.Val, resp.Version = val, version
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_PUT:
+		fmt.Println("Handling PUT request...")
+		err := db.shardedWrite(&communication.LogRecord{Op: communication.Operation_PUT, Key: clientRequest.Key, Val: clientRequest.Val})
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
 		}
-
+		if errors.Is(err, ErrWrongShard) {
+			return db.wrongShard(clientRequest.Key)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_DELETE:
+		fmt.Println("Handling DELETE request...")
+		err := db.shardedWrite(&communication.LogRecord{Op: communication.Operation_DELETE, Key: clientRequest.Key})
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
+		}
+		if errors.Is(err, ErrWrongShard) {
+			return db.wrongShard(clientRequest.Key)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_CAS:
+		fmt.Println("Handling CAS request...")
+		record := &communication.LogRecord{Op: communication.Operation_CAS, Key: clientRequest.Key, Val: clientRequest.Val,
+			Condition: clientRequest.Condition, ExpectedVersion: clientRequest.ExpectedVersion, ExpectedVal: clientRequest.ExpectedVal}
+		version, err := db.compareAndSwap(record, db.shardedWrite)
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
+		}
+		if errors.Is(err, ErrWrongShard) {
+			return db.wrongShard(clientRequest.Key)
+		}
+		if errors.Is(err, ErrConditionFailed) {
+			return &communication.Response{Status: communication.Status_CONDITION_FAILED, Error: err.Error()}
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Version = version
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_BATCH:
+		fmt.Println("Handling BATCH request...")
+		batch, err := decodeRecords(clientRequest.Records)
+		if err == nil && len(batch) > 0 {
+			err = db.shardedWrite(&communication.LogRecord{Op: communication.Operation_BATCH, Batch: batch})
+		}
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
+		}
+		var wrongShard *wrongShardError
+		if errors.As(err, &wrongShard) {
+			return db.wrongShard(wrongShard.key)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_REPLICATE:
+		var record communication.LogRecord
+		err := proto.Unmarshal(clientRequest.Record, &record)
+		if err == nil {
+			err = db.applyReplicated(&record)
+		}
+		resp.Seq = db.AppliedSeq()
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_FETCH:
+		var from []byte
+		if len(clientRequest.Key) > 0 {
+			from = clientRequest.Key
+		}
+		records, seq, snapshot, next := db.fetch(clientRequest.Seq, from)
+		encoded, err := encodeRecords(records)
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Records, resp.Seq, resp.Snapshot, resp.Continuation = encoded, seq, snapshot, next
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_RAFT:
+		msg := &communication.RaftMessage{}
+		err := proto.Unmarshal(clientRequest.Raft, msg)
+		if err == nil && db.raft == nil {
+			err = fmt.Errorf("%w: not in a raft cluster", ErrInvalidOperation)
+		}
+		if err == nil {
+			msg, err = db.raft.handle(msg)
+		}
+		if err == nil {
+			resp.Raft, err = proto.Marshal(msg)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_ADD_MEMBER, communication.Operation_REMOVE_MEMBER:
+		fmt.Printf("\nHandling %s request for %s...", clientRequest.Op, clientRequest.Key)
+		var err error
+		if clientRequest.Op == communication.Operation_ADD_MEMBER {
+			err = db.AddMember(string(clientRequest.Key), string(clientRequest.Val))
+		} else {
+			err = db.RemoveMember(string(clientRequest.Key))
+		}
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_SHARD_MAP:
+		shardMap, err := db.encodedShardMap()
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.ShardMap = shardMap
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_SHARD_PREPARE, communication.Operation_SHARD_MIGRATE, communication.Operation_SHARD_MIGRATE_STATUS,
+		communication.Operation_SHARD_TRANSFER, communication.Operation_SHARD_HANDED_OFF, communication.Operation_SHARD_COMMIT:
+		err := db.handleRebalance(clientRequest, &resp)
+		if errors.Is(err, ErrNotLeader) {
+			return db.notLeader()
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_MERKLE, communication.Operation_MERKLE_RANGE, communication.Operation_CHECK_REPLICA:
+		err := db.handleAntiEntropy(clientRequest, &resp)
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_MGET:
+		fmt.Println("Handling MGET request...")
+		err := db.handleMGet(clientRequest, &resp)
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_SCAN, communication.Operation_PREFIX_SCAN:
+		fmt.Printf("Handling %s request...\n", clientRequest.Op)
+		err := db.handleScan(clientRequest, &resp)
+		if err != nil {
+			resp.Error = err.Error()
+			resp.Status = communication.Status_FAILURE
+			break
+		}
+		resp.Status = communication.Status_SUCCESS
+	case communication.Operation_PING:
+		resp.Seq = db.AppliedSeq()
+		resp.Status = communication.Status_SUCCESS
+	default:
+		resp.Error = ErrInvalidOperation.Error()
+		resp.Status = communication.Status_FAILURE
 	}
 
+	return &resp
 }
 
 func (db *DB) Get(key []byte) (val []byte, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	entry, err := db.get(key)
 	if err != nil {
 		return nil, err
@@ -236,64 +826,236 @@ func (db *DB) Get(key []byte) (val []byte, err error) {
 	return entry.Val, nil
 }
 
+/* Call this only with db.Mutex held */
 func (db *DB) get(key []byte) (entry *DBEntry, err error) {
-	for _, entry := range db.Entries {
-		if bytes.Equal(key, entry.Key) {
-			return entry, nil
-		}
+	entry, ok := db.index[string(key)]
+	if !ok {
+		return nil, ErrKeyDoesNotExist
 	}
 
-	return nil, ErrKeyDoesNotExist
+	return entry, nil
+}
+
+/* Call this only with db.Mutex held */
+func (db *DB) insert(entry *DBEntry) {
+	entry.pos = len(db.Entries)
+	db.Entries = append(db.Entries, entry)
+	db.index[string(entry.Key)] = entry
+	db.sorted.insert(entry)
+	db.toggleMerkle(entry.Key, entry.Val)
+}
+
+/* Swap the last entry into the removed entry's slot so that removal stays O(1). Call this only with db.Mutex held */
+func (db *DB) remove(entry *DBEntry) {
+	last := db.Entries[len(db.Entries)-1]
+	db.Entries[entry.pos] = last
+	last.pos = entry.pos
+	db.Entries[len(db.Entries)-1] = nil
+	db.Entries = db.Entries[:len(db.Entries)-1]
+	delete(db.index, string(entry.Key))
+	db.sorted.remove(entry.Key)
+	db.toggleMerkle(entry.Key, entry.Val)
 }
 
+/* Put key, replicating it according to ReplicationMode, or through raft */
 func (db *DB) Put(key, val []byte) error {
-	entry, err := db.get(key)
+	return db.write(&communication.LogRecord{Op: communication.Operation_PUT, Key: key, Val: val})
+}
+
+/* Delete key, replicating the tombstone according to ReplicationMode, or through raft */
+func (db *DB) Delete(key []byte) error {
+	return db.write(&communication.LogRecord{Op: communication.Operation_DELETE, Key: key})
+}
+
+/*
+	Assign the write the next sequence number, commit it and queue it for the replicas. Sequence numbers are assigned
+	and writes queued under db.mu, so the replicas receive writes in exactly the order they were applied here.
+*/
+func (db *DB) write(record *communication.LogRecord) error {
+	if err := checkBatch(record); err != nil {
+		return err
+	}
+	if db.raft != nil {
+		return db.raftPropose(record)
+	}
+
 	db.mu.Lock()
-	defer db.mu.Unlock()
-	if err != nil {
-		if errors.Is(err, ErrKeyDoesNotExist) {
-			newEntry := newDBEntry(key, val)
-			db.Entries = append(db.Entries, &newEntry)
-			if !db.config.Persist {
-				return nil
-			}
-			return db.writeToDisk()
+	if record.Op == communication.Operation_DELETE {
+		_, err := db.get(record.Key)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	if record.Op == communication.Operation_CAS {
+		err := db.checkCondition(record)
+		if err != nil {
+			db.mu.Unlock()
+			return err
 		}
+		/* Nothing can change the key before the write is applied, the log and the replicas only need the put */
+		record.Op, record.Condition, record.ExpectedVersion, record.ExpectedVal = communication.Operation_PUT, communication.Condition_DUMMYCONDITION, 0, nil
+	}
 
+	record.Seq = db.seq + 1
+	err := db.commit(record)
+	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
+	replicated := db.queueReplication(record)
+	db.mu.Unlock()
+
+	return db.awaitReplication(replicated)
+}
 
-	entry.Val = val
-	if !db.config.Persist {
+/*
+	Apply a write received from the leader. Writes must arrive in sequence order: one we already have is acknowledged
+	without being applied again (e.g. a redelivery), one that skips ahead is refused with ErrOutOfOrder so that it can't be
+	applied on top of a missing write, and we go fetch the missing writes from the leader.
+*/
+func (db *DB) applyReplicated(record *communication.LogRecord) error {
+	db.mu.Lock()
+	if record.Seq <= db.seq {
+		db.mu.Unlock()
 		return nil
 	}
+	if record.Seq != db.seq+1 {
+		applied := db.seq
+		db.mu.Unlock()
+		db.signalBehind()
+		return fmt.Errorf("%w: got %d, last applied %d", ErrOutOfOrder, record.Seq, applied)
+	}
 
-	return db.writeToDisk()
-}
-
-/* Call this only with db.Mutex held */
-func (db *DB) writeToDisk() error {
-	/* Truncate entire file */
-	_, err := db.f.Seek(0, 0)
+	err := db.commit(record)
 	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
 
-	err = db.f.Truncate(0)
-	if err != nil {
+	/* Pass it down the chain to our own replicas */
+	replicated := db.queueReplication(record)
+	db.mu.Unlock()
+
+	return db.awaitReplication(replicated)
+}
+
+/* Sequence number of the last write applied, compare against the leader's to detect a lagging or diverged follower */
+func (db *DB) AppliedSeq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+/*
+	Log before applying so that an acknowledged write always survives a crash. A CAS whose condition doesn't hold is
+	committed as a no-op, and ErrConditionFailed returned. Call this only with db.Mutex held
+*/
+func (db *DB) commit(record *communication.LogRecord) error {
+	if db.config.Persist {
+		err := db.wal.append(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.apply(record)
+	if err != nil && !errors.Is(err, ErrConditionFailed) {
 		return err
 	}
+	db.retain(record)
+	db.maybeCompact()
+	return err
+}
+
+/* Apply a logged mutation to the in-memory state. Call this only with db.Mutex held */
+func (db *DB) apply(record *communication.LogRecord) error {
+	/* Records written before sequence numbers existed have none, and give no versions */
+	var version uint64
+	if record.Seq > 0 {
+		version = db.nextVersion(record.Seq)
+	}
 
-	/* Rewrite the data */
-	encoder := json.NewEncoder(db.f)
-	err = encoder.Encode(db.Entries)
+	var conditionErr error
+	switch record.Op {
+	case communication.Operation_PUT, communication.Operation_DELETE:
+		db.applyWrite(record, version)
+	case communication.Operation_BATCH, communication.Operation_SHARD_TRANSFER:
+		err := checkBatch(record)
+		if err != nil {
+			return err
+		}
+		for _, write := range record.Batch {
+			db.applyWrite(write, version)
+		}
+	case communication.Operation_CAS:
+		conditionErr = db.checkCondition(record)
+		if conditionErr == nil {
+			db.set(record.Key, record.Val, version)
+		}
+	case communication.Operation_NOOP, communication.Operation_ADD_MEMBER, communication.Operation_REMOVE_MEMBER:
+		/* Raft's own, nothing to apply */
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidOperation, record.Op)
+	}
+
+	if record.Seq > 0 {
+		db.seq, db.versionFloor = record.Seq, version
+	}
+	/* Keys handed over to us keep their versions, ours have to be above them and anything else the group had given out */
+	if record.Op == communication.Operation_SHARD_TRANSFER && record.KeyVersion > db.versionFloor {
+		db.versionFloor = record.KeyVersion
+	}
+	if _, ok := db.casVersions[record]; ok && conditionErr == nil {
+		db.casVersions[record] = version
+	}
+
+	return conditionErr
+}
+
+/* The version a write with sequence number seq gives its keys, seq itself unless that isn't above the floor. Call this only with db.Mutex held */
+func (db *DB) nextVersion(seq uint64) uint64 {
+	if seq > db.versionFloor {
+		return seq
+	}
+	return db.versionFloor + 1
+}
+
+/* Apply a PUT or DELETE, a PUT gives the key version unless it carries its own. Call this only with db.Mutex held */
+func (db *DB) applyWrite(write *communication.LogRecord, version uint64) {
+	switch write.Op {
+	case communication.Operation_PUT:
+		if write.KeyVersion != 0 {
+			version = write.KeyVersion
+		}
+		db.set(write.Key, write.Val, version)
+	case communication.Operation_DELETE:
+		/* Tombstones for keys that are already gone are fine, e.g. when replaying a log over a newer snapshot */
+		entry, err := db.get(write.Key)
+		if err == nil {
+			db.remove(entry)
+		}
+	}
+}
+
+/* Call this only with db.Mutex held */
+func (db *DB) set(key, val []byte, version uint64) {
+	entry, err := db.get(key)
 	if err != nil {
-		return err
+		newEntry := newDBEntry(key, val, version)
+		db.insert(&newEntry)
+		return
 	}
 
-	return nil
+	db.toggleMerkle(key, entry.Val)
+	entry.Val, entry.Version = val, version
+	db.toggleMerkle(key, val)
 }
 
+/* Close storage, Shutdown should be preferred for a DB that is serving */
 func (db *DB) Close() error {
-	return db.f.Close()
+	if db.wal == nil {
+		return nil
+	}
+	return db.wal.close()
 }
@@ -1,10 +1,19 @@
 package distdb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
 	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -20,6 +29,26 @@ const (
 	DEFAULT_REPLICA_PORT     = "3109"
 )
 
+/* Start listening in the background and wait till the server accepts connections, the server is shut down when the test ends */
+func listen(t testing.TB, db *DB) {
+	go db.Listen()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		db.Shutdown(ctx)
+	})
+
+	addr := db.config.ServerHost + ":" + db.config.ServerPort
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial(db.config.ServerProtocol, addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
 func TestGetPut(t *testing.T) {
 	config := DBConfig{Persist: false, Role: LEADER}
 
@@ -48,6 +77,83 @@ func TestGetPut(t *testing.T) {
 	require.Equal(t, v2, v2FromDB)
 }
 
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "dbdump")
+
+	/* Start from a JSON snapshot in the original dump format */
+	err := os.WriteFile(fileName, []byte(`[{"Key":"a2V5MQ==","Val":"dmFsMQ=="},{"Key":"a2V5Mg==","Val":"dmFsMg=="}]`), 0777)
+	require.NoError(t, err)
+
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: fileName}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	err = db.Put([]byte("key1"), []byte("val1-new"))
+	require.NoError(t, err)
+	err = db.Put([]byte("key3"), []byte("val3"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	/* Reopen, snapshot + log should give back the latest values */
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tcs := []struct {
+		k, v []byte
+	}{
+		{k: []byte("key1"), v: []byte("val1-new")},
+		{k: []byte("key2"), v: []byte("val2")},
+		{k: []byte("key3"), v: []byte("val3")},
+	}
+	for _, tc := range tcs {
+		v, err := db.Get(tc.k)
+		require.NoError(t, err)
+		require.Equal(t, tc.v, v)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: fileName}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	/* Delete a non existing key */
+	err = db.Delete([]byte("kNE"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	for _, k := range []string{"key1", "key2", "key3"} {
+		require.NoError(t, db.Put([]byte(k), []byte("val")))
+	}
+
+	/* Delete from the middle, the rest should be untouched */
+	require.NoError(t, db.Delete([]byte("key1")))
+	_, err = db.Get([]byte("key1"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+	require.Len(t, db.Entries, 2)
+
+	/* Tombstone in the log should survive a restart, and so should a compacted delete */
+	verify := func() {
+		db, err := NewDB(config)
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Get([]byte("key1"))
+		require.ErrorIs(t, err, ErrKeyDoesNotExist)
+		_, err = db.Get([]byte("key3"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Close())
+	verify()
+
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+	verify()
+}
+
 /* TODO: test mutex? currently not tested, also how would you test it? */
 func TestHandleConn(t *testing.T) {
 	/* Define test case struct and create a 'verify' function */
@@ -59,14 +165,7 @@ func TestHandleConn(t *testing.T) {
 		client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: DEFAULT_SERVER_PORT})
 		require.NoError(t, err)
 
-		client.MakeRequest(&communication.Request{Key: req.Key, Val: req.Val, Op: req.Op})
-		require.NoError(t, err)
-
-		var response communication.Response
-		respData, err := client.RcvResponse()
-
-		require.NoError(t, err)
-		err = proto.Unmarshal(respData, &response)
+		response, err := client.Do(&communication.Request{Key: req.Key, Val: req.Val, Op: req.Op})
 		require.NoError(t, err)
 
 		require.Equal(t, respWant.Status, response.Status)
@@ -82,12 +181,13 @@ func TestHandleConn(t *testing.T) {
 	db, err := NewDB(dbConfig)
 	require.NoError(t, err)
 
-	go db.Listen()
+	listen(t, db)
 
 	/* Start a new goroutine, with a new client for each request - TODO: error cases */
 	tcs := []testcase{
 		{req: &communication.Request{Key: []byte("key2"), Val: []byte("val2"), Op: communication.Operation_PUT}, respWant: &communication.Response{Status: communication.Status_SUCCESS, Error: "", Val: nil}},
 		{req: &communication.Request{Key: []byte("key1"), Op: communication.Operation_GET}, respWant: &communication.Response{Status: communication.Status_FAILURE, Error: ErrKeyDoesNotExist.Error(), Val: nil}},
+		{req: &communication.Request{Key: []byte("key3"), Op: communication.Operation_DELETE}, respWant: &communication.Response{Status: communication.Status_FAILURE, Error: ErrKeyDoesNotExist.Error(), Val: nil}},
 	}
 
 	/* Execute tcs parallely - Wait Group to ensure test completes only when all goroutines finish */
@@ -108,46 +208,414 @@ func TestHandleConn(t *testing.T) {
 
 }
 
-/* Verifying if put requests to leader are replicated all the way to followers */
+/* Back to back requests on one connection should each get a response tagged with their request ID */
+func TestPipelining(t *testing.T) {
+	dbConfig := DBConfig{Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3112"}
+	db, err := NewDB(dbConfig)
+	require.NoError(t, err)
+	listen(t, db)
+
+	const n = 2 * MAX_PIPELINED_REQUESTS
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+
+	/* Write every request in one go without waiting for any response */
+	conn, err := net.Dial(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":3112")
+	require.NoError(t, err)
+	defer conn.Close()
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		reqData, err := proto.Marshal(&communication.Request{Key: []byte(fmt.Sprintf("key%d", i)), Op: communication.Operation_GET, RequestId: uint64(i + 1)})
+		require.NoError(t, err)
+		require.NoError(t, framing.WriteMessage(&buf, reqData, 0))
+	}
+	_, err = conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	seen := map[uint64]bool{}
+	for i := 0; i < n; i++ {
+		respData, err := framing.ReadMessage(conn, 0)
+		require.NoError(t, err)
+		var resp communication.Response
+		require.NoError(t, proto.Unmarshal(respData, &resp))
+		require.Equal(t, communication.Status_SUCCESS, resp.Status)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", resp.RequestId-1)), resp.Val)
+		require.False(t, seen[resp.RequestId])
+		seen[resp.RequestId] = true
+	}
+
+	/* Pipelined writes to the same key are applied in the order they were sent */
+	buf.Reset()
+	for i := 0; i < n; i++ {
+		reqData, err := proto.Marshal(&communication.Request{Key: []byte("ordered"), Val: []byte(fmt.Sprintf("val%d", i)), Op: communication.Operation_PUT, RequestId: uint64(n + i + 1)})
+		require.NoError(t, err)
+		require.NoError(t, framing.WriteMessage(&buf, reqData, 0))
+	}
+	_, err = conn.Write(buf.Bytes())
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		respData, err := framing.ReadMessage(conn, 0)
+		require.NoError(t, err)
+		var resp communication.Response
+		require.NoError(t, proto.Unmarshal(respData, &resp))
+		require.Equal(t, communication.Status_SUCCESS, resp.Status)
+		require.Equal(t, uint64(n+i+1), resp.RequestId)
+	}
+	v, err := db.Get([]byte("ordered"))
+	require.NoError(t, err)
+	require.Equal(t, []byte(fmt.Sprintf("val%d", n-1)), v)
+
+	/* Many goroutines sharing a single client */
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3112"})
+	require.NoError(t, err)
+	defer client.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k, v := []byte(fmt.Sprintf("shared%d", i)), []byte(fmt.Sprintf("val%d", i))
+			require.NoError(t, client.Put(k, v))
+			vFromDB, err := client.Get(k)
+			require.NoError(t, err)
+			require.Equal(t, v, vFromDB)
+		}(i)
+	}
+	wg.Wait()
+}
+
+/* Values far bigger than a single read should make it through intact */
+func TestLargeValues(t *testing.T) {
+	dbConfig := DBConfig{Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3111", MaxMessageSize: 8 << 20}
+	db, err := NewDB(dbConfig)
+	require.NoError(t, err)
+	listen(t, db)
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3111", MaxMessageSize: 16 << 20})
+	require.NoError(t, err)
+
+	k, v := []byte("large"), bytes.Repeat([]byte("v"), 6<<20)
+	require.NoError(t, client.Put(k, v))
+	vFromDB, err := client.Get(k)
+	require.NoError(t, err)
+	require.Equal(t, v, vFromDB)
+
+	/* Above the server's limit the request is rejected but the connection stays usable */
+	err = client.Put(k, bytes.Repeat([]byte("v"), 10<<20))
+	require.ErrorContains(t, err, framing.ErrMessageTooLarge.Error())
+	vFromDB, err = client.Get(k)
+	require.NoError(t, err)
+	require.Equal(t, v, vFromDB)
+
+	/* A response above the server's limit is turned into a failure rather than never sent */
+	start := time.Now()
+	resp, err := client.Do(&communication.Request{Op: communication.Operation_MGET, Keys: [][]byte{k, k}})
+	require.NoError(t, err)
+	require.Equal(t, communication.Status_FAILURE, resp.Status)
+	require.Contains(t, resp.Error, framing.ErrMessageTooLarge.Error())
+	require.Less(t, time.Since(start), distdbclient.DEFAULT_READ_TIMEOUT)
+
+	/* The rejection carries the oversized request's ID, and the next request on the same connection goes through */
+	conn, err := net.Dial(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":3111")
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, req := range []*communication.Request{
+		{Op: communication.Operation_PUT, Key: k, Val: bytes.Repeat([]byte("v"), 10<<20), RequestId: 7},
+		{Op: communication.Operation_GET, Key: k, RequestId: 8},
+	} {
+		reqData, err := proto.Marshal(req)
+		require.NoError(t, err)
+		require.NoError(t, framing.WriteMessage(conn, reqData, 16<<20))
+	}
+	statuses := map[uint64]communication.Status{}
+	for i := 0; i < 2; i++ {
+		respData, err := framing.ReadMessage(conn, 16<<20)
+		require.NoError(t, err)
+		var resp communication.Response
+		require.NoError(t, proto.Unmarshal(respData, &resp))
+		statuses[resp.RequestId] = resp.Status
+	}
+	require.Equal(t, map[uint64]communication.Status{7: communication.Status_FAILURE, 8: communication.Status_SUCCESS}, statuses)
+}
+
+/* Verifying if put and delete requests to leader are replicated all the way to followers */
 func TestReplicationChain(t *testing.T) {
 	tcs := []struct {
 		k, v []byte
-	} {
+	}{
 		{k: []byte("k1"), v: []byte("v1")},
 		{k: []byte("k2"), v: []byte("v2")},
 		{k: []byte("k3"), v: []byte("v3")},
 	}
 
+	/* Initialize follower, start listening */
+	followerConfig := DBConfig{ReplicationToken: "secret", Persist: false, Role: FOLLOWER, ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: DEFAULT_REPLICA_PORT}
+	follower, err := NewDB(followerConfig)
+	require.NoError(t, err)
+	listen(t, follower)
+
 	/* Intiialize db and replica(s), start listening */
-	dbConfig := DBConfig{Persist: false, Role: LEADER, 
+	dbConfig := DBConfig{ReplicationToken: "secret", Persist: false, Role: LEADER,
 		ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3110",
-		ReplicaConfigs: []distdbclient.ClientConfig {
-			distdbclient.ClientConfig{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: DEFAULT_REPLICA_PORT},
+		ReplicaConfigs: []distdbclient.ClientConfig{
+			{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: DEFAULT_REPLICA_PORT},
 		},
 	}
 	db, err := NewDB(dbConfig)
 	require.NoError(t, err)
+	listen(t, db)
 
-	go func() {
-		err := db.Listen()
+	/* Make put requests using client */
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3110"})
+	require.NoError(t, err)
+
+	for _, tc := range tcs {
+		err := client.Put(tc.k, tc.v)
 		require.NoError(t, err)
-	}()
+	}
 
-	/* Make put requests using client */
-	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: DEFAULT_SERVER_PORT})
+	/* Wait till every put reaches the follower */
+	for _, tc := range tcs {
+		require.Eventually(t, func() bool {
+			v, err := follower.Get(tc.k)
+			return err == nil && string(v) == string(tc.v)
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	/* Delete and wait till the delete reaches the follower */
+	err = client.Delete(tcs[1].k)
 	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := follower.Get(tcs[1].k)
+		return errors.Is(err, ErrKeyDoesNotExist)
+	}, time.Second, 10*time.Millisecond)
+}
+
+/* What each role lets through, and what it answers with otherwise */
+func TestRoles(t *testing.T) {
+	record, err := proto.Marshal(&communication.LogRecord{Seq: 1, Op: communication.Operation_PUT, Key: []byte("k"), Val: []byte("v")})
+	require.NoError(t, err)
+	leaderConfig := &distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: DEFAULT_SERVER_PORT}
+
+	tcs := []struct {
+		name       string
+		config     DBConfig
+		req        *communication.Request
+		statusWant communication.Status
+		errWant    error
+	}{
+		{name: "leader put", config: DBConfig{Role: LEADER}, req: &communication.Request{Op: communication.Operation_PUT, Key: []byte("k")}, statusWant: communication.Status_SUCCESS},
+		{name: "leader get", config: DBConfig{Role: LEADER}, req: &communication.Request{Op: communication.Operation_GET, Key: []byte("k")}, statusWant: communication.Status_FAILURE, errWant: ErrKeyDoesNotExist},
+		{name: "leader replicate", config: DBConfig{Role: LEADER, ReplicationToken: "secret"}, req: &communication.Request{Op: communication.Operation_REPLICATE, Record: record, Token: "secret"}, statusWant: communication.Status_FAILURE, errWant: ErrNotFollower},
+		{name: "leader fetch bad token", config: DBConfig{Role: LEADER, ReplicationToken: "secret"}, req: &communication.Request{Op: communication.Operation_FETCH, Token: "guess"}, statusWant: communication.Status_FAILURE, errWant: ErrUnauthorized},
+		{name: "leader fetch", config: DBConfig{Role: LEADER, ReplicationToken: "secret"}, req: &communication.Request{Op: communication.Operation_FETCH, Token: "secret"}, statusWant: communication.Status_SUCCESS},
+		{name: "follower put", config: DBConfig{Role: FOLLOWER, LeaderConfig: leaderConfig}, req: &communication.Request{Op: communication.Operation_PUT, Key: []byte("k")}, statusWant: communication.Status_NOT_LEADER, errWant: ErrNotLeader},
+		{name: "follower delete", config: DBConfig{Role: FOLLOWER, LeaderConfig: leaderConfig}, req: &communication.Request{Op: communication.Operation_DELETE, Key: []byte("k")}, statusWant: communication.Status_NOT_LEADER, errWant: ErrNotLeader},
+		{name: "follower get", config: DBConfig{Role: FOLLOWER, LeaderConfig: leaderConfig}, req: &communication.Request{Op: communication.Operation_GET, Key: []byte("k")}, statusWant: communication.Status_NOT_LEADER, errWant: ErrNotLeader},
+		{name: "follower get with follower reads", config: DBConfig{Role: FOLLOWER, FollowerReads: true}, req: &communication.Request{Op: communication.Operation_GET, Key: []byte("k")}, statusWant: communication.Status_FAILURE, errWant: ErrKeyDoesNotExist},
+		{name: "follower ping", config: DBConfig{Role: FOLLOWER}, req: &communication.Request{Op: communication.Operation_PING}, statusWant: communication.Status_SUCCESS},
+		{name: "follower replicate", config: DBConfig{Role: FOLLOWER, ReplicationToken: "secret"}, req: &communication.Request{Op: communication.Operation_REPLICATE, Record: record, Token: "secret"}, statusWant: communication.Status_SUCCESS},
+		{name: "follower replicate without a token configured", config: DBConfig{Role: FOLLOWER}, req: &communication.Request{Op: communication.Operation_REPLICATE, Record: record}, statusWant: communication.Status_FAILURE, errWant: ErrNoReplicationToken},
+		{name: "leader fetch without a token configured", config: DBConfig{Role: LEADER}, req: &communication.Request{Op: communication.Operation_FETCH}, statusWant: communication.Status_FAILURE, errWant: ErrNoReplicationToken},
+		{name: "follower replicate bad token", config: DBConfig{Role: FOLLOWER, ReplicationToken: "secret"}, req: &communication.Request{Op: communication.Operation_REPLICATE, Record: record}, statusWant: communication.Status_FAILURE, errWant: ErrUnauthorized},
+	}
 
 	for _, tc := range tcs {
-		req := &communication.Request{Key: tc.k, Val: tc.v, Op: communication.Operation_PUT}
-		err := client.MakeRequest(&communication.Request{Key: req.Key, Val: req.Val, Op: req.Op})
+		t.Run(tc.name, func(t *testing.T) {
+			/* Don't go catching up from a leader that isn't there */
+			config := tc.config
+			config.LeaderConfig = nil
+			db, err := NewDB(config)
+			require.NoError(t, err)
+			db.config.LeaderConfig = tc.config.LeaderConfig
+
+			resp := db.handleRequest(tc.req)
+			require.Equal(t, tc.statusWant, resp.Status)
+			if tc.errWant != nil {
+				require.Equal(t, tc.errWant.Error(), resp.Error)
+			}
+			if tc.statusWant == communication.Status_NOT_LEADER {
+				require.Equal(t, DEFAULT_SERVER_HOST+":"+DEFAULT_SERVER_PORT, resp.Leader)
+			}
+		})
+	}
+}
+
+/* Followers turn away client writes but take them from a leader with the right token */
+func TestFollowerRejectsClientWrites(t *testing.T) {
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3125"}
+	follower := startDB(t, DBConfig{Persist: false, Role: FOLLOWER, ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3126",
+		LeaderConfig: &leaderConfig, ReplicationToken: "secret", FollowerReads: true})
+	startDB(t, DBConfig{Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3125",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3126"}}, ReplicationToken: "secret"})
+
+	followerClient, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3126", MaxRedirects: -1})
+	require.NoError(t, err)
+	defer followerClient.Close()
+
+	err = followerClient.Put([]byte("k"), []byte("v"))
+	require.ErrorIs(t, err, distdbclient.ErrNotLeader)
+	var notLeader *distdbclient.NotLeaderError
+	require.ErrorAs(t, err, &notLeader)
+	require.Equal(t, DEFAULT_SERVER_HOST+":3125", notLeader.Leader)
+
+	/* Unless told otherwise, clients follow the redirect */
+	redirectedClient, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3126"})
+	require.NoError(t, err)
+	defer redirectedClient.Close()
+	require.NoError(t, redirectedClient.Put([]byte("redirected"), []byte("v")))
+	require.Equal(t, DEFAULT_SERVER_HOST+":3125", redirectedClient.Leader())
+
+	leaderClient, err := distdbclient.NewClient(leaderConfig)
+	require.NoError(t, err)
+	defer leaderClient.Close()
+	require.NoError(t, leaderClient.Put([]byte("k"), []byte("v")))
+	require.Eventually(t, func() bool {
+		v, err := followerClient.Get([]byte("k"))
+		return err == nil && string(v) == "v"
+	}, time.Second, 10*time.Millisecond)
+
+	/* Nobody else gets to replicate */
+	record, err := proto.Marshal(&communication.LogRecord{Seq: follower.AppliedSeq() + 1, Op: communication.Operation_PUT, Key: []byte("k"), Val: []byte("forged")})
+	require.NoError(t, err)
+	resp, err := followerClient.Do(&communication.Request{Op: communication.Operation_REPLICATE, Record: record, Token: "guess"})
+	require.NoError(t, err)
+	require.Equal(t, communication.Status_FAILURE, resp.Status)
+	require.Equal(t, ErrUnauthorized.Error(), resp.Error)
+	v, err := follower.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+}
+
+/* Writes acknowledged before Shutdown returns must be on disk and on every follower */
+func TestShutdown(t *testing.T) {
+	followerConfig := DBConfig{ReplicationToken: "secret", Persist: false, Role: FOLLOWER, ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3113"}
+	follower, err := NewDB(followerConfig)
+	require.NoError(t, err)
+	listen(t, follower)
+
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+	dbConfig := DBConfig{ReplicationToken: "secret", Persist: true, Role: LEADER, DiskFileName: fileName,
+		ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3114",
+		ReplicaConfigs: []distdbclient.ClientConfig{
+			{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3113"},
+		},
+	}
+	db, err := NewDB(dbConfig)
+	require.NoError(t, err)
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- db.Listen() }()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":3114")
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3114", PoolSize: 4})
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* Keep writing from a few goroutines while we shut down */
+	var mu sync.Mutex
+	var acked [][]byte
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				k := []byte(fmt.Sprintf("g%d-key%d", g, i))
+				if err := client.Put(k, k); err != nil {
+					return
+				}
+				mu.Lock()
+				acked = append(acked, k)
+				mu.Unlock()
+			}
+		}(g)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, db.Shutdown(ctx))
+	require.ErrorIs(t, <-listenErr, ErrServerClosed)
+	wg.Wait()
+	require.NotEmpty(t, acked)
+
+	/* No new connections, and shutting down again is a no-op */
+	_, err = net.Dial(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":3114")
+	require.Error(t, err)
+	require.NoError(t, db.Shutdown(ctx))
+
+	/* Replica queues were flushed before Shutdown returned */
+	for _, k := range acked {
+		v, err := follower.Get(k)
 		require.NoError(t, err)
+		require.Equal(t, k, v)
 	}
-	
-	/* Wait till all workers are done */
-	for _, worker := range db.replicaWorkers {
-		<- worker.done
+
+	/* And the log was synced and closed */
+	db, err = NewDB(DBConfig{ReplicationToken: "secret", Persist: true, Role: LEADER, DiskFileName: fileName})
+	require.NoError(t, err)
+	defer db.Close()
+	for _, k := range acked {
+		v, err := db.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, k, v)
 	}
+}
 
+func TestCloseWithoutPersistence(t *testing.T) {
+	db, err := NewDB(DBConfig{Persist: false, Role: LEADER})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Shutdown(context.Background()))
 }
 
+/* Get/Put cost should stay flat as the number of keys grows */
+func BenchmarkGet(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("keys=%d", size), func(b *testing.B) {
+			db := benchmarkDB(b, size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.Get([]byte(fmt.Sprintf("key%d", i%size)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
 
+func BenchmarkPut(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("keys=%d", size), func(b *testing.B) {
+			db := benchmarkDB(b, size)
+			val := []byte("newval")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err := db.Put([]byte(fmt.Sprintf("key%d", i%size)), val)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+/* Non-persistent DB pre-populated with keys key0..key<size-1> */
+func benchmarkDB(b *testing.B, size int) *DB {
+	db, err := NewDB(DBConfig{Persist: false, Role: LEADER})
+	require.NoError(b, err)
+	for i := 0; i < size; i++ {
+		err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+		require.NoError(b, err)
+	}
+	return db
+}
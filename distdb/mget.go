@@ -0,0 +1,46 @@
+package distdb
+
+import (
+	"fmt"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/* Most keys a single MGET may ask for, clients split bigger lookups up */
+const MAX_MGET_KEYS = 1000
+
+/*
+	Look up every key in clientRequest.Keys as of the same point in time. Keys that aren't ours get a WRONG_SHARD result
+	rather than failing the whole request, along with the map the first of them is routed by.
+*/
+func (db *DB) handleMGet(clientRequest *communication.Request, resp *communication.Response) error {
+	if len(clientRequest.Keys) > MAX_MGET_KEYS {
+		return fmt.Errorf("%w: %d keys in one MGET, at most %d", ErrInvalidOperation, len(clientRequest.Keys), MAX_MGET_KEYS)
+	}
+
+	var misrouted []byte
+	resp.Results = make([]*communication.KeyResult, 0, len(clientRequest.Keys))
+	db.shardMu.RLock()
+	db.mu.RLock()
+	for _, key := range clientRequest.Keys {
+		result := &communication.KeyResult{Status: communication.Status_SUCCESS}
+		if !db.ownsKey(key) {
+			result.Status = communication.Status_WRONG_SHARD
+			if misrouted == nil {
+				misrouted = key
+			}
+		} else if entry, err := db.get(key); err != nil {
+			result.Status = communication.Status_NOT_FOUND
+		} else {
+			result.Val, result.Version = entry.Val, entry.Version
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	db.mu.RUnlock()
+	db.shardMu.RUnlock()
+
+	if misrouted != nil {
+		resp.ShardMap = db.wrongShard(misrouted).ShardMap
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMany(t *testing.T) {
+	db := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3148"})
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3148"})
+	require.NoError(t, err)
+	defer client.Close()
+
+	results, err := client.GetMany(context.Background(), [][]byte{[]byte("key1"), []byte("missing"), []byte("key2"), []byte("key1")})
+	require.NoError(t, err)
+	require.Equal(t, []distdbclient.GetResult{
+		{Val: []byte("val1"), Version: 2, Found: true},
+		{},
+		{Val: []byte("val2"), Version: 3, Found: true},
+		{Val: []byte("val1"), Version: 2, Found: true},
+	}, results)
+
+	/* Split into several MGETs */
+	var keys [][]byte
+	for i := 0; i < 2*distdbclient.MGET_BATCH_SIZE+500; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%d", i)))
+	}
+	results, err = client.GetMany(context.Background(), keys)
+	require.NoError(t, err)
+	require.Len(t, results, len(keys))
+	for i, result := range results {
+		require.Equal(t, i < 2000, result.Found)
+		if result.Found {
+			require.Equal(t, fmt.Sprintf("val%d", i), string(result.Val))
+		}
+	}
+
+	results, err = client.GetMany(context.Background(), nil)
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	/* The server has its limits */
+	resp, err := client.Do(&communication.Request{Op: communication.Operation_MGET, Keys: keys})
+	require.NoError(t, err)
+	require.Equal(t, communication.Status_FAILURE, resp.Status)
+	require.Contains(t, resp.Error, ErrInvalidOperation.Error())
+}
+
+/* Lookups spanning groups are split between them */
+func TestShardedGetMany(t *testing.T) {
+	groups := []sharding.Group{{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3149"}}, {ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3150"}}}
+	shardMap, err := sharding.NewShardMap(2, groups, 0)
+	require.NoError(t, err)
+	startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3149", ShardMap: shardMap, ShardGroup: "g0"})
+	startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3150", ShardMap: shardMap, ShardGroup: "g1"})
+
+	client, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, shardMap)
+	require.NoError(t, err)
+	defer client.Close()
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		keys = append(keys, key)
+		if i%10 != 0 {
+			require.NoError(t, client.Put(key, key))
+		}
+	}
+
+	check := func(results []distdbclient.GetResult) {
+		require.Len(t, results, len(keys))
+		for i, result := range results {
+			require.Equal(t, i%10 != 0, result.Found, "key%d", i)
+			if result.Found {
+				require.Equal(t, keys[i], result.Val)
+			}
+		}
+	}
+	results, err := client.GetMany(context.Background(), keys)
+	require.NoError(t, err)
+	check(results)
+
+	/* A client with an out of date map that only knows g0 picks up the servers' map as it goes */
+	old, err := sharding.NewShardMap(1, groups[:1], 0)
+	require.NoError(t, err)
+	stale, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, old)
+	require.NoError(t, err)
+	defer stale.Close()
+	results, err = stale.GetMany(context.Background(), keys)
+	require.NoError(t, err)
+	check(results)
+	require.Equal(t, uint64(2), stale.ShardMap().Version)
+
+	/* A plain client can only ask one group */
+	plain, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3149"})
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.GetMany(context.Background(), keys)
+	require.ErrorIs(t, err, distdbclient.ErrWrongShard)
+}
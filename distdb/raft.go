@@ -0,0 +1,1476 @@
+package distdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Raft consensus (https://raft.github.io/raft.pdf), used instead of the fixed LEADER/FOLLOWER roles when RaftID is set.
+
+	Every node starts out as a follower. A follower that hasn't heard from a leader within its (randomized) election
+	timeout becomes a candidate, bumps the term and asks its peers for votes; whoever gets a majority leads that term.
+	The leader appends writes to its log, tagged with the term and their index (the write's sequence number), and
+	sends them to every peer with AppendEntries. An entry is committed once a majority has it in its log, after
+	which every node applies it to its state machine (the DB) in index order. Heartbeats are empty AppendEntries.
+
+	Each node's log only keeps entries that aren't applied yet plus the last ReplicationLogSize applied ones, a peer
+	that is behind the start of the leader's log is sent a snapshot of the state machine instead. Snapshots go out a
+	page at a time, the peer stages the pages and only installs the snapshot once the last one is in.
+
+	A leader that hasn't heard from a majority within an election timeout steps down, since the rest of the cluster
+	has most likely elected someone else by then. Reads on the leader wait until a majority answers a heartbeat sent
+	after the read came in (section 6.4 of https://github.com/ongardie/dissertation), so that a leader cut off from
+	the cluster never serves data a newer leader has already overwritten.
+
+	Membership changes one node at a time (section 4.1 of https://github.com/ongardie/dissertation): ADD_MEMBER and
+	REMOVE_MEMBER entries go through the log like writes, but every node switches to the new membership as soon as
+	the entry is in its log rather than once it commits. Any two majorities of memberships that differ by one node
+	overlap, so as long as only one change is in flight at a time there can't be two leaders. A new node starts out
+	with no membership and waits for the leader, which brings it up to date with a snapshot carrying the membership
+	(the founding membership is in the founders' configuration rather than the log). A removed node stops
+	taking part in elections once it learns of its removal, and until then nodes that hear from their leader ignore its
+	vote requests.
+
+	raftNode itself knows nothing about networking or disks: messages go through a raftTransport, persistent state
+	through a raftStorage and committed entries to a raftStateMachine, so that it can be driven by an in-process
+	harness in tests.
+*/
+
+/* Raft states */
+const (
+	RAFT_FOLLOWER = iota
+	RAFT_CANDIDATE
+	RAFT_LEADER
+)
+
+const (
+	DEFAULT_ELECTION_TIMEOUT   = 300 * time.Millisecond
+	DEFAULT_HEARTBEAT_INTERVAL = 50 * time.Millisecond
+	RAFT_MAX_APPEND_ENTRIES    = 1000    /* Most entries sent in a single AppendEntries */
+	RAFT_MAX_MESSAGE_BYTES     = 4 << 20 /* Most encoded bytes of entries sent in a single message, see fitsMessage */
+)
+
+var ErrProposalDropped = errors.New("write was overwritten by a new leader before it committed")
+var ErrRaftStopped = errors.New("raft stopped")
+var ErrMembershipChangePending = errors.New("another membership change is still in progress")
+var ErrUnknownMember = errors.New("not a member of the cluster")
+var ErrMemberExists = errors.New("already a member of the cluster at another address")
+
+type raftTransport interface {
+	/* Send msg to peer and wait for its response */
+	send(ctx context.Context, peer string, msg *communication.RaftMessage) (*communication.RaftMessage, error)
+	/* Called whenever the membership changes, with every member's address by ID */
+	setMembers(members map[string]string)
+}
+
+type raftStateMachine interface {
+	/*
+		Apply a committed entry, entries at or below the last applied index must be ignored. ErrConditionFailed (a
+		CAS whose condition doesn't hold) and ErrKeyDoesNotExist (a DELETE of a missing key) mean the entry was
+		applied as a no-op, and are passed on to its proposer
+	*/
+	applyCommitted(record *communication.LogRecord) error
+	/* Every live entry as PUTs, along with the index of the last entry applied */
+	snapshotRecords() (records []*communication.LogRecord, index uint64)
+	/* Replace the state with a snapshot as of index, unless we are already past it */
+	installSnapshot(records []*communication.LogRecord, index uint64) error
+}
+
+type raftConfig struct {
+	id                string
+	members           map[string]string /* Addresses by ID of every node (this one included) to start out with, until the log records a membership */
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	logSize           int /* Applied entries kept in the log for lagging peers */
+	maxMessageSize    int /* Largest message the transport carries, defaults to framing.DEFAULT_MAX_MESSAGE_SIZE */
+}
+
+/* A write proposed on this node, waiting to be committed and applied */
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+/* A read on the leader, waiting for a majority to confirm we still lead and for the state machine to reach index */
+type readRequest struct {
+	index     uint64
+	since     time.Time /* Only answers to messages sent after this confirm leadership */
+	confirmed bool
+	done      chan error
+}
+
+type raftNode struct {
+	config    raftConfig
+	transport raftTransport
+	storage   raftStorage
+	sm        raftStateMachine
+
+	mu        *sync.Mutex /* Guards everything below, never held while calling into the state machine other than to install a snapshot */
+	applyCond *sync.Cond  /* Signalled when commitIndex moves or the node stops */
+	state     int
+	term      uint64
+	votedFor  string
+	leader    string    /* ID of the current term's leader, empty if we don't know it yet */
+	lastHeard time.Time /* When we last heard from the leader */
+
+	members         map[string]string /* As of the last entry in the log, committed or not */
+	snapshotMembers map[string]string /* As of snapshotIndex */
+	configIndex     uint64            /* Index of the last membership change in the log, 0 if there is none after snapshotIndex */
+
+	log           []*communication.LogRecord /* Entries after snapshotIndex, log[i].Seq == snapshotIndex+1+i */
+	snapshotIndex uint64                     /* Index of the last entry dropped from the log */
+	snapshotTerm  uint64
+	commitIndex   uint64
+	lastApplied   uint64
+
+	staged      []*communication.LogRecord /* Pages of the snapshot being received so far */
+	stagedIndex uint64                     /* Index and term of the snapshot being received */
+	stagedTerm  uint64
+
+	nextIndex   map[string]uint64    /* Leader only, next entry to send to each peer */
+	matchIndex  map[string]uint64    /* Leader only, last entry known to be in each peer's log */
+	lastAck     map[string]time.Time /* Leader only, when we sent the latest message each peer answered */
+	leaderSince time.Time            /* Leader only, when we were elected */
+	termStart   uint64               /* Leader only, index of the no-op our term started with */
+	votes       int                  /* Candidate only */
+
+	electionDeadline time.Time
+	proposals        map[uint64]*proposal /* By index */
+	reads            []*readRequest
+	triggers         map[string]chan struct{}
+
+	ctx     context.Context /* Cancelled on stop, so that in-flight RPCs are abandoned */
+	cancel  context.CancelFunc
+	started bool
+	stopped bool
+	wg      *sync.WaitGroup
+}
+
+/*
+	Load persisted state from storage, applied is the index of the last entry the state machine already has.
+	The node does nothing until start is called.
+*/
+func newRaftNode(config raftConfig, transport raftTransport, storage raftStorage, sm raftStateMachine, applied uint64) (*raftNode, error) {
+	if config.electionTimeout <= 0 {
+		config.electionTimeout = DEFAULT_ELECTION_TIMEOUT
+	}
+	if config.heartbeatInterval <= 0 {
+		config.heartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if config.logSize <= 0 {
+		config.logSize = DEFAULT_REPLICATION_LOG_SIZE
+	}
+	if config.maxMessageSize <= 0 {
+		config.maxMessageSize = framing.DEFAULT_MAX_MESSAGE_SIZE
+	}
+
+	state, err := storage.load()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &raftNode{
+		config:        config,
+		transport:     transport,
+		storage:       storage,
+		sm:            sm,
+		mu:            &sync.Mutex{},
+		state:         RAFT_FOLLOWER,
+		term:          state.term,
+		votedFor:      state.votedFor,
+		log:           state.entries,
+		snapshotIndex: state.snapshotIndex,
+		snapshotTerm:  state.snapshotTerm,
+		proposals:     map[uint64]*proposal{},
+		triggers:      map[string]chan struct{}{},
+		ctx:           ctx,
+		cancel:        cancel,
+		wg:            &sync.WaitGroup{},
+	}
+	n.applyCond = sync.NewCond(n.mu)
+
+	/* Nothing recorded yet, this is the first time we start */
+	n.snapshotMembers = state.members
+	record := n.snapshotMembers == nil
+	if record {
+		n.snapshotMembers = copyMembers(config.members)
+	}
+
+	/*
+		The log is only ever compacted up to entries that were applied, and entries are only applied once they are in
+		the log, so the state machine should be somewhere within the log. If it isn't (say the state machine was
+		restored separately) the log can't be trusted to lead up to it: start over from the state machine's index.
+	*/
+	if applied < n.snapshotIndex || applied > n.lastIndex() {
+		fmt.Printf("\nRaft log (%d-%d) doesn't cover applied index %d, discarding it", n.snapshotIndex, n.lastIndex(), applied)
+		n.log, n.snapshotIndex, n.snapshotTerm = nil, applied, 0
+		record = true
+	}
+	if record {
+		err := storage.compact(n.snapshotIndex, n.snapshotTerm, n.snapshotMembers, n.log)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	n.refreshMembers()
+
+	/* Anything the state machine has was committed */
+	n.commitIndex, n.lastApplied = applied, applied
+
+	return n, nil
+}
+
+func (n *raftNode) start() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.started = true
+	n.resetElectionTimer()
+	n.refreshMembers()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applier()
+}
+
+/* Stop every goroutine and close storage, proposals still waiting fail with ErrRaftStopped */
+func (n *raftNode) stop() error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil
+	}
+	n.stopped = true
+	n.cancel()
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for index, p := range n.proposals {
+		p.done <- ErrRaftStopped
+		delete(n.proposals, index)
+	}
+	n.failReads(ErrRaftStopped)
+	return n.storage.close()
+}
+
+/* Election timer and heartbeats */
+func (n *raftNode) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		/* Check quorum: cut off from the majority, which has most likely moved on without us */
+		if n.state == RAFT_LEADER && time.Since(n.leaderSince) > n.config.electionTimeout &&
+			!n.heardFromMajoritySince(time.Now().Add(-n.config.electionTimeout)) {
+			fmt.Printf("\n%s hasn't heard from a majority within the election timeout, stepping down", n.config.id)
+			n.stepDown(n.term)
+			n.leader = ""
+			n.resetElectionTimer()
+		}
+		isLeader := n.state == RAFT_LEADER
+		/* Nodes that aren't members (yet, or any more) wait to hear from the leader */
+		_, isMember := n.members[n.config.id]
+		electionDue := !isLeader && isMember && time.Now().After(n.electionDeadline)
+		if isLeader {
+			n.triggerAll()
+		}
+		n.mu.Unlock()
+
+		if electionDue {
+			n.campaign()
+		}
+	}
+}
+
+/* Become a candidate for the next term and ask every peer for its vote */
+func (n *raftNode) campaign() {
+	n.mu.Lock()
+	n.state = RAFT_CANDIDATE
+	n.term++
+	n.votedFor = n.config.id
+	n.leader = ""
+	n.votes = 1
+	n.resetElectionTimer()
+	if err := n.persistState(); err != nil {
+		fmt.Printf("\nError persisting raft state: %v", err)
+		n.mu.Unlock()
+		return
+	}
+	fmt.Printf("\n%s campaigning for term %d", n.config.id, n.term)
+
+	/* Single node cluster */
+	if n.hasMajority(n.votes) {
+		n.becomeLeader()
+		n.mu.Unlock()
+		return
+	}
+
+	term := n.term
+	lastIndex := n.lastIndex()
+	msg := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_VOTE, Term: term, From: n.config.id, LastLogIndex: lastIndex, LastLogTerm: n.termAt(lastIndex)}
+	peers := n.peers()
+	n.mu.Unlock()
+
+	for _, peer := range peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			resp, err := n.call(peer, msg)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if _, ok := n.members[peer]; n.state != RAFT_CANDIDATE || n.term != term || !resp.Granted || !ok {
+				return
+			}
+			n.votes++
+			if n.hasMajority(n.votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) becomeLeader() {
+	fmt.Printf("\n%s elected leader for term %d", n.config.id, n.term)
+	n.state = RAFT_LEADER
+	n.leader = n.config.id
+	n.nextIndex, n.matchIndex, n.lastAck = map[string]uint64{}, map[string]uint64{}, map[string]time.Time{}
+	n.leaderSince = time.Now()
+	for _, peer := range n.peers() {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+
+	/* Entries from earlier terms can only be committed along with one from our own, so commit a no-op right away */
+	noop := &communication.LogRecord{Version: LOG_RECORD_VERSION, Op: communication.Operation_NOOP, Term: n.term, Seq: n.lastIndex() + 1}
+	n.termStart = noop.Seq
+	if err := n.appendEntries([]*communication.LogRecord{noop}); err != nil {
+		fmt.Printf("\nError appending to raft log: %v", err)
+	}
+	n.advanceCommit()
+	n.triggerAll()
+}
+
+/* Move to term (if it is newer) as a follower, reads waiting on our leadership fail. Call this only with n.mu held */
+func (n *raftNode) stepDown(term uint64) {
+	n.failReads(ErrNotLeader)
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.persistState(); err != nil {
+			fmt.Printf("\nError persisting raft state: %v", err)
+		}
+	}
+	n.state = RAFT_FOLLOWER
+}
+
+/*
+	Append record to the log and wait for it to be committed and applied. Fails with ErrNotLeader if we aren't the
+	leader, and with ErrProposalDropped if a new leader overwrote it. Giving up on ctx doesn't take the write back,
+	it may still be committed later.
+
+	ADD_MEMBER and REMOVE_MEMBER records change the membership, one at a time: they fail with
+	ErrMembershipChangePending while an earlier change (or one from a previous leader) hasn't committed yet.
+*/
+func (n *raftNode) propose(ctx context.Context, record *communication.LogRecord) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrRaftStopped
+	}
+	if n.state != RAFT_LEADER {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if isMembershipChange(record) {
+		if err := n.checkMembershipChange(record); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+
+	record.Version, record.Term, record.Seq = LOG_RECORD_VERSION, n.term, n.lastIndex()+1
+	if err := n.appendEntries([]*communication.LogRecord{record}); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	p := &proposal{term: n.term, done: make(chan error, 1)}
+	n.proposals[record.Seq] = p
+	n.advanceCommit()
+	n.triggerAll()
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.proposals, record.Seq)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+/* Whether record can be appended as the next membership change. Call this only with n.mu held */
+func (n *raftNode) checkMembershipChange(record *communication.LogRecord) error {
+	/*
+		Until an entry of our own term commits, a change proposed by a previous leader may still be in some logs
+		without us knowing it's there (see the bug fix in https://groups.google.com/g/raft-dev/c/t4xj6dJTP6E)
+	*/
+	if n.configIndex > n.commitIndex || n.termAt(n.commitIndex) != n.term {
+		return ErrMembershipChangePending
+	}
+
+	id, addr := string(record.Key), string(record.Val)
+	current, ok := n.members[id]
+	switch record.Op {
+	case communication.Operation_ADD_MEMBER:
+		if ok && current != addr {
+			return fmt.Errorf("%w: %s at %s", ErrMemberExists, id, current)
+		}
+	case communication.Operation_REMOVE_MEMBER:
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownMember, id)
+		}
+		if len(n.members) == 1 {
+			return fmt.Errorf("%w: can't remove the last member", ErrInvalidOperation)
+		}
+	}
+	return nil
+}
+
+/*
+	Wait until reads here see every write committed before the call: a majority has to confirm that we are still the
+	leader, and the state machine has to catch up with what was committed by then. Fails with ErrNotLeader if we aren't
+	the leader or stop being it meanwhile.
+*/
+func (n *raftNode) readIndex(ctx context.Context) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrRaftStopped
+	}
+	if n.state != RAFT_LEADER {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	/* Until the no-op we started our term with commits, earlier terms may have committed more than we know of */
+	index := n.commitIndex
+	if index < n.termStart {
+		index = n.termStart
+	}
+	read := &readRequest{index: index, since: time.Now(), done: make(chan error, 1)}
+	n.reads = append(n.reads, read)
+	n.checkReads()
+	n.triggerAll()
+	n.mu.Unlock()
+
+	select {
+	case err := <-read.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/* Handle an incoming RPC */
+func (n *raftNode) handle(msg *communication.RaftMessage) (*communication.RaftMessage, error) {
+	var resp *communication.RaftMessage
+	switch msg.Type {
+	case communication.RaftMessageType_RAFT_VOTE:
+		resp = n.handleVote(msg)
+	case communication.RaftMessageType_RAFT_APPEND:
+		resp = n.handleAppend(msg)
+	case communication.RaftMessageType_RAFT_SNAPSHOT:
+		resp = n.handleSnapshot(msg)
+	default:
+		return nil, fmt.Errorf("%w: raft message %s", ErrInvalidOperation, msg.Type)
+	}
+
+	/* Storage is closed once we stop, don't answer with state we can't keep */
+	if resp == nil {
+		return nil, ErrRaftStopped
+	}
+	return resp, nil
+}
+
+func (n *raftNode) handleVote(msg *communication.RaftMessage) *communication.RaftMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil
+	}
+
+	/*
+		We have a leader that is alive and well, this is most likely a removed node that hasn't heard of its removal.
+		Don't let it bump our term and depose the leader. A leader that is cut off steps down on its own (see run).
+	*/
+	resp := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_VOTE_RESPONSE, Term: n.term, From: n.config.id}
+	if n.state == RAFT_LEADER || (n.leader != "" && time.Since(n.lastHeard) < n.config.electionTimeout) {
+		return resp
+	}
+
+	if msg.Term > n.term {
+		n.stepDown(msg.Term)
+	}
+	resp.Term = n.term
+	if msg.Term < n.term {
+		return resp
+	}
+
+	/* Only vote for candidates whose log has everything ours does, so that a leader always has every committed entry */
+	lastIndex := n.lastIndex()
+	lastTerm := n.termAt(lastIndex)
+	upToDate := msg.LastLogTerm > lastTerm || (msg.LastLogTerm == lastTerm && msg.LastLogIndex >= lastIndex)
+	if (n.votedFor == "" || n.votedFor == msg.From) && upToDate {
+		n.votedFor = msg.From
+		if err := n.persistState(); err != nil {
+			fmt.Printf("\nError persisting raft state: %v", err)
+			return resp
+		}
+		n.resetElectionTimer()
+		resp.Granted = true
+	}
+
+	return resp
+}
+
+func (n *raftNode) handleAppend(msg *communication.RaftMessage) *communication.RaftMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil
+	}
+
+	resp := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_APPEND_RESPONSE, From: n.config.id}
+	if msg.Term < n.term {
+		resp.Term = n.term
+		return resp
+	}
+	n.stepDown(msg.Term)
+	n.leader, n.lastHeard = msg.From, time.Now()
+	n.resetElectionTimer()
+	resp.Term = n.term
+
+	/*
+		The founding membership isn't in the log, it is in the founders' configuration. A node that joined later only
+		learns it from a snapshot, which carries the membership along with it.
+	*/
+	if len(n.snapshotMembers) == 0 {
+		resp.NeedsSnapshot = true
+		return resp
+	}
+
+	/* Our log has to match the leader's up to PrevLogIndex, everything up to snapshotIndex is committed and so matches */
+	lastIndex := n.lastIndex()
+	if msg.PrevLogIndex > lastIndex {
+		resp.MatchIndex = lastIndex
+		return resp
+	}
+	if msg.PrevLogIndex > n.snapshotIndex && n.termAt(msg.PrevLogIndex) != msg.PrevLogTerm {
+		/* Have the leader skip back over the whole conflicting term rather than one entry at a time */
+		conflictTerm := n.termAt(msg.PrevLogIndex)
+		i := msg.PrevLogIndex
+		for i > n.snapshotIndex+1 && n.termAt(i-1) == conflictTerm {
+			i--
+		}
+		resp.MatchIndex = i - 1
+		return resp
+	}
+
+	/* Skip entries we already have, drop a conflicting suffix and append the rest */
+	for j, entry := range msg.Entries {
+		index := msg.PrevLogIndex + 1 + uint64(j)
+		if index <= n.snapshotIndex {
+			continue
+		}
+		if index <= n.lastIndex() {
+			if n.termAt(index) == entry.Term {
+				continue
+			}
+			if err := n.truncate(index); err != nil {
+				fmt.Printf("\nError truncating raft log: %v", err)
+				return resp
+			}
+		}
+		if err := n.appendEntries(msg.Entries[j:]); err != nil {
+			fmt.Printf("\nError appending to raft log: %v", err)
+			return resp
+		}
+		break
+	}
+
+	resp.Success = true
+	resp.MatchIndex = msg.PrevLogIndex + uint64(len(msg.Entries))
+
+	commit := msg.LeaderCommit
+	if commit > resp.MatchIndex {
+		commit = resp.MatchIndex
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.applyCond.Broadcast()
+	}
+
+	return resp
+}
+
+func (n *raftNode) handleSnapshot(msg *communication.RaftMessage) *communication.RaftMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return nil
+	}
+
+	resp := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_SNAPSHOT_RESPONSE, From: n.config.id}
+	if msg.Term < n.term {
+		resp.Term = n.term
+		return resp
+	}
+	n.stepDown(msg.Term)
+	n.leader, n.lastHeard = msg.From, time.Now()
+	n.resetElectionTimer()
+	resp.Term = n.term
+
+	if msg.SnapshotIndex <= n.commitIndex && len(n.snapshotMembers) > 0 {
+		resp.Success, resp.MatchIndex = true, msg.SnapshotIndex
+		return resp
+	}
+
+	/* A page that doesn't follow on from the ones staged so far is refused, the leader starts over */
+	if msg.SnapshotOffset == 0 {
+		n.staged, n.stagedIndex, n.stagedTerm = nil, msg.SnapshotIndex, msg.SnapshotTerm
+	}
+	if msg.SnapshotOffset != uint64(len(n.staged)) || msg.SnapshotIndex != n.stagedIndex || msg.SnapshotTerm != n.stagedTerm {
+		return resp
+	}
+	n.staged = append(n.staged, msg.Entries...)
+	if !msg.SnapshotDone {
+		resp.Success = true
+		return resp
+	}
+	records := n.staged
+	n.staged = nil
+
+	fmt.Printf("\n%s installing snapshot as of index %d", n.config.id, msg.SnapshotIndex)
+	err := n.sm.installSnapshot(records, msg.SnapshotIndex)
+	if err != nil {
+		fmt.Printf("\nError installing snapshot: %v", err)
+		return resp
+	}
+
+	/* Keep whatever follows the snapshot if it is consistent with it */
+	if msg.SnapshotIndex < n.lastIndex() && n.termAt(msg.SnapshotIndex) == msg.SnapshotTerm {
+		n.log = append([]*communication.LogRecord(nil), n.log[msg.SnapshotIndex-n.snapshotIndex:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapshotIndex, n.snapshotTerm = msg.SnapshotIndex, msg.SnapshotTerm
+	n.snapshotMembers = decodeMembers(msg.Members)
+	n.commitIndex = msg.SnapshotIndex
+	if n.lastApplied < msg.SnapshotIndex {
+		n.lastApplied = msg.SnapshotIndex
+	}
+	n.refreshMembers()
+	if err := n.storage.compact(n.snapshotIndex, n.snapshotTerm, n.snapshotMembers, n.log); err != nil {
+		fmt.Printf("\nError compacting raft log: %v", err)
+		return resp
+	}
+
+	resp.Success, resp.MatchIndex = true, msg.SnapshotIndex
+	return resp
+}
+
+/* Leader only, keep peer's log in line with ours, woken up by heartbeats and new entries. Exits once peer is removed */
+func (n *raftNode) replicator(peer string, trigger chan struct{}) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-trigger:
+		}
+
+		n.mu.Lock()
+		if _, ok := n.members[peer]; !ok {
+			delete(n.triggers, peer)
+			n.mu.Unlock()
+			return
+		}
+		if n.state != RAFT_LEADER {
+			n.mu.Unlock()
+			continue
+		}
+		term := n.term
+		next := n.nextIndex[peer]
+		if next <= n.snapshotIndex {
+			n.mu.Unlock()
+			n.sendSnapshot(peer, term)
+			continue
+		}
+
+		prev := next - 1
+		msg := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_APPEND, Term: term, From: n.config.id,
+			PrevLogIndex: prev, PrevLogTerm: n.termAt(prev), LeaderCommit: n.commitIndex}
+		end, size := prev, 0
+		for end < n.lastIndex() && end-prev < RAFT_MAX_APPEND_ENTRIES && n.fitsMessage(int(end-prev), size, n.entry(end+1)) {
+			size += proto.Size(n.entry(end + 1))
+			end++
+		}
+		/* Copied, the log may be truncated under us once we let go of the lock */
+		msg.Entries = append([]*communication.LogRecord(nil), n.log[prev-n.snapshotIndex:end-n.snapshotIndex]...)
+		n.mu.Unlock()
+
+		sent := time.Now()
+		resp, err := n.call(peer, msg)
+		if err != nil {
+			continue
+		}
+		n.handleAppendResponse(peer, term, next, sent, resp)
+	}
+}
+
+/* sent is when we sent the AppendEntries resp answers */
+func (n *raftNode) handleAppendResponse(peer string, term, next uint64, sent time.Time, resp *communication.RaftMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.state != RAFT_LEADER || n.term != term {
+		return
+	}
+	/* Even a rejection means peer takes us for its leader */
+	n.ack(peer, sent)
+
+	if resp.NeedsSnapshot {
+		n.nextIndex[peer] = 0
+		n.trigger(peer)
+		return
+	}
+
+	if resp.Success {
+		if resp.MatchIndex > n.matchIndex[peer] {
+			n.matchIndex[peer] = resp.MatchIndex
+		}
+		if n.matchIndex[peer]+1 > n.nextIndex[peer] {
+			n.nextIndex[peer] = n.matchIndex[peer] + 1
+		}
+		n.advanceCommit()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.trigger(peer)
+		}
+		return
+	}
+
+	/* Back up to where the peer says our logs may still match, at least one entry */
+	retry := next - 1
+	if resp.MatchIndex+1 < retry {
+		retry = resp.MatchIndex + 1
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	n.nextIndex[peer] = retry
+	n.trigger(peer)
+}
+
+/*
+	Send peer a snapshot of the state machine, a page at a time (see fitsMessage). An error or a refused page gives up
+	until peer is next triggered, which starts over with a fresh snapshot.
+*/
+func (n *raftNode) sendSnapshot(peer string, term uint64) {
+	records, index := n.sm.snapshotRecords()
+
+	n.mu.Lock()
+	/* The log may have been compacted past the snapshot meanwhile, we'll be back on the next heartbeat */
+	if n.state != RAFT_LEADER || n.term != term || index < n.snapshotIndex {
+		n.mu.Unlock()
+		return
+	}
+	snapshotTerm, members := n.termAt(index), encodeMembers(n.membersAt(index))
+	n.mu.Unlock()
+
+	for offset := 0; ; {
+		end, size := offset, 0
+		for end < len(records) && n.fitsMessage(end-offset, size, records[end]) {
+			size += proto.Size(records[end])
+			end++
+		}
+		msg := &communication.RaftMessage{Type: communication.RaftMessageType_RAFT_SNAPSHOT, Term: term, From: n.config.id,
+			SnapshotIndex: index, SnapshotTerm: snapshotTerm, Entries: records[offset:end], Members: members,
+			SnapshotOffset: uint64(offset), SnapshotDone: end == len(records)}
+
+		sent := time.Now()
+		resp, err := n.call(peer, msg)
+		if err != nil || !n.handleSnapshotResponse(peer, term, sent, resp) || msg.SnapshotDone {
+			return
+		}
+		offset = end
+	}
+}
+
+/* sent is when we sent the snapshot page resp answers, returns whether to go on with the next page */
+func (n *raftNode) handleSnapshotResponse(peer string, term uint64, sent time.Time, resp *communication.RaftMessage) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.state != RAFT_LEADER || n.term != term {
+		return false
+	}
+	n.ack(peer, sent)
+	if !resp.Success {
+		return false
+	}
+	/* Staged, but not installed yet */
+	if resp.MatchIndex == 0 {
+		return true
+	}
+
+	if resp.MatchIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = resp.MatchIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+	n.trigger(peer)
+	return false
+}
+
+/* Commit the latest entry of our term that a majority has. Call this only with n.mu held */
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		/* Entries from earlier terms are committed by committing one from ours after them */
+		if n.termAt(index) != n.term {
+			return
+		}
+
+		/* We don't count towards the majority once we've removed ourselves */
+		count := 0
+		if _, ok := n.members[n.config.id]; ok {
+			count++
+		}
+		for _, peer := range n.peers() {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.hasMajority(count) {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			/* Let the followers know */
+			n.triggerAll()
+			n.maybeLeave()
+			return
+		}
+	}
+}
+
+/* Step down once our own removal has committed, leaving the rest of the cluster to elect a new leader. Call this only with n.mu held */
+func (n *raftNode) maybeLeave() {
+	if _, ok := n.members[n.config.id]; ok || n.commitIndex < n.configIndex {
+		return
+	}
+	fmt.Printf("\n%s removed from the cluster, stepping down", n.config.id)
+	n.stepDown(n.term)
+	n.leader = ""
+	/* Give the rest a chance to hear of it before they elect someone without us */
+	n.triggerAll()
+}
+
+/* Apply committed entries to the state machine in order and let proposals know */
+func (n *raftNode) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			n.mu.Unlock()
+			return
+		}
+		var entries []*communication.LogRecord
+		for index := n.lastApplied + 1; index <= n.commitIndex; index++ {
+			entries = append(entries, n.entry(index))
+		}
+		n.mu.Unlock()
+
+		for _, entry := range entries {
+			err := n.sm.applyCommitted(entry)
+			if err != nil && !appliedAsNoop(err) {
+				/* Entries can't be skipped, try again in a bit */
+				fmt.Printf("\nError applying index %d: %v", entry.Seq, err)
+				time.Sleep(n.config.heartbeatInterval)
+				break
+			}
+
+			n.mu.Lock()
+			if entry.Seq > n.lastApplied {
+				n.lastApplied = entry.Seq
+			}
+			if p, ok := n.proposals[entry.Seq]; ok {
+				delete(n.proposals, entry.Seq)
+				if p.term == entry.Term {
+					p.done <- err
+				} else {
+					p.done <- ErrProposalDropped
+				}
+			}
+			n.checkReads()
+			n.mu.Unlock()
+		}
+
+		n.mu.Lock()
+		n.maybeCompact()
+		n.mu.Unlock()
+	}
+}
+
+/* Drop applied entries once the log is twice logSize, keeping the last logSize. Call this only with n.mu held */
+func (n *raftNode) maybeCompact() {
+	if len(n.log) <= 2*n.config.logSize {
+		return
+	}
+
+	drop := uint64(len(n.log) - n.config.logSize)
+	if applied := n.lastApplied - n.snapshotIndex; drop > applied {
+		drop = applied
+	}
+	if drop == 0 {
+		return
+	}
+
+	snapshotIndex := n.snapshotIndex + drop
+	snapshotTerm := n.termAt(snapshotIndex)
+	snapshotMembers := n.membersAt(snapshotIndex)
+	log := append([]*communication.LogRecord(nil), n.log[drop:]...)
+	if err := n.storage.compact(snapshotIndex, snapshotTerm, snapshotMembers, log); err != nil {
+		fmt.Printf("\nError compacting raft log: %v", err)
+		return
+	}
+	n.log, n.snapshotIndex, n.snapshotTerm, n.snapshotMembers = log, snapshotIndex, snapshotTerm, snapshotMembers
+	n.refreshMembers()
+}
+
+/* Persist and append entries, which must follow on from the last entry. Call this only with n.mu held */
+func (n *raftNode) appendEntries(entries []*communication.LogRecord) error {
+	if err := n.storage.append(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	for _, entry := range entries {
+		if isMembershipChange(entry) {
+			n.refreshMembers()
+			break
+		}
+	}
+	return nil
+}
+
+/* Drop the entry at index and everything after it. Call this only with n.mu held */
+func (n *raftNode) truncate(index uint64) error {
+	if err := n.storage.truncate(index); err != nil {
+		return err
+	}
+	n.log = n.log[:index-n.snapshotIndex-1]
+	/* Back to the membership before a change we took back */
+	if n.configIndex >= index {
+		n.refreshMembers()
+	}
+
+	for i, p := range n.proposals {
+		if i >= index {
+			p.done <- ErrProposalDropped
+			delete(n.proposals, i)
+		}
+	}
+	return nil
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) persistState() error {
+	return n.storage.saveState(n.term, n.votedFor)
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) resetElectionTimer() {
+	timeout := n.config.electionTimeout + time.Duration(rand.Int63n(int64(n.config.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) hasMajority(count int) bool {
+	return 2*count > len(n.members)
+}
+
+/* Whether a majority, us included, answered messages we sent at or after since. Call this only with n.mu held */
+func (n *raftNode) heardFromMajoritySince(since time.Time) bool {
+	count := 0
+	if _, ok := n.members[n.config.id]; ok {
+		count++
+	}
+	for _, peer := range n.peers() {
+		if !n.lastAck[peer].Before(since) {
+			count++
+		}
+	}
+	return n.hasMajority(count)
+}
+
+/* peer answered a message we sent at sent while leading our current term. Call this only with n.mu held */
+func (n *raftNode) ack(peer string, sent time.Time) {
+	if sent.After(n.lastAck[peer]) {
+		n.lastAck[peer] = sent
+	}
+	n.checkReads()
+}
+
+/* Let reads whose leadership is confirmed and whose index is applied go ahead. Call this only with n.mu held */
+func (n *raftNode) checkReads() {
+	pending := n.reads[:0]
+	for _, read := range n.reads {
+		if !read.confirmed {
+			read.confirmed = n.heardFromMajoritySince(read.since)
+		}
+		if read.confirmed && n.lastApplied >= read.index {
+			read.done <- nil
+			continue
+		}
+		pending = append(pending, read)
+	}
+	n.reads = pending
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) failReads(err error) {
+	for _, read := range n.reads {
+		read.done <- err
+	}
+	n.reads = nil
+}
+
+/* Every member other than us, sorted. Call this only with n.mu held */
+func (n *raftNode) peers() []string {
+	peers := make([]string, 0, len(n.members))
+	for id := range n.members {
+		if id != n.config.id {
+			peers = append(peers, id)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+/* Membership as of index, which must be at or after snapshotIndex. Call this only with n.mu held */
+func (n *raftNode) membersAt(index uint64) map[string]string {
+	members := copyMembers(n.snapshotMembers)
+	for i := n.snapshotIndex + 1; i <= index && i <= n.lastIndex(); i++ {
+		entry := n.entry(i)
+		switch entry.Op {
+		case communication.Operation_ADD_MEMBER:
+			members[string(entry.Key)] = string(entry.Val)
+		case communication.Operation_REMOVE_MEMBER:
+			delete(members, string(entry.Key))
+		}
+	}
+	return members
+}
+
+/*
+	Switch to the membership as of the last entry in the log, starting replicators for new peers. Replicators of removed
+	peers notice on their own once triggered. Call this only with n.mu held
+*/
+func (n *raftNode) refreshMembers() {
+	n.members = n.membersAt(n.lastIndex())
+	n.configIndex = 0
+	for i := n.lastIndex(); i > n.snapshotIndex; i-- {
+		if isMembershipChange(n.entry(i)) {
+			n.configIndex = i
+			break
+		}
+	}
+	n.transport.setMembers(copyMembers(n.members))
+
+	for _, peer := range n.peers() {
+		if n.state == RAFT_LEADER {
+			if _, ok := n.nextIndex[peer]; !ok {
+				n.nextIndex[peer], n.matchIndex[peer] = n.lastIndex()+1, 0
+			}
+		}
+		if _, ok := n.triggers[peer]; ok || !n.started || n.stopped {
+			continue
+		}
+		trigger := make(chan struct{}, 1)
+		n.triggers[peer] = trigger
+		n.wg.Add(1)
+		go n.replicator(peer, trigger)
+	}
+	n.triggerAll()
+}
+
+/* Whether the state machine's error means it applied the entry as a no-op, see raftStateMachine */
+func appliedAsNoop(err error) bool {
+	return errors.Is(err, ErrConditionFailed) || errors.Is(err, ErrKeyDoesNotExist)
+}
+
+func isMembershipChange(record *communication.LogRecord) bool {
+	return record.Op == communication.Operation_ADD_MEMBER || record.Op == communication.Operation_REMOVE_MEMBER
+}
+
+/*
+	Whether record can go in a message that has count entries of size encoded bytes so far. Messages are kept to
+	RAFT_MAX_MESSAGE_BYTES of entries (or half of maxMessageSize if that is smaller, leaving room for the rest of the
+	message), but always take their first entry.
+*/
+func (n *raftNode) fitsMessage(count, size int, record *communication.LogRecord) bool {
+	if count == 0 {
+		return true
+	}
+	maxBytes := RAFT_MAX_MESSAGE_BYTES
+	if n.config.maxMessageSize/2 < maxBytes {
+		maxBytes = n.config.maxMessageSize / 2
+	}
+	return size+proto.Size(record) <= maxBytes
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.log))
+}
+
+/* Term of the entry at index, 0 if it is no longer (or not yet) in the log. Call this only with n.mu held */
+func (n *raftNode) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.entry(index).Term
+}
+
+/* Call this only with n.mu held, and index within the log */
+func (n *raftNode) entry(index uint64) *communication.LogRecord {
+	return n.log[index-n.snapshotIndex-1]
+}
+
+/* Call this only with n.mu held */
+func (n *raftNode) trigger(peer string) {
+	select {
+	case n.triggers[peer] <- struct{}{}:
+	default:
+	}
+}
+
+/* Every replicator, those of removed peers included so that they exit. Call this only with n.mu held */
+func (n *raftNode) triggerAll() {
+	for peer := range n.triggers {
+		n.trigger(peer)
+	}
+}
+
+func (n *raftNode) call(peer string, msg *communication.RaftMessage) (*communication.RaftMessage, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.electionTimeout)
+	defer cancel()
+	return n.transport.send(ctx, peer, msg)
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == RAFT_LEADER
+}
+
+/* ID of the leader we last heard from, empty if we don't know of one */
+func (n *raftNode) leaderID() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+/* Address of member id, empty if it isn't one */
+func (n *raftNode) memberAddr(id string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.members[id]
+}
+
+/* Current membership, by ID */
+func (n *raftNode) membership() map[string]string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return copyMembers(n.members)
+}
+
+func (n *raftNode) currentTerm() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+/* Sends raft messages to the other members as RAFT requests */
+type networkTransport struct {
+	mu             *sync.Mutex
+	clients        map[string]*distdbclient.Client
+	addrs          map[string]string /* Address each client connects to */
+	id             string
+	peerConfigs    map[string]distdbclient.ClientConfig /* RaftPeers, for client settings other than the address */
+	protocol       string
+	maxMessageSize int
+	token          string
+}
+
+func (t *networkTransport) send(ctx context.Context, peer string, msg *communication.RaftMessage) (*communication.RaftMessage, error) {
+	t.mu.Lock()
+	client, ok := t.clients[peer]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMember, peer)
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DoContext(ctx, &communication.Request{Op: communication.Operation_RAFT, Raft: data, Token: t.token})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != communication.Status_SUCCESS {
+		return nil, errors.New(resp.Error)
+	}
+
+	var respMsg communication.RaftMessage
+	err = proto.Unmarshal(resp.Raft, &respMsg)
+	if err != nil {
+		return nil, err
+	}
+	return &respMsg, nil
+}
+
+/* Connect to new members (lazily, peers come and go, that's the point) and drop removed ones */
+func (t *networkTransport) setMembers(members map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, client := range t.clients {
+		if addr, ok := members[id]; !ok || addr != t.addrs[id] {
+			client.Close()
+			delete(t.clients, id)
+			delete(t.addrs, id)
+		}
+	}
+
+	for id, addr := range members {
+		if _, ok := t.clients[id]; ok || id == t.id {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			fmt.Printf("\nInvalid address %q for raft member %s: %v", addr, id, err)
+			continue
+		}
+
+		config, ok := t.peerConfigs[id]
+		if !ok {
+			config = distdbclient.ClientConfig{ServerProtocol: t.protocol, MaxMessageSize: t.maxMessageSize}
+		}
+		config.ServerHost, config.ServerPort, config.LazyConnect = host, port, true
+		client, err := distdbclient.NewClient(config)
+		if err != nil {
+			fmt.Printf("\nError connecting to raft member %s: %v", id, err)
+			continue
+		}
+		t.clients[id], t.addrs[id] = client, addr
+	}
+}
+
+func (t *networkTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, client := range t.clients {
+		client.Close()
+	}
+	t.clients = map[string]*distdbclient.Client{}
+}
+
+/* Join the raft cluster in RaftPeers if RaftID is set, or wait to be added to one if RaftJoin is also set */
+func initRaft(db *DB) error {
+	if db.config.RaftID == "" {
+		return nil
+	}
+
+	members := map[string]string{}
+	if !db.config.RaftJoin {
+		if _, ok := db.config.RaftPeers[db.config.RaftID]; !ok {
+			return fmt.Errorf("raft ID %q missing from RaftPeers", db.config.RaftID)
+		}
+		for id, peerConfig := range db.config.RaftPeers {
+			members[id] = net.JoinHostPort(peerConfig.ServerHost, peerConfig.ServerPort)
+		}
+	}
+
+	transport := &networkTransport{mu: &sync.Mutex{}, clients: map[string]*distdbclient.Client{}, addrs: map[string]string{}, id: db.config.RaftID,
+		peerConfigs: db.config.RaftPeers, protocol: db.config.ServerProtocol, maxMessageSize: db.config.MaxMessageSize, token: db.config.ReplicationToken}
+
+	var storage raftStorage = newMemRaftStorage()
+	if db.config.Persist {
+		storage = openDiskRaftStorage(db.config.DiskFileName)
+	}
+
+	config := raftConfig{id: db.config.RaftID, members: members, electionTimeout: db.config.ElectionTimeout,
+		heartbeatInterval: db.config.HeartbeatInterval, logSize: db.config.ReplicationLogSize, maxMessageSize: db.config.MaxMessageSize}
+	node, err := newRaftNode(config, transport, storage, db, db.seq)
+	if err != nil {
+		transport.close()
+		storage.close()
+		return err
+	}
+
+	db.raft, db.raftTransport = node, transport
+	node.start()
+	return nil
+}
+
+/*
+	Wait until the raft leader can serve reads without missing committed writes, see raftNode.readIndex. A leader cut
+	off from the cluster fails with ErrNotLeader once it notices, or with ErrQuorumNotReached until then.
+*/
+func (db *DB) raftRead() error {
+	timeout := db.replicationTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := db.raft.readIndex(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: leadership not confirmed within %s", ErrQuorumNotReached, timeout)
+	}
+	return err
+}
+
+/*
+	Add node id, listening on host:port addr, to the raft cluster. The leader brings it up to date, start it with
+	RaftJoin set. Adding a member that is already there at the same address is a no-op.
+*/
+func (db *DB) AddMember(id, addr string) error {
+	if db.raft == nil {
+		return fmt.Errorf("%w: not in a raft cluster", ErrInvalidOperation)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil || id == "" {
+		return fmt.Errorf("%w: member %q at %q", ErrInvalidOperation, id, addr)
+	}
+	if db.raft.memberAddr(id) == addr {
+		return nil
+	}
+	return db.raftPropose(&communication.LogRecord{Op: communication.Operation_ADD_MEMBER, Key: []byte(id), Val: []byte(addr)})
+}
+
+/* Remove node id from the raft cluster, once this returns it can be shut down */
+func (db *DB) RemoveMember(id string) error {
+	if db.raft == nil {
+		return fmt.Errorf("%w: not in a raft cluster", ErrInvalidOperation)
+	}
+	return db.raftPropose(&communication.LogRecord{Op: communication.Operation_REMOVE_MEMBER, Key: []byte(id)})
+}
+
+/* The raft cluster's current membership, addresses by ID, nil if we aren't in one */
+func (db *DB) Members() map[string]string {
+	if db.raft == nil {
+		return nil
+	}
+	return db.raft.membership()
+}
+
+/* Propose a write to the raft cluster and wait for it to be applied here */
+func (db *DB) raftPropose(record *communication.LogRecord) error {
+	timeout := db.replicationTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := db.raft.propose(ctx, record)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: not committed within %s", ErrQuorumNotReached, timeout)
+	}
+	return err
+}
+
+func (db *DB) stopRaft() error {
+	if db.raft == nil {
+		return nil
+	}
+	err := db.raft.stop()
+	db.raftTransport.close()
+	return err
+}
+
+/* raftStateMachine */
+func (db *DB) applyCommitted(record *communication.LogRecord) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if record.Seq <= db.seq {
+		return nil
+	}
+	/* Checked here rather than when proposing, as a concurrent DELETE may get to the key first */
+	var missing error
+	if record.Op == communication.Operation_DELETE {
+		_, missing = db.get(record.Key)
+	}
+	err := db.commit(record)
+	if err != nil {
+		return err
+	}
+	return missing
+}
+
+/* raftStateMachine */
+func (db *DB) snapshotRecords() ([]*communication.LogRecord, uint64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	records := make([]*communication.LogRecord, 0, len(db.Entries)+1)
+	if floor := versionFloorRecord(db.versionFloor, db.seq); floor != nil {
+		records = append(records, floor)
+	}
+	for _, entry := range db.Entries {
+		records = append(records, entryRecord(entry))
+	}
+	return records, db.seq
+}
@@ -0,0 +1,717 @@
+package distdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	In-process harness: every node runs in this process and messages are handed straight to the receiving node,
+	unless either end is killed or the link between them is cut.
+*/
+
+var errUnreachable = errors.New("unreachable")
+
+const (
+	TEST_ELECTION_TIMEOUT   = 150 * time.Millisecond
+	TEST_HEARTBEAT_INTERVAL = 20 * time.Millisecond
+)
+
+/* Map of keys to values, standing in for the DB */
+type testStateMachine struct {
+	mu        *sync.Mutex
+	data      map[string]string
+	applied   uint64
+	snapshots int /* Snapshots installed */
+}
+
+func newTestStateMachine() *testStateMachine {
+	return &testStateMachine{mu: &sync.Mutex{}, data: map[string]string{}}
+}
+
+func (sm *testStateMachine) applyCommitted(record *communication.LogRecord) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if record.Seq <= sm.applied {
+		return nil
+	}
+	if record.Seq != sm.applied+1 {
+		return fmt.Errorf("applied %d after %d", record.Seq, sm.applied)
+	}
+
+	switch record.Op {
+	case communication.Operation_PUT:
+		sm.data[string(record.Key)] = string(record.Val)
+	case communication.Operation_DELETE:
+		delete(sm.data, string(record.Key))
+	}
+	sm.applied = record.Seq
+	return nil
+}
+
+func (sm *testStateMachine) snapshotRecords() ([]*communication.LogRecord, uint64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	var records []*communication.LogRecord
+	for k, v := range sm.data {
+		records = append(records, &communication.LogRecord{Op: communication.Operation_PUT, Key: []byte(k), Val: []byte(v)})
+	}
+	return records, sm.applied
+}
+
+func (sm *testStateMachine) installSnapshot(records []*communication.LogRecord, index uint64) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if index <= sm.applied {
+		return nil
+	}
+	sm.data = map[string]string{}
+	for _, record := range records {
+		sm.data[string(record.Key)] = string(record.Val)
+	}
+	sm.applied = index
+	sm.snapshots++
+	return nil
+}
+
+func (sm *testStateMachine) snapshot() (map[string]string, uint64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	data := map[string]string{}
+	for k, v := range sm.data {
+		data[k] = v
+	}
+	return data, sm.applied
+}
+
+type testCluster struct {
+	t        *testing.T
+	ids      []string
+	founders map[string]string /* Initial membership, nodes added later start out with none */
+	logSize  int
+	maxSize  int /* Largest message the transport carries, 0 for no limit */
+	mu       *sync.Mutex
+	nodes    map[string]*raftNode
+	storages map[string]*memRaftStorage /* Survive kills, standing in for disks */
+	sms      map[string]*testStateMachine
+	down     map[string]bool
+	cut      map[[2]string]bool
+}
+
+type testTransport struct {
+	cluster *testCluster
+	from    string
+}
+
+func (tr *testTransport) send(ctx context.Context, peer string, msg *communication.RaftMessage) (*communication.RaftMessage, error) {
+	c := tr.cluster
+	c.mu.Lock()
+	node, ok := c.nodes[peer]
+	unreachable := !ok || c.down[tr.from] || c.down[peer] || c.cut[[2]string{tr.from, peer}]
+	c.mu.Unlock()
+	if unreachable {
+		return nil, errUnreachable
+	}
+
+	if c.maxSize > 0 && proto.Size(msg) > c.maxSize {
+		return nil, framing.ErrMessageTooLarge
+	}
+
+	/* Nodes mustn't share records, same as over the network */
+	resp, err := node.handle(proto.Clone(msg).(*communication.RaftMessage))
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(resp).(*communication.RaftMessage), ctx.Err()
+}
+
+func (tr *testTransport) setMembers(members map[string]string) {}
+
+func newTestCluster(t *testing.T, size, logSize int) *testCluster {
+	return newLimitedTestCluster(t, size, logSize, 0)
+}
+
+/* A cluster whose transport refuses messages larger than maxSize, like the network does */
+func newLimitedTestCluster(t *testing.T, size, logSize, maxSize int) *testCluster {
+	c := &testCluster{t: t, founders: map[string]string{}, logSize: logSize, maxSize: maxSize, mu: &sync.Mutex{}, nodes: map[string]*raftNode{}, storages: map[string]*memRaftStorage{},
+		sms: map[string]*testStateMachine{}, down: map[string]bool{}, cut: map[[2]string]bool{}}
+	for i := 0; i < size; i++ {
+		c.founders[fmt.Sprintf("n%d", i)] = ""
+	}
+	for i := 0; i < size; i++ {
+		c.add(fmt.Sprintf("n%d", i))
+	}
+	t.Cleanup(func() {
+		c.mu.Lock()
+		nodes := c.nodes
+		c.mu.Unlock()
+		for _, node := range nodes {
+			node.stop()
+		}
+	})
+	return c
+}
+
+/* Start a brand new node id */
+func (c *testCluster) add(id string) {
+	c.mu.Lock()
+	c.ids = append(c.ids, id)
+	c.storages[id] = newMemRaftStorage()
+	c.sms[id] = newTestStateMachine()
+	c.mu.Unlock()
+	c.start(id)
+}
+
+/* Start (or restart) id from its storage and state machine */
+func (c *testCluster) start(id string) {
+	members := map[string]string{}
+	if _, ok := c.founders[id]; ok {
+		members = c.founders
+	}
+	_, applied := c.sms[id].snapshot()
+	config := raftConfig{id: id, members: members, electionTimeout: TEST_ELECTION_TIMEOUT, heartbeatInterval: TEST_HEARTBEAT_INTERVAL, logSize: c.logSize, maxMessageSize: c.maxSize}
+	node, err := newRaftNode(config, &testTransport{cluster: c, from: id}, c.storages[id], c.sms[id], applied)
+	require.NoError(c.t, err)
+
+	c.mu.Lock()
+	c.nodes[id] = node
+	c.down[id] = false
+	c.mu.Unlock()
+	node.start()
+}
+
+func (c *testCluster) kill(id string) {
+	c.mu.Lock()
+	c.down[id] = true
+	node := c.nodes[id]
+	c.mu.Unlock()
+	require.NoError(c.t, node.stop())
+}
+
+/* Cut every link between group and the rest of the cluster */
+func (c *testCluster) partition(group ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inGroup := map[string]bool{}
+	for _, id := range group {
+		inGroup[id] = true
+	}
+	for _, a := range c.ids {
+		for _, b := range c.ids {
+			if inGroup[a] != inGroup[b] {
+				c.cut[[2]string{a, b}] = true
+			}
+		}
+	}
+}
+
+func (c *testCluster) heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cut = map[[2]string]bool{}
+}
+
+func (c *testCluster) node(id string) *raftNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[id]
+}
+
+/* Wait for exactly one leader among ids (every live node if none are given) and return it */
+func (c *testCluster) leader(ids ...string) string {
+	if len(ids) == 0 {
+		ids = c.ids
+	}
+	var leader string
+	require.Eventually(c.t, func() bool {
+		var leaders []string
+		for _, id := range ids {
+			c.mu.Lock()
+			down := c.down[id]
+			c.mu.Unlock()
+			if !down && c.node(id).isLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) != 1 {
+			return false
+		}
+		leader = leaders[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *testCluster) propose(id string, k, v string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.node(id).propose(ctx, &communication.LogRecord{Op: communication.Operation_PUT, Key: []byte(k), Val: []byte(v)})
+}
+
+func (c *testCluster) changeMembership(id string, op communication.Operation, member string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.node(id).propose(ctx, &communication.LogRecord{Op: op, Key: []byte(member)})
+}
+
+/* Wait until every one of ids has applied the same state as the leader */
+func (c *testCluster) requireConverged(leader string, ids ...string) {
+	require.Eventually(c.t, func() bool {
+		want, wantApplied := c.sms[leader].snapshot()
+		for _, id := range ids {
+			got, applied := c.sms[id].snapshot()
+			if applied != wantApplied || fmt.Sprint(got) != fmt.Sprint(want) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRaftElection(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	/* Everyone follows the leader in its term */
+	term := c.node(leader).currentTerm()
+	require.Eventually(t, func() bool {
+		for _, id := range c.ids {
+			if c.node(id).leaderID() != leader || c.node(id).currentTerm() != term {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	/* And it stays leader while nothing goes wrong */
+	time.Sleep(5 * TEST_ELECTION_TIMEOUT)
+	require.Equal(t, leader, c.leader())
+	require.Equal(t, term, c.node(leader).currentTerm())
+}
+
+func TestRaftReplication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, c.propose(leader, fmt.Sprintf("key%d", i%5), fmt.Sprintf("val%d", i)))
+	}
+	c.requireConverged(leader, c.ids...)
+	data, _ := c.sms[leader].snapshot()
+	require.Equal(t, map[string]string{"key0": "val15", "key1": "val16", "key2": "val17", "key3": "val18", "key4": "val19"}, data)
+
+	/* Followers refuse proposals */
+	for _, id := range c.ids {
+		if id != leader {
+			require.ErrorIs(t, c.propose(id, "k", "v"), ErrNotLeader)
+		}
+	}
+}
+
+func TestRaftFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	oldLeader := c.leader()
+	require.NoError(t, c.propose(oldLeader, "k1", "v1"))
+	oldTerm := c.node(oldLeader).currentTerm()
+
+	/* The survivors elect a new leader which has every committed write */
+	c.kill(oldLeader)
+	var survivors []string
+	for _, id := range c.ids {
+		if id != oldLeader {
+			survivors = append(survivors, id)
+		}
+	}
+	leader := c.leader(survivors...)
+	require.Greater(t, c.node(leader).currentTerm(), oldTerm)
+	require.NoError(t, c.propose(leader, "k2", "v2"))
+	c.requireConverged(leader, survivors...)
+	data, _ := c.sms[leader].snapshot()
+	require.Equal(t, map[string]string{"k1": "v1", "k2": "v2"}, data)
+
+	/* The old leader comes back as a follower and catches up */
+	c.start(oldLeader)
+	c.requireConverged(leader, c.ids...)
+	require.Equal(t, leader, c.leader())
+}
+
+/* A leader cut off in a minority can't commit, the majority carries on without it and wins once the partition heals */
+func TestRaftPartition(t *testing.T) {
+	c := newTestCluster(t, 5, 0)
+	oldLeader := c.leader()
+	require.NoError(t, c.propose(oldLeader, "k", "v1"))
+	c.requireConverged(oldLeader, c.ids...)
+
+	minority := []string{oldLeader}
+	var majority []string
+	for _, id := range c.ids {
+		if id == oldLeader {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.partition(minority...)
+
+	/* The old leader takes the write but can't commit it */
+	var wg sync.WaitGroup
+	var minorityErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		minorityErr = c.propose(oldLeader, "k", "lost")
+	}()
+
+	leader := c.leader(majority...)
+	require.NoError(t, c.propose(leader, "k", "v2"))
+	c.requireConverged(leader, majority...)
+	wg.Wait()
+	require.Error(t, minorityErr)
+
+	/* Once healed the old leader steps down and its uncommitted write is gone everywhere */
+	c.heal()
+	leader = c.leader()
+	require.NoError(t, c.propose(leader, "k2", "v"))
+	c.requireConverged(leader, c.ids...)
+	data, _ := c.sms[oldLeader].snapshot()
+	require.Equal(t, map[string]string{"k": "v2", "k2": "v"}, data)
+}
+
+/* A leader cut off from the majority steps down, and never confirms reads meanwhile */
+func TestRaftCheckQuorum(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	require.NoError(t, c.propose(leader, "k", "v1"))
+	readIndex := func(id string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return c.node(id).readIndex(ctx)
+	}
+	require.NoError(t, readIndex(leader))
+
+	c.partition(leader)
+	var rest []string
+	for _, id := range c.ids {
+		if id != leader {
+			rest = append(rest, id)
+		}
+	}
+	newLeader := c.leader(rest...)
+	require.NoError(t, c.propose(newLeader, "k", "v2"))
+
+	require.ErrorIs(t, readIndex(leader), ErrNotLeader)
+	require.Eventually(t, func() bool { return !c.node(leader).isLeader() }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, readIndex(newLeader))
+}
+
+/* A node that missed more entries than fit in one message gets them over several */
+func TestRaftAppendBytes(t *testing.T) {
+	c := newLimitedTestCluster(t, 3, 1000, 10000)
+	leader := c.leader()
+	var behind string
+	for _, id := range c.ids {
+		if id != leader {
+			behind = id
+			break
+		}
+	}
+
+	c.kill(behind)
+	val := strings.Repeat("v", 2000)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, c.propose(leader, fmt.Sprintf("key%d", i), val))
+	}
+
+	c.start(behind)
+	c.requireConverged(leader, c.ids...)
+}
+
+/* A node that falls behind the start of the leader's log is sent a snapshot */
+func TestRaftSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	leader := c.leader()
+	var behind string
+	for _, id := range c.ids {
+		if id != leader {
+			behind = id
+			break
+		}
+	}
+
+	c.kill(behind)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, c.propose(leader, fmt.Sprintf("key%d", i), "v"))
+	}
+	require.Eventually(t, func() bool {
+		n := c.node(leader)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.snapshotIndex > 0
+	}, time.Second, 10*time.Millisecond)
+
+	c.start(behind)
+	c.requireConverged(leader, c.ids...)
+	require.NoError(t, c.propose(c.leader(), "key50", "v"))
+	c.requireConverged(c.leader(), c.ids...)
+}
+
+/* A snapshot bigger than a single message goes out a page at a time */
+func TestRaftSnapshotPages(t *testing.T) {
+	c := newLimitedTestCluster(t, 3, 5, 10000)
+	leader := c.leader()
+	var behind string
+	for _, id := range c.ids {
+		if id != leader {
+			behind = id
+			break
+		}
+	}
+
+	c.kill(behind)
+	val := strings.Repeat("v", 2000)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, c.propose(leader, fmt.Sprintf("key%d", i), val))
+	}
+	require.Eventually(t, func() bool {
+		n := c.node(leader)
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.snapshotIndex > 0
+	}, time.Second, 10*time.Millisecond)
+
+	c.start(behind)
+	c.requireConverged(leader, c.ids...)
+	c.sms[behind].mu.Lock()
+	require.NotZero(t, c.sms[behind].snapshots)
+	c.sms[behind].mu.Unlock()
+}
+
+func TestRaftMembership(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	leader := c.leader()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, c.propose(leader, fmt.Sprintf("key%d", i), "v"))
+	}
+
+	/* A new node is brought up to date with a snapshot */
+	c.add("n3")
+	require.NoError(t, c.changeMembership(leader, communication.Operation_ADD_MEMBER, "n3"))
+	require.NoError(t, c.propose(leader, "key20", "v"))
+	c.requireConverged(leader, "n0", "n1", "n2", "n3")
+	require.Equal(t, 1, c.sms["n3"].snapshots)
+	require.Eventually(t, func() bool { return len(c.node("n3").membership()) == 4 }, time.Second, 10*time.Millisecond)
+
+	/* With a follower removed, the other three are a cluster of their own: two of them are a majority */
+	var removed, down string
+	for _, id := range []string{"n0", "n1", "n2"} {
+		if id == leader {
+			continue
+		}
+		if removed == "" {
+			removed = id
+		} else {
+			down = id
+		}
+	}
+	require.NoError(t, c.changeMembership(leader, communication.Operation_REMOVE_MEMBER, removed))
+	c.kill(removed)
+	c.kill(down)
+	require.NoError(t, c.propose(leader, "key21", "v"))
+	c.requireConverged(leader, "n3")
+
+	/* The membership survives a restart */
+	c.start(down)
+	c.requireConverged(leader, down, "n3")
+	c.kill(down)
+	c.start(down)
+	require.Len(t, c.node(down).membership(), 3)
+	require.NotContains(t, c.node(down).membership(), removed)
+	c.requireConverged(leader, down, "n3")
+
+	/* The leader removes itself, steps down and the other two take over */
+	require.NoError(t, c.changeMembership(leader, communication.Operation_REMOVE_MEMBER, leader))
+	newLeader := c.leader(down, "n3")
+	require.NotEqual(t, leader, newLeader)
+	require.NoError(t, c.propose(newLeader, "key22", "v"))
+	c.requireConverged(newLeader, down, "n3")
+	require.False(t, c.node(leader).isLeader())
+}
+
+func TestRaftMembershipChangeRejected(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.leader()
+	require.NoError(t, c.propose(leader, "k", "v"))
+
+	require.ErrorIs(t, c.changeMembership(leader, communication.Operation_REMOVE_MEMBER, "n9"), ErrUnknownMember)
+	err := c.node(leader).propose(contextWithTimeout(t, time.Second), &communication.LogRecord{Op: communication.Operation_ADD_MEMBER, Key: []byte("n1"), Val: []byte("elsewhere:1")})
+	require.ErrorIs(t, err, ErrMemberExists)
+
+	/* A change that can't commit blocks the next one */
+	c.partition(leader)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = c.node(leader).propose(ctx, &communication.LogRecord{Op: communication.Operation_ADD_MEMBER, Key: []byte("n3")})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, c.changeMembership(leader, communication.Operation_REMOVE_MEMBER, "n1"), ErrMembershipChangePending)
+}
+
+/* Three DBs talking raft over the network: clients are redirected to the leader, and a new one takes over when it dies */
+func TestRaftCluster(t *testing.T) {
+	peers := map[string]distdbclient.ClientConfig{}
+	for i, port := range []string{"3127", "3128", "3129"} {
+		peers[fmt.Sprintf("n%d", i)] = distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port}
+	}
+	dbs := map[string]*DB{}
+	for id, peerConfig := range peers {
+		dbs[id] = startDB(t, DBConfig{Persist: true, DiskFileName: t.TempDir() + "/dbdump", ServerProtocol: peerConfig.ServerProtocol, ServerHost: peerConfig.ServerHost, ServerPort: peerConfig.ServerPort,
+			RaftID: id, RaftPeers: peers, ElectionTimeout: TEST_ELECTION_TIMEOUT, HeartbeatInterval: TEST_HEARTBEAT_INTERVAL, ReplicationToken: "secret"})
+	}
+
+	leaderID := func(ids ...string) string {
+		var leader string
+		require.Eventually(t, func() bool {
+			var leaders []string
+			for _, id := range ids {
+				if dbs[id].IsLeader() {
+					leaders = append(leaders, id)
+				}
+			}
+			if len(leaders) != 1 {
+				return false
+			}
+			leader = leaders[0]
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		return leader
+	}
+	leader := leaderID("n0", "n1", "n2")
+
+	/* Followers point clients at the leader */
+	for id, db := range dbs {
+		if id == leader {
+			continue
+		}
+		config := peers[id]
+		config.MaxRedirects = -1
+		client, err := distdbclient.NewClient(config)
+		require.NoError(t, err)
+		err = client.Put([]byte("k"), []byte("v"))
+		client.Close()
+		var notLeader *distdbclient.NotLeaderError
+		require.ErrorAs(t, err, &notLeader)
+		require.Eventually(t, func() bool { return db.raft.leaderID() == leader }, time.Second, 10*time.Millisecond)
+	}
+
+	/* A client that knows the whole cluster finds the leader and follows it around */
+	var seeds []string
+	for _, id := range []string{"n0", "n1", "n2"} {
+		seeds = append(seeds, peers[id].ServerHost+":"+peers[id].ServerPort)
+	}
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds})
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Put([]byte("k1"), []byte("v1")))
+	require.Equal(t, peers[leader].ServerHost+":"+peers[leader].ServerPort, client.Leader())
+	var batch distdbclient.Batch
+	batch.Put([]byte("b1"), []byte("v"))
+	batch.Put([]byte("b2"), []byte("v"))
+	require.NoError(t, client.WriteBatch(context.Background(), &batch))
+	version, err := client.PutIfAbsent(context.Background(), []byte("c1"), []byte("v"))
+	require.NoError(t, err)
+	_, err = client.PutIfAbsent(context.Background(), []byte("c1"), []byte("again"))
+	require.ErrorIs(t, err, distdbclient.ErrConditionFailed)
+	_, err = client.PutIfVersion(context.Background(), []byte("c1"), []byte("v2"), version)
+	require.NoError(t, err)
+	v, err := client.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), v)
+
+	/* Of two DELETEs racing for the same key, only one finds it */
+	require.NoError(t, client.Put([]byte("d1"), []byte("v")))
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- client.Delete([]byte("d1")) }()
+	}
+	err1, err2 := <-errs, <-errs
+	if err1 != nil {
+		err1, err2 = err2, err1
+	}
+	require.NoError(t, err1)
+	require.ErrorContains(t, err2, ErrKeyDoesNotExist.Error())
+
+	/* Kill the leader, the other two carry on */
+	require.NoError(t, dbs[leader].Shutdown(contextWithTimeout(t, time.Second)))
+	var survivors []string
+	for id := range dbs {
+		if id != leader {
+			survivors = append(survivors, id)
+		}
+	}
+	newLeader := leaderID(survivors...)
+	require.NoError(t, client.PutContext(contextWithTimeout(t, 5*time.Second), []byte("k2"), []byte("v2")))
+	require.Equal(t, peers[newLeader].ServerHost+":"+peers[newLeader].ServerPort, client.Leader())
+
+	for _, id := range survivors {
+		require.Eventually(t, func() bool {
+			v1, err1 := dbs[id].Get([]byte("k1"))
+			v2, err2 := dbs[id].Get([]byte("k2"))
+			_, err3 := dbs[id].Get([]byte("b2"))
+			v4, _, err4 := dbs[id].GetWithVersion([]byte("c1"))
+			return err1 == nil && err2 == nil && err3 == nil && err4 == nil && string(v1) == "v1" && string(v2) == "v2" && string(v4) == "v2"
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+/* A node joins a running cluster through an admin request, and the cluster remembers it across restarts */
+func TestRaftClusterJoin(t *testing.T) {
+	dir := t.TempDir()
+	n0Config := DBConfig{Persist: true, DiskFileName: dir + "/n0", ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3130",
+		RaftID: "n0", RaftPeers: map[string]distdbclient.ClientConfig{"n0": {ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3130"}},
+		ElectionTimeout: TEST_ELECTION_TIMEOUT, HeartbeatInterval: TEST_HEARTBEAT_INTERVAL, ReplicationToken: "secret"}
+	n0 := startDB(t, n0Config)
+	require.Eventually(t, n0.IsLeader, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, n0.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+	}
+
+	n1 := startDB(t, DBConfig{Persist: true, DiskFileName: dir + "/n1", ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3131",
+		RaftID: "n1", RaftJoin: true, ElectionTimeout: TEST_ELECTION_TIMEOUT, HeartbeatInterval: TEST_HEARTBEAT_INTERVAL, ReplicationToken: "secret"})
+	require.Empty(t, n1.Members())
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3130"})
+	require.NoError(t, err)
+	defer client.Close()
+	ctx := contextWithTimeout(t, 5*time.Second)
+	requireErrorContains(t, client.AddMember(ctx, "n1", "localhost:3131", "wrong"), ErrUnauthorized)
+	require.NoError(t, client.AddMember(ctx, "n1", "localhost:3131", "secret"))
+	requireCaughtUp(t, n1, n0, 10)
+	require.Equal(t, map[string]string{"n0": "localhost:3130", "n1": "localhost:3131"}, n0.Members())
+
+	/* RaftPeers only has n0, the log has both */
+	require.NoError(t, n0.Shutdown(contextWithTimeout(t, time.Second)))
+	n0 = startDB(t, n0Config)
+	require.Equal(t, map[string]string{"n0": "localhost:3130", "n1": "localhost:3131"}, n0.Members())
+
+	/* And needs both for a majority */
+	require.Eventually(t, func() bool { return n0.IsLeader() || n1.IsLeader() }, 5*time.Second, 10*time.Millisecond)
+	leader := n0
+	if n1.IsLeader() {
+		leader = n1
+	}
+	require.NoError(t, leader.Put([]byte("key10"), []byte("v")))
+	requireCaughtUp(t, n0, n1, 11)
+}
@@ -0,0 +1,381 @@
+package distdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Raft's persistent state: the current term and vote, and the log. Both must be durable before the node answers
+	the RPC that changed them.
+
+	On disk the term and vote live in DiskFileName+RAFT_STATE_FILE_SUFFIX, a single framed record
+	| term (8 bytes, big endian) | voted for |, replaced atomically on every change. The log lives in
+	DiskFileName+RAFT_LOG_FILE_SUFFIX:
+
+	| magic (6 bytes) | version (1 byte) | snapshot index (8 bytes) | snapshot term (8 bytes) | membership | record | ...
+
+	with the membership as of the snapshot index as a framed RaftMembership and one framed LogRecord per entry
+	after the snapshot index. Unlike the write-ahead log entries can be taken
+	back (truncated) as long as they aren't committed, and the head is dropped by rewriting the file once the
+	entries have been applied.
+*/
+
+const (
+	RAFT_STATE_FILE_SUFFIX = ".raftstate"
+	RAFT_LOG_FILE_SUFFIX   = ".raftlog"
+	RAFT_LOG_MAGIC         = "DKVRFT"
+	RAFT_LOG_VERSION       = 1
+
+	raftLogHeaderLen = len(RAFT_LOG_MAGIC) + 1 + 16
+)
+
+var ErrInvalidRaftLog = errors.New("invalid raft log")
+
+type raftStorage interface {
+	load() (*raftState, error)
+	saveState(term uint64, votedFor string) error
+	/* Append entries, which follow on from the last entry */
+	append(entries []*communication.LogRecord) error
+	/* Drop the entry at index and everything after it */
+	truncate(index uint64) error
+	/* Replace the log with entries, which follow on from snapshotIndex, members being the membership as of snapshotIndex */
+	compact(snapshotIndex, snapshotTerm uint64, members map[string]string, entries []*communication.LogRecord) error
+	close() error
+}
+
+type raftState struct {
+	term          uint64
+	votedFor      string
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	members       map[string]string /* Membership as of snapshotIndex by ID, nil if none was ever recorded */
+	entries       []*communication.LogRecord
+}
+
+/* Keeps raft's state in memory, for DBs that don't persist (and tests, where it stands in for a disk across restarts) */
+type memRaftStorage struct {
+	state raftState
+}
+
+func newMemRaftStorage() *memRaftStorage {
+	return &memRaftStorage{}
+}
+
+func (s *memRaftStorage) load() (*raftState, error) {
+	state := s.state
+	state.members = copyMembers(s.state.members)
+	state.entries = append([]*communication.LogRecord(nil), s.state.entries...)
+	return &state, nil
+}
+
+func (s *memRaftStorage) saveState(term uint64, votedFor string) error {
+	s.state.term, s.state.votedFor = term, votedFor
+	return nil
+}
+
+func (s *memRaftStorage) append(entries []*communication.LogRecord) error {
+	s.state.entries = append(s.state.entries, entries...)
+	return nil
+}
+
+func (s *memRaftStorage) truncate(index uint64) error {
+	s.state.entries = s.state.entries[:index-s.state.snapshotIndex-1]
+	return nil
+}
+
+func (s *memRaftStorage) compact(snapshotIndex, snapshotTerm uint64, members map[string]string, entries []*communication.LogRecord) error {
+	s.state.snapshotIndex, s.state.snapshotTerm, s.state.members = snapshotIndex, snapshotTerm, copyMembers(members)
+	s.state.entries = append([]*communication.LogRecord(nil), entries...)
+	return nil
+}
+
+func (s *memRaftStorage) close() error {
+	return nil
+}
+
+type diskRaftStorage struct {
+	stateFileName string
+	logFileName   string
+	f             *os.File
+	snapshotIndex uint64
+	offsets       []int64 /* Offset of every entry in the log file */
+	size          int64
+}
+
+func openDiskRaftStorage(fileName string) *diskRaftStorage {
+	return &diskRaftStorage{stateFileName: fileName + RAFT_STATE_FILE_SUFFIX, logFileName: fileName + RAFT_LOG_FILE_SUFFIX}
+}
+
+/* Read the state and log back, a torn tail on the log is truncated the same way as the write-ahead log's */
+func (s *diskRaftStorage) load() (*raftState, error) {
+	state := &raftState{}
+	err := s.loadState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(s.logFileName, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return state, s.compact(0, 0, nil, nil)
+	}
+
+	reader := &countingReader{r: bufio.NewReader(f)}
+	header := make([]byte, raftLogHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%w: %s: short header", ErrInvalidRaftLog, s.logFileName)
+	}
+	version := header[len(RAFT_LOG_MAGIC)]
+	if !bytes.Equal(header[:len(RAFT_LOG_MAGIC)], []byte(RAFT_LOG_MAGIC)) || version != RAFT_LOG_VERSION {
+		return nil, fmt.Errorf("%w: %s: bad magic or version", ErrInvalidRaftLog, s.logFileName)
+	}
+	state.snapshotIndex = binary.BigEndian.Uint64(header[len(RAFT_LOG_MAGIC)+1:])
+	state.snapshotTerm = binary.BigEndian.Uint64(header[len(RAFT_LOG_MAGIC)+9:])
+	s.snapshotIndex = state.snapshotIndex
+
+	payload, err := readRecord(reader, info.Size()-reader.n)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: bad membership: %v", ErrInvalidRaftLog, s.logFileName, err)
+	}
+	var membership communication.RaftMembership
+	if err := proto.Unmarshal(payload, &membership); err != nil {
+		return nil, fmt.Errorf("%w: %s: bad membership: %v", ErrInvalidRaftLog, s.logFileName, err)
+	}
+	state.members = decodeMembers(membership.Members)
+
+	offset := reader.n
+	for {
+		payload, err := readRecord(reader, info.Size()-offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if tornTail(err, reader.n, info.Size()) {
+				fmt.Printf("\nTruncating torn raft log tail at offset %d: %v", offset, err)
+				break
+			}
+			return nil, fmt.Errorf("%w: %s at offset %d: %v", ErrInvalidRaftLog, s.logFileName, offset, err)
+		}
+
+		record, err := decodeLogRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		state.entries = append(state.entries, record)
+		s.offsets = append(s.offsets, offset)
+		offset = reader.n
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	s.size = offset
+
+	return state, nil
+}
+
+func (s *diskRaftStorage) loadState(state *raftState) error {
+	f, err := os.Open(s.stateFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	payload, err := readRecord(f, info.Size())
+	if err != nil || len(payload) < 8 {
+		return fmt.Errorf("%w: %s: bad state", ErrInvalidRaftLog, s.stateFileName)
+	}
+	state.term = binary.BigEndian.Uint64(payload)
+	state.votedFor = string(payload[8:])
+	return nil
+}
+
+func (s *diskRaftStorage) saveState(term uint64, votedFor string) error {
+	payload := binary.BigEndian.AppendUint64(nil, term)
+	payload = append(payload, votedFor...)
+	return writeFileAtomic(s.stateFileName, frameRecord(payload))
+}
+
+func (s *diskRaftStorage) append(entries []*communication.LogRecord) error {
+	var buf []byte
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		payload, err := encodeLogRecord(entry)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, s.size+int64(len(buf)))
+		buf = append(buf, frameRecord(payload)...)
+	}
+
+	n, err := s.f.Write(buf)
+	if err != nil {
+		/* Don't leave a partial record behind for the next append to follow */
+		s.f.Truncate(s.size)
+		s.f.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(n)
+	s.offsets = append(s.offsets, offsets...)
+
+	return nil
+}
+
+func (s *diskRaftStorage) truncate(index uint64) error {
+	i := index - s.snapshotIndex - 1
+	offset := s.offsets[i]
+	if err := s.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.size = offset
+	s.offsets = s.offsets[:i]
+
+	return nil
+}
+
+/* Write the new log next to the old one and rename it into place, so that a crash leaves one or the other */
+func (s *diskRaftStorage) compact(snapshotIndex, snapshotTerm uint64, members map[string]string, entries []*communication.LogRecord) error {
+	header := append([]byte(RAFT_LOG_MAGIC), RAFT_LOG_VERSION)
+	header = binary.BigEndian.AppendUint64(header, snapshotIndex)
+	header = binary.BigEndian.AppendUint64(header, snapshotTerm)
+	membership, err := proto.Marshal(&communication.RaftMembership{Members: encodeMembers(members)})
+	if err != nil {
+		return err
+	}
+
+	buf := append(header, frameRecord(membership)...)
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		payload, err := encodeLogRecord(entry)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, int64(len(buf)))
+		buf = append(buf, frameRecord(payload)...)
+	}
+
+	if err := writeFileAtomic(s.logFileName, buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.logFileName, os.O_RDWR, 0777)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.snapshotIndex, s.offsets, s.size = f, snapshotIndex, offsets, int64(len(buf))
+
+	return nil
+}
+
+func (s *diskRaftStorage) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func encodeMembers(members map[string]string) []*communication.RaftMember {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	encoded := make([]*communication.RaftMember, 0, len(ids))
+	for _, id := range ids {
+		encoded = append(encoded, &communication.RaftMember{Id: id, Addr: members[id]})
+	}
+	return encoded
+}
+
+/* Never nil, an empty membership was still recorded */
+func decodeMembers(encoded []*communication.RaftMember) map[string]string {
+	members := make(map[string]string, len(encoded))
+	for _, member := range encoded {
+		members[member.Id] = member.Addr
+	}
+	return members
+}
+
+func copyMembers(members map[string]string) map[string]string {
+	if members == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(members))
+	for id, addr := range members {
+		copied[id] = addr
+	}
+	return copied
+}
+
+/* Write data to fileName through a temporary file and a rename, fsyncing both the file and the directory */
+func writeFileAtomic(fileName string, data []byte) error {
+	tmpName := fileName + SNAPSHOT_TMP_SUFFIX
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fileName))
+}
@@ -0,0 +1,97 @@
+package distdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+func raftEntries(from, to, term uint64) []*communication.LogRecord {
+	var entries []*communication.LogRecord
+	for seq := from; seq <= to; seq++ {
+		entries = append(entries, &communication.LogRecord{Version: LOG_RECORD_VERSION, Op: communication.Operation_PUT,
+			Key: []byte(fmt.Sprintf("key%d", seq)), Val: []byte("val"), Seq: seq, Term: term})
+	}
+	return entries
+}
+
+func requireRaftState(t *testing.T, fileName string, want raftState) {
+	storage := openDiskRaftStorage(fileName)
+	defer storage.close()
+	got, err := storage.load()
+	require.NoError(t, err)
+
+	require.Equal(t, want.term, got.term)
+	require.Equal(t, want.votedFor, got.votedFor)
+	require.Equal(t, want.snapshotIndex, got.snapshotIndex)
+	require.Equal(t, want.snapshotTerm, got.snapshotTerm)
+	require.Equal(t, want.members, got.members)
+	require.Len(t, got.entries, len(want.entries))
+	for i := range want.entries {
+		require.Equal(t, want.entries[i].Seq, got.entries[i].Seq)
+		require.Equal(t, want.entries[i].Term, got.entries[i].Term)
+		require.Equal(t, want.entries[i].Key, got.entries[i].Key)
+	}
+}
+
+func TestDiskRaftStorage(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+
+	/* Fresh */
+	storage := openDiskRaftStorage(fileName)
+	state, err := storage.load()
+	require.NoError(t, err)
+	require.Equal(t, raftState{}, *state)
+
+	require.NoError(t, storage.saveState(3, "n1"))
+	require.NoError(t, storage.append(raftEntries(1, 5, 1)))
+	require.NoError(t, storage.append(raftEntries(6, 8, 2)))
+	require.NoError(t, storage.close())
+	requireRaftState(t, fileName, raftState{term: 3, votedFor: "n1", members: map[string]string{}, entries: append(raftEntries(1, 5, 1), raftEntries(6, 8, 2)...)})
+
+	/* Conflicting suffix replaced */
+	storage = openDiskRaftStorage(fileName)
+	_, err = storage.load()
+	require.NoError(t, err)
+	require.NoError(t, storage.truncate(6))
+	require.NoError(t, storage.append(raftEntries(6, 7, 3)))
+	require.NoError(t, storage.saveState(4, ""))
+	require.NoError(t, storage.close())
+	requireRaftState(t, fileName, raftState{term: 4, members: map[string]string{}, entries: append(raftEntries(1, 5, 1), raftEntries(6, 7, 3)...)})
+
+	/* Head dropped, and the log keeps going after that */
+	storage = openDiskRaftStorage(fileName)
+	_, err = storage.load()
+	require.NoError(t, err)
+	require.NoError(t, storage.compact(5, 1, map[string]string{"n1": "localhost:1", "n2": "localhost:2"}, raftEntries(6, 7, 3)))
+	require.NoError(t, storage.append(raftEntries(8, 9, 4)))
+	require.NoError(t, storage.truncate(9))
+	require.NoError(t, storage.close())
+	requireRaftState(t, fileName, raftState{term: 4, snapshotIndex: 5, snapshotTerm: 1, members: map[string]string{"n1": "localhost:1", "n2": "localhost:2"}, entries: append(raftEntries(6, 7, 3), raftEntries(8, 8, 4)...)})
+}
+
+/* A record torn by a crash mid-append is dropped, and the log can be appended to again */
+func TestDiskRaftStorageTornTail(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+	storage := openDiskRaftStorage(fileName)
+	_, err := storage.load()
+	require.NoError(t, err)
+	require.NoError(t, storage.append(raftEntries(1, 3, 1)))
+	require.NoError(t, storage.close())
+
+	info, err := os.Stat(fileName + RAFT_LOG_FILE_SUFFIX)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(fileName+RAFT_LOG_FILE_SUFFIX, info.Size()-2))
+
+	storage = openDiskRaftStorage(fileName)
+	state, err := storage.load()
+	require.NoError(t, err)
+	require.Len(t, state.entries, 2)
+	require.NoError(t, storage.append(raftEntries(3, 4, 2)))
+	require.NoError(t, storage.close())
+	requireRaftState(t, fileName, raftState{members: map[string]string{}, entries: append(raftEntries(1, 2, 1), raftEntries(3, 4, 2)...)})
+}
@@ -0,0 +1,246 @@
+package distdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/* Replication modes for the DB */
+const (
+	REPLICATION_ASYNC    = iota /* Acknowledge writes right away and replicate in the background */
+	REPLICATION_SYNC_ALL        /* Acknowledge writes once every replica has them */
+	REPLICATION_QUORUM          /* Acknowledge writes once a majority of the cluster (leader included) has them */
+)
+
+const (
+	DEFAULT_REPLICATION_TIMEOUT = 5 * time.Second
+	REPLICATION_QUEUE_SIZE      = 1024        /* Writes queued per replica, a replica whose queue is full misses writes until it drains */
+	REPLICA_RETRY_INTERVAL      = time.Second /* How long writes skip an unreachable replica before it is tried again */
+)
+
+var ErrQuorumNotReached = errors.New("write not acknowledged by enough replicas")
+var ErrReplicaUnavailable = errors.New("replica unavailable")
+var ErrReplicationQueueFull = errors.New("replication queue full")
+
+type ReplicaWorker struct {
+	receiver chan *replicatedWrite
+	config   distdbclient.ClientConfig
+	done     chan struct{}
+	applied  uint64 /* Last sequence number the replica reported, accessed atomically */
+}
+
+/* A write on its way to the replicas, for synchronous modes every worker reports its outcome on acks */
+type replicatedWrite struct {
+	record *communication.LogRecord
+	acks   chan error
+}
+
+func (w *ReplicaWorker) String() string {
+	return fmt.Sprintf("Worker: \n Protocol: %s; Host: %s; Port: %s", w.config.ServerProtocol, w.config.ServerHost, w.config.ServerPort)
+}
+
+func initReplicas(db *DB) error {
+
+	/* Initialize a worker + goroutine + client for each worker - to replicate the broadcast k-v */
+	for _, replicaConfig := range db.config.ReplicaConfigs {
+		/* A replica that is down now catches up once it is back, it mustn't keep us from starting */
+		replicaConfig.LazyConnect = true
+		worker := ReplicaWorker{receiver: make(chan *replicatedWrite, REPLICATION_QUEUE_SIZE), config: replicaConfig, done: make(chan struct{})}
+		db.replicaWorkers = append(db.replicaWorkers, &worker)
+		client, err := distdbclient.NewClient(replicaConfig)
+		if err != nil {
+			return err
+		}
+
+		go replicate(&worker, client, db.config.ReplicationToken, db.replicationTimeout())
+	}
+
+	/* Initialize and start broadcast channel */
+	db.broadcaster = make(chan *replicatedWrite, REPLICATION_QUEUE_SIZE)
+	db.replicating = true
+	go broadcast(db)
+
+	return nil
+}
+
+/*
+	Fan out every write to the replica workers, once the broadcaster is closed the workers are told to finish up too.
+	A worker that is too far behind to take the write misses it, it's up to the replica to fetch it.
+*/
+func broadcast(db *DB) {
+	for write := range db.broadcaster {
+		for _, worker := range db.replicaWorkers {
+			select {
+			case worker.receiver <- write:
+			default:
+				fmt.Printf("\nReplication queue of %s full, dropping Seq: %d", worker, write.record.Seq)
+				write.ack(ErrReplicationQueueFull)
+			}
+		}
+	}
+
+	for _, worker := range db.replicaWorkers {
+		close(worker.receiver)
+	}
+}
+
+/*
+	Replicate every write the worker receives, one at a time and in order, done is closed once the receiver is closed and drained.
+	Writes are never retried: a replica that misses some (it was down, refused them or its queue was full) fetches them itself
+	once it notices, from the next write it gets or its next catch-up.
+	While a replica is unreachable writes fail straight away, it is only tried again every REPLICA_RETRY_INTERVAL.
+*/
+func replicate(worker *ReplicaWorker, client *distdbclient.Client, token string, timeout time.Duration) {
+	defer close(worker.done)
+	defer client.Close()
+
+	var retryAt time.Time
+	for write := range worker.receiver {
+		record := write.record
+		var err error
+		if time.Now().Before(retryAt) {
+			err = ErrReplicaUnavailable
+		} else {
+			err = replicateRecord(worker, client, record, token, timeout)
+			if errors.Is(err, ErrReplicaUnavailable) {
+				retryAt = time.Now().Add(REPLICA_RETRY_INTERVAL)
+			}
+			if err != nil {
+				fmt.Printf("\nError replicating Seq: %d; Op: %s; Key: %s; to %s (last applied %d): %v", record.Seq, record.Op, record.Key, worker, worker.AppliedSeq(), err)
+			}
+		}
+		write.ack(err)
+	}
+}
+
+/* Report a replica's outcome to whoever waits on the write, if anyone does */
+func (write *replicatedWrite) ack(err error) {
+	if write.acks != nil {
+		write.acks <- err
+	}
+}
+
+func replicateRecord(worker *ReplicaWorker, client *distdbclient.Client, record *communication.LogRecord, token string, timeout time.Duration) error {
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := client.DoContext(ctx, &communication.Request{Op: communication.Operation_REPLICATE, Record: data, Token: token})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReplicaUnavailable, err)
+	}
+	atomic.StoreUint64(&worker.applied, resp.Seq)
+	if resp.Status != communication.Status_SUCCESS {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+/* Sequence number of the last write the replica reported applying */
+func (w *ReplicaWorker) AppliedSeq() uint64 {
+	return atomic.LoadUint64(&w.applied)
+}
+
+/*
+	Queue a write that has been committed locally for the replicas, returns nil if there is nothing to wait for. Never
+	blocks: if the broadcaster is backed up every replica misses the write, and fetches it later.
+	Call this only with db.Mutex held, which is what keeps the queue in sequence order.
+*/
+func (db *DB) queueReplication(record *communication.LogRecord) *replicatedWrite {
+	if !db.replicating || len(db.replicaWorkers) == 0 {
+		return nil
+	}
+
+	write := &replicatedWrite{record: record}
+	if db.requiredAcks() > 0 {
+		write.acks = make(chan error, len(db.replicaWorkers))
+	}
+	select {
+	case db.broadcaster <- write:
+	default:
+		fmt.Printf("\nBroadcaster full, dropping Seq: %d", record.Seq)
+		for range db.replicaWorkers {
+			write.ack(ErrReplicationQueueFull)
+		}
+	}
+
+	if write.acks == nil {
+		return nil
+	}
+	return write
+}
+
+/*
+	Wait for as many acknowledgements of a queued write as ReplicationMode requires, failing with ErrQuorumNotReached if
+	they don't all arrive within ReplicationTimeout. The write stays applied here (and on any replica that got it) either way.
+*/
+func (db *DB) awaitReplication(write *replicatedWrite) error {
+	if write == nil {
+		return nil
+	}
+
+	required := db.requiredAcks()
+	timeout := db.replicationTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	acked, failed := 0, 0
+	for acked < required {
+		select {
+		case err := <-write.acks:
+			if err != nil {
+				failed++
+			} else {
+				acked++
+			}
+			/* Not enough replicas left to make it */
+			if len(db.replicaWorkers)-failed < required {
+				return fmt.Errorf("%w: %d/%d acks, %d replicas failed", ErrQuorumNotReached, acked, required, failed)
+			}
+		case <-timer.C:
+			return fmt.Errorf("%w: %d/%d acks within %s", ErrQuorumNotReached, acked, required, timeout)
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) replicationTimeout() time.Duration {
+	if db.config.ReplicationTimeout <= 0 {
+		return DEFAULT_REPLICATION_TIMEOUT
+	}
+	return db.config.ReplicationTimeout
+}
+
+/* Close the broadcaster, writes after this are no longer replicated. Call this only with db.Mutex held */
+func (db *DB) stopReplication() {
+	if !db.replicating {
+		return
+	}
+	db.replicating = false
+	close(db.broadcaster)
+}
+
+/* Replica acknowledgements a write needs before it is acknowledged to the client */
+func (db *DB) requiredAcks() int {
+	switch db.config.ReplicationMode {
+	case REPLICATION_SYNC_ALL:
+		return len(db.replicaWorkers)
+	case REPLICATION_QUORUM:
+		/* Majority of leader + replicas, the leader's own copy counts as one */
+		return (len(db.replicaWorkers) + 1) / 2
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,261 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+/* NewDB + listen */
+func startDB(t *testing.T, config DBConfig) *DB {
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	listen(t, db)
+	return db
+}
+
+func TestSyncReplication(t *testing.T) {
+	tcs := []struct {
+		mode           int
+		errWantAllUp   error
+		errWantOneDown error
+		visibleOn      int /* Followers guaranteed to have the write once Put returns */
+	}{
+		{mode: REPLICATION_ASYNC, errWantAllUp: nil, errWantOneDown: nil, visibleOn: 0},
+		{mode: REPLICATION_SYNC_ALL, errWantAllUp: nil, errWantOneDown: ErrQuorumNotReached, visibleOn: 2},
+		{mode: REPLICATION_QUORUM, errWantAllUp: nil, errWantOneDown: nil, visibleOn: 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(fmt.Sprintf("mode=%d", tc.mode), func(t *testing.T) {
+			/* Leader with two followers */
+			followerPorts := []string{"3115", "3116"}
+			var followers []*DB
+			var replicaConfigs []distdbclient.ClientConfig
+			for _, port := range followerPorts {
+				followers = append(followers, startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: FOLLOWER, ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: port}))
+				replicaConfigs = append(replicaConfigs, distdbclient.ClientConfig{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: port, ReconnectBaseDelay: time.Millisecond})
+			}
+			startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3117",
+				ReplicaConfigs: replicaConfigs, ReplicationMode: tc.mode, ReplicationTimeout: time.Second})
+
+			client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3117"})
+			require.NoError(t, err)
+			defer client.Close()
+
+			/* Every follower up */
+			err = client.Put([]byte("k1"), []byte("v1"))
+			requireErrorContains(t, err, tc.errWantAllUp)
+			visible := 0
+			for _, follower := range followers {
+				v, err := follower.Get([]byte("k1"))
+				if err == nil && string(v) == "v1" {
+					visible++
+				}
+			}
+			require.GreaterOrEqual(t, visible, tc.visibleOn)
+
+			/* One follower down */
+			require.NoError(t, followers[1].Shutdown(contextWithTimeout(t, time.Second)))
+			err = client.Put([]byte("k2"), []byte("v2"))
+			requireErrorContains(t, err, tc.errWantOneDown)
+			if tc.errWantOneDown == nil && tc.visibleOn > 0 {
+				v, err := followers[0].Get([]byte("k2"))
+				require.NoError(t, err)
+				require.Equal(t, []byte("v2"), v)
+			}
+		})
+	}
+}
+
+/* A follower that never answers should fail the write once ReplicationTimeout passes */
+func TestReplicationTimeout(t *testing.T) {
+	blackHole, err := net.Listen(DEFAULT_REPLICA_PROTOCOL, DEFAULT_REPLICA_HOST+":3118")
+	require.NoError(t, err)
+	defer blackHole.Close()
+	go func() {
+		for {
+			conn, err := blackHole.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	startDB(t, DBConfig{Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3119",
+		ReplicaConfigs:  []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3118", ReadTimeout: 500 * time.Millisecond}},
+		ReplicationMode: REPLICATION_SYNC_ALL, ReplicationTimeout: 100 * time.Millisecond})
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3119"})
+	require.NoError(t, err)
+	defer client.Close()
+
+	start := time.Now()
+	err = client.Put([]byte("k1"), []byte("v1"))
+	require.ErrorContains(t, err, ErrQuorumNotReached.Error())
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+/* A replica that can't keep up misses writes rather than holding up the leader */
+func TestReplicationQueueFull(t *testing.T) {
+	blackHole, err := net.Listen(DEFAULT_REPLICA_PROTOCOL, DEFAULT_REPLICA_HOST+":3153")
+	require.NoError(t, err)
+	defer blackHole.Close()
+	go func() {
+		for {
+			conn, err := blackHole.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	db, err := NewDB(DBConfig{Persist: false, Role: LEADER, ReplicationTimeout: 2 * time.Second,
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3153"}}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3*REPLICATION_QUEUE_SIZE; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	require.Less(t, time.Since(start), time.Second)
+}
+
+/* Concurrent writes to the same keys must end up with the same final values on the follower as on the leader */
+func TestReplicationOrder(t *testing.T) {
+	follower := startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: FOLLOWER, ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3120"})
+	leader := startDB(t, DBConfig{ReplicationToken: "secret", Persist: false, Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3121",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_REPLICA_PROTOCOL, ServerHost: DEFAULT_REPLICA_HOST, ServerPort: "3120"}}})
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3121", PoolSize: 4})
+	require.NoError(t, err)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key%d", i%3))
+				if i%7 == 0 {
+					client.Delete(key)
+					continue
+				}
+				require.NoError(t, client.Put(key, []byte(fmt.Sprintf("val%d-%d", g, i))))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == leader.AppliedSeq() }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, len(leader.Entries), len(follower.Entries))
+	for i := 0; i < 3; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		vLeader, errLeader := leader.Get(key)
+		vFollower, errFollower := follower.Get(key)
+		require.Equal(t, errLeader, errFollower)
+		require.Equal(t, vLeader, vFollower)
+	}
+}
+
+func TestApplyReplicated(t *testing.T) {
+	db, err := NewDB(DBConfig{Persist: false, Role: FOLLOWER})
+	require.NoError(t, err)
+
+	tcs := []struct {
+		seq     uint64
+		val     string
+		errWant error
+		seqWant uint64
+		valWant string
+	}{
+		{seq: 1, val: "v1", errWant: nil, seqWant: 1, valWant: "v1"},
+		{seq: 2, val: "v2", errWant: nil, seqWant: 2, valWant: "v2"},
+		/* Redelivery of a write we already have */
+		{seq: 1, val: "v1", errWant: nil, seqWant: 2, valWant: "v2"},
+		/* Write 3 went missing */
+		{seq: 4, val: "v4", errWant: ErrOutOfOrder, seqWant: 2, valWant: "v2"},
+		{seq: 3, val: "v3", errWant: nil, seqWant: 3, valWant: "v3"},
+	}
+
+	for _, tc := range tcs {
+		err := db.applyReplicated(&communication.LogRecord{Seq: tc.seq, Op: communication.Operation_PUT, Key: []byte("k"), Val: []byte(tc.val)})
+		require.ErrorIs(t, err, tc.errWant)
+		require.Equal(t, tc.seqWant, db.AppliedSeq())
+		v, err := db.Get([]byte("k"))
+		require.NoError(t, err)
+		require.Equal(t, []byte(tc.valWant), v)
+	}
+}
+
+/* The sequence number survives a restart, both from the log and from a snapshot */
+func TestAppliedSeqPersistence(t *testing.T) {
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: filepath.Join(t.TempDir(), "dbdump")}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Delete([]byte("key0")))
+	require.Equal(t, uint64(6), db.AppliedSeq())
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), db.AppliedSeq())
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, uint64(6), db.AppliedSeq())
+	require.NoError(t, db.Put([]byte("key0"), []byte("val")))
+	require.Equal(t, uint64(7), db.AppliedSeq())
+}
+
+func TestRequiredAcks(t *testing.T) {
+	tcs := []struct {
+		mode, replicas, want int
+	}{
+		{mode: REPLICATION_ASYNC, replicas: 3, want: 0},
+		{mode: REPLICATION_SYNC_ALL, replicas: 3, want: 3},
+		{mode: REPLICATION_QUORUM, replicas: 0, want: 0},
+		{mode: REPLICATION_QUORUM, replicas: 1, want: 1},
+		{mode: REPLICATION_QUORUM, replicas: 2, want: 1},
+		{mode: REPLICATION_QUORUM, replicas: 3, want: 2},
+		{mode: REPLICATION_QUORUM, replicas: 4, want: 2},
+	}
+
+	for _, tc := range tcs {
+		db := &DB{config: DBConfig{ReplicationMode: tc.mode}, replicaWorkers: make([]*ReplicaWorker, tc.replicas)}
+		require.Equal(t, tc.want, db.requiredAcks(), "mode %d with %d replicas", tc.mode, tc.replicas)
+	}
+}
+
+func requireErrorContains(t *testing.T, err, errWant error) {
+	if errWant == nil {
+		require.NoError(t, err)
+		return
+	}
+	require.ErrorContains(t, err, errWant.Error())
+}
+
+func contextWithTimeout(t *testing.T, timeout time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
@@ -0,0 +1,147 @@
+package distdb
+
+import (
+	"bytes"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	Scans walk the skip list (see skiplist.go) in key order. Over the network they are paged: a SCAN or PREFIX_SCAN
+	returns up to limit entries, at most MAX_SCAN_PAGE_SIZE of them and MAX_SCAN_PAGE_BYTES of keys and values, and if
+	the range has more, a continuation to send as the next page's start. Every page is consistent on its own, but
+	writes may land in between pages.
+
+	With the keyspace sharded a node only scans the keys its group owns.
+*/
+
+const (
+	MAX_SCAN_PAGE_SIZE  = 1000
+	MAX_SCAN_PAGE_BYTES = 4 << 20 /* A page always has at least one entry, however big */
+)
+
+/* Entries with keys from start up to but not including end in key order, at most limit of them. nil end and limit <= 0 don't bound the scan */
+func (db *DB) Scan(start, end []byte, limit int) []DBEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var entries []DBEntry
+	db.walk(start, end, func(entry *DBEntry) bool {
+		if limit > 0 && len(entries) == limit {
+			return false
+		}
+		entries = append(entries, newDBEntry(entry.Key, entry.Val, entry.Version))
+		return true
+	})
+	return entries
+}
+
+/*
+	Call fn on every entry whose key starts with prefix in key order, until it returns false. Entries are read
+	MAX_SCAN_PAGE_SIZE at a time and fn is called without the DB locked, so it may write, but like a paged scan it may or
+	may not see writes made while it runs.
+*/
+func (db *DB) IteratePrefix(prefix []byte, fn func(key, val []byte) bool) {
+	start, end := prefix, prefixEnd(prefix)
+	for start != nil {
+		var page []DBEntry
+		db.mu.RLock()
+		more := db.walk(start, end, func(entry *DBEntry) bool {
+			if len(page) == MAX_SCAN_PAGE_SIZE {
+				return false
+			}
+			page = append(page, newDBEntry(entry.Key, entry.Val, entry.Version))
+			return true
+		})
+		db.mu.RUnlock()
+
+		for _, entry := range page {
+			if !fn(entry.Key, entry.Val) {
+				return
+			}
+		}
+		start = nil
+		if more {
+			start = after(page[len(page)-1].Key)
+		}
+	}
+}
+
+/* Call fn on the entries with keys from start up to but not including end (nil for no end) until it returns false, in which case walk does too. Call this only with db.Mutex held */
+func (db *DB) walk(start, end []byte, fn func(entry *DBEntry) bool) bool {
+	for node := db.sorted.seek(start); node != nil; node = node.next[0] {
+		if end != nil && bytes.Compare(node.entry.Key, end) >= 0 {
+			break
+		}
+		if !fn(node.entry) {
+			return true
+		}
+	}
+	return false
+}
+
+/* The first key after every key starting with prefix, nil if there is none (prefix is empty or all 0xff) */
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+/* The smallest key after key */
+func after(key []byte) []byte {
+	return append(append([]byte{}, key...), 0)
+}
+
+/* A page of the scan clientRequest (a SCAN or PREFIX_SCAN) asks for */
+func (db *DB) handleScan(clientRequest *communication.Request, resp *communication.Response) error {
+	limit := int(clientRequest.Limit)
+	if limit <= 0 || limit > MAX_SCAN_PAGE_SIZE {
+		limit = MAX_SCAN_PAGE_SIZE
+	}
+	start, end := clientRequest.Key, clientRequest.End
+	keysOnly := false
+	if clientRequest.Op == communication.Operation_PREFIX_SCAN {
+		end, keysOnly = prefixEnd(clientRequest.Prefix), clientRequest.KeysOnly
+		if bytes.Compare(start, clientRequest.Prefix) < 0 {
+			start = clientRequest.Prefix
+		}
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+
+	var records []*communication.LogRecord
+	size := 0
+	db.shardMu.RLock()
+	db.mu.RLock()
+	more := db.walk(start, end, func(entry *DBEntry) bool {
+		if !db.ownsKey(entry.Key) {
+			return true
+		}
+		record := &communication.LogRecord{Op: communication.Operation_PUT, Key: entry.Key}
+		if !keysOnly {
+			record.Val = entry.Val
+		}
+		if len(records) == limit || (len(records) > 0 && size+len(record.Key)+len(record.Val) > MAX_SCAN_PAGE_BYTES) {
+			return false
+		}
+		records = append(records, record)
+		size += len(record.Key) + len(record.Val)
+		return true
+	})
+	db.mu.RUnlock()
+	db.shardMu.RUnlock()
+
+	if more {
+		resp.Continuation = after(records[len(records)-1].Key)
+	}
+
+	var err error
+	resp.Records, err = encodeRecords(records)
+	return err
+}
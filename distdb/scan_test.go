@@ -0,0 +1,246 @@
+package distdb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+/* The skip list stays in key order through random puts and deletes */
+func TestSkipList(t *testing.T) {
+	db, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	want := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", r.Intn(500))
+		if r.Intn(3) == 0 {
+			db.Delete([]byte(key))
+			delete(want, key)
+			continue
+		}
+		val := fmt.Sprint(r.Int())
+		require.NoError(t, db.Put([]byte(key), []byte(val)))
+		want[key] = val
+	}
+
+	keys := make([]string, 0, len(want))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	entries := db.Scan(nil, nil, 0)
+	require.Len(t, entries, len(keys))
+	for i, entry := range entries {
+		require.Equal(t, keys[i], string(entry.Key))
+		require.Equal(t, want[keys[i]], string(entry.Val))
+	}
+
+	/* Seeks land on the first key at or after the one sought */
+	for _, key := range []string{"", "key1", "key250", "key4999", "zzz"} {
+		i := sort.SearchStrings(keys, key)
+		node := db.sorted.seek([]byte(key))
+		if i == len(keys) {
+			require.Nil(t, node)
+			continue
+		}
+		require.Equal(t, keys[i], string(node.entry.Key))
+	}
+}
+
+func TestScan(t *testing.T) {
+	db, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+	for _, key := range []string{"d", "b", "a", "e", "c"} {
+		require.NoError(t, db.Put([]byte(key), []byte("val"+key)))
+	}
+
+	tcs := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{"a", "b", "c", "d", "e"}},
+		{"b", "d", 0, []string{"b", "c"}},
+		{"bb", "", 0, []string{"c", "d", "e"}},
+		{"", "", 2, []string{"a", "b"}},
+		{"c", "c", 0, nil},
+		{"f", "", 0, nil},
+	}
+	for _, tc := range tcs {
+		var end []byte
+		if tc.end != "" {
+			end = []byte(tc.end)
+		}
+		var keys []string
+		for _, entry := range db.Scan([]byte(tc.start), end, tc.limit) {
+			keys = append(keys, string(entry.Key))
+			require.Equal(t, "val"+string(entry.Key), string(entry.Val))
+		}
+		require.Equal(t, tc.want, keys, "start %q end %q limit %d", tc.start, tc.end, tc.limit)
+	}
+}
+
+/* Client.Scan pages through the range, continuing where each page left off */
+func TestClientScan(t *testing.T) {
+	db := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3142"})
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("valkey%02d", i))))
+	}
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3142", ScanPageSize: 7})
+	require.NoError(t, err)
+	defer client.Close()
+
+	scan := func(start, end []byte, limit int) []string {
+		var keys []string
+		it := client.Scan(context.Background(), start, end, limit)
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+			require.Equal(t, "val"+string(it.Key()), string(it.Val()))
+		}
+		require.NoError(t, it.Err())
+		return keys
+	}
+
+	keys := scan(nil, nil, 0)
+	require.Len(t, keys, 50)
+	require.Equal(t, "key00", keys[0])
+	require.Equal(t, "key49", keys[49])
+
+	keys = scan([]byte("key10"), []byte("key30"), 0)
+	require.Len(t, keys, 20)
+	require.Equal(t, "key10", keys[0])
+	require.Equal(t, "key29", keys[19])
+
+	keys = scan([]byte("key10"), nil, 15)
+	require.Len(t, keys, 15)
+	require.Equal(t, "key24", keys[14])
+
+	require.Empty(t, scan([]byte("zzz"), nil, 0))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("user:124"), prefixEnd([]byte("user:123")))
+	require.Equal(t, []byte{'a', 1}, prefixEnd([]byte{'a', 0}))
+	require.Equal(t, []byte("b"), prefixEnd([]byte{'a', 0xff, 0xff}))
+	require.Nil(t, prefixEnd([]byte{0xff}))
+	require.Nil(t, prefixEnd(nil))
+}
+
+func TestIteratePrefix(t *testing.T) {
+	db, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+	for i := 0; i < MAX_SCAN_PAGE_SIZE+10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("user:1:%04d", i)), []byte("val")))
+	}
+	for _, key := range []string{"user:1", "user:10:a", "user:2:a", "user:0:a"} {
+		require.NoError(t, db.Put([]byte(key), []byte("other")))
+	}
+
+	/* Across pages, in order, and writing as we go doesn't deadlock */
+	n := 0
+	db.IteratePrefix([]byte("user:1:"), func(key, val []byte) bool {
+		require.Equal(t, fmt.Sprintf("user:1:%04d", n), string(key))
+		require.Equal(t, []byte("val"), val)
+		require.NoError(t, db.Put(key, []byte("seen")))
+		n++
+		return true
+	})
+	require.Equal(t, MAX_SCAN_PAGE_SIZE+10, n)
+
+	/* Stopped early */
+	n = 0
+	db.IteratePrefix([]byte("user:"), func(key, val []byte) bool {
+		n++
+		return n < 3
+	})
+	require.Equal(t, 3, n)
+}
+
+/* Pages stop short of MAX_SCAN_PAGE_BYTES, but always hold at least one entry */
+func TestScanPageBytes(t *testing.T) {
+	db, err := NewDB(DBConfig{Role: LEADER})
+	require.NoError(t, err)
+	big := make([]byte, MAX_SCAN_PAGE_BYTES/2+1)
+	for _, key := range []string{"a:1", "a:2", "a:3"} {
+		require.NoError(t, db.Put([]byte(key), big))
+	}
+
+	req := &communication.Request{Op: communication.Operation_PREFIX_SCAN, Prefix: []byte("a:"), Key: []byte("a:")}
+	var keys []string
+	for pages := 1; ; pages++ {
+		resp := &communication.Response{}
+		require.NoError(t, db.handleScan(req, resp))
+		require.Len(t, resp.Records, 1)
+		records, err := decodeRecords(resp.Records)
+		require.NoError(t, err)
+		keys = append(keys, string(records[0].Key))
+		if resp.Continuation == nil {
+			require.Equal(t, 3, pages)
+			break
+		}
+		req.Key = resp.Continuation
+	}
+	require.Equal(t, []string{"a:1", "a:2", "a:3"}, keys)
+
+	/* Keys alone fit in a single page */
+	req = &communication.Request{Op: communication.Operation_PREFIX_SCAN, Prefix: []byte("a:"), KeysOnly: true}
+	resp := &communication.Response{}
+	require.NoError(t, db.handleScan(req, resp))
+	require.Len(t, resp.Records, 3)
+	require.Nil(t, resp.Continuation)
+}
+
+func TestClientListPrefix(t *testing.T) {
+	db := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3143"})
+	for i := 0; i < 30; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("user:123:%02d", i)), []byte(fmt.Sprint(i))))
+	}
+	for _, key := range []string{"user:12", "user:1234:profile", "user:122:profile", "user:124:profile"} {
+		require.NoError(t, db.Put([]byte(key), []byte("other")))
+	}
+
+	client, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3143", ScanPageSize: 7})
+	require.NoError(t, err)
+	defer client.Close()
+
+	list := func(prefix string, limit int, keysOnly bool) (keys, vals []string) {
+		it := client.ListPrefix(context.Background(), []byte(prefix), limit, keysOnly)
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+			vals = append(vals, string(it.Val()))
+		}
+		require.NoError(t, it.Err())
+		return keys, vals
+	}
+
+	keys, vals := list("user:123:", 0, false)
+	require.Len(t, keys, 30)
+	for i := range keys {
+		require.Equal(t, fmt.Sprintf("user:123:%02d", i), keys[i])
+		require.Equal(t, fmt.Sprint(i), vals[i])
+	}
+
+	keys, vals = list("user:123:", 10, true)
+	require.Len(t, keys, 10)
+	require.Equal(t, "user:123:09", keys[9])
+	for _, val := range vals {
+		require.Empty(t, val)
+	}
+
+	keys, _ = list("user:123", 0, true)
+	require.Len(t, keys, 31)
+	require.Equal(t, "user:1234:profile", keys[0]) /* "4" sorts before ":" */
+
+	keys, _ = list("nobody:", 0, false)
+	require.Empty(t, keys)
+}
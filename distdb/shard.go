@@ -0,0 +1,571 @@
+package distdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	With a ShardMap set the node belongs to one of several replica groups, each storing its own part of the keyspace,
+	see the sharding package. A group is an ordinary leader/follower or raft cluster that only takes keys the map says
+	belong to ShardGroup: GETs, PUTs and DELETEs for anyone else's keys are turned away with WRONG_SHARD and a map, so
+	that a client routing by an out of date one can go to the right group. A group that isn't in the map owns no keys,
+	which is how a new group starts out.
+
+	Rebalancing moves the keyspace over to a new map without downtime (see distdbclient.ShardedClient.Rebalance):
+	1. SHARD_PREPARE tells every node the map being moved to, the target.
+	2. SHARD_MIGRATE has each group's leader start handing over the keys the target gives to someone else, in the
+	   background (SHARD_MIGRATE_STATUS says once it is done). From then on writes to those keys are applied at their
+	   new owner before they are applied here (dual writes), while every such key is streamed over as it is now,
+	   version included (see cas.go), in batches of MIGRATE_BATCH_SIZE. Dual writes and batches are serialized, so a
+	   batch can't overwrite a newer dual write.
+	3. Once everything has been streamed the leader stops taking the keys, and tells every other group's leader with
+	   SHARD_HANDED_OFF, after which they own the keys coming from us. Requests for them are held back until then, so
+	   that they aren't sent back and forth between us and a new owner that doesn't know yet. Then our copies are deleted.
+	4. SHARD_COMMIT has every node route by the target from then on.
+
+	Until a group has handed off, the keys it is giving away are still its own everywhere. A client that picked up the
+	target early and asks a key's new owner gets the map the owner routes that key by, and goes where that says.
+
+	Rebalancing state is kept in memory only. The leader of every group has to stay up until the rebalance is done,
+	or it has to be run again (every step can be repeated), and nodes restarted afterwards need the new map in their
+	config.
+*/
+
+const MIGRATE_BATCH_SIZE = 100
+
+var ErrWrongShard = errors.New("key belongs to another shard group")
+var ErrRebalanceUnderway = errors.New("another rebalance is underway")
+var ErrNoRebalance = errors.New("no rebalance to the shard map version")
+
+/* A key that isn't ours, matches ErrWrongShard with errors.Is */
+type wrongShardError struct {
+	key []byte
+}
+
+func (e *wrongShardError) Error() string {
+	return fmt.Sprintf("%s: %q", ErrWrongShard, e.key)
+}
+
+func (e *wrongShardError) Is(target error) bool {
+	return target == ErrWrongShard
+}
+
+/* Our keys being handed over to their new owners in the rebalance to a shard map version, see Migrate */
+type migration struct {
+	mu      *sync.Mutex                     /* Held by dual writes and while a batch is read and streamed */
+	clients map[string]*distdbclient.Client /* Group ID -> client, one per group we are handing keys over to */
+
+	/* Guarded by db.shardMu */
+	running    bool
+	done       bool          /* Keys handed over and our copies deleted */
+	err        error         /* Why the last run failed, Migrate again to pick up where it left off */
+	handingOff chan struct{} /* Closed once the new owners know they have our keys, nil unless we are telling them */
+	cancel     context.CancelFunc
+	finished   chan struct{} /* Closed when the current run returns */
+}
+
+/* Check that ShardGroup is set if ShardMap is */
+func initShards(db *DB) error {
+	db.shardMu = &sync.RWMutex{}
+	if db.config.ShardMap == nil {
+		return nil
+	}
+	if db.config.ShardGroup == "" {
+		return fmt.Errorf("%w: a shard map needs a shard group", ErrInvalidOperation)
+	}
+	db.shardMap = db.config.ShardMap
+	return nil
+}
+
+/* The shard map we route by, nil if the keyspace isn't sharded */
+func (db *DB) ShardMap() *sharding.ShardMap {
+	db.shardMu.RLock()
+	defer db.shardMu.RUnlock()
+	return db.shardMap
+}
+
+/* The group owning key as far as we know, empty if the keyspace isn't sharded. Call this only with db.shardMu held */
+func (db *DB) owner(key []byte) string {
+	if db.shardMap == nil {
+		return ""
+	}
+	from := db.shardMap.Owner(key).ID
+	if db.shardTarget == nil || !db.handedOff[from] {
+		return from
+	}
+	return db.shardTarget.Owner(key).ID
+}
+
+/* Whether key is ours to store, always true if the keyspace isn't sharded. Call this only with db.shardMu held */
+func (db *DB) ownsKey(key []byte) bool {
+	return db.shardMap == nil || db.owner(key) == db.config.ShardGroup
+}
+
+/* Whether key is ours now but someone else's in the target. Call this only with db.shardMu held */
+func (db *DB) movingAway(key []byte) bool {
+	return db.shardTarget != nil && db.shardMap.Owner(key).ID == db.config.ShardGroup && db.shardTarget.Owner(key).ID != db.config.ShardGroup
+}
+
+/* WRONG_SHARD along with the map we route key by */
+func (db *DB) wrongShard(key []byte) *communication.Response {
+	db.shardMu.RLock()
+	db.awaitHandOff(key)
+	shardMap := db.shardMap
+	if db.shardTarget != nil && db.owner(key) == db.shardTarget.Owner(key).ID {
+		shardMap = db.shardTarget
+	}
+	db.shardMu.RUnlock()
+
+	resp := &communication.Response{Status: communication.Status_WRONG_SHARD, Error: ErrWrongShard.Error()}
+	resp.ShardMap, _ = shardMap.Encode()
+	return resp
+}
+
+func (db *DB) encodedShardMap() ([]byte, error) {
+	shardMap := db.ShardMap()
+	if shardMap == nil {
+		return nil, fmt.Errorf("%w: the keyspace isn't sharded", ErrInvalidOperation)
+	}
+	return shardMap.Encode()
+}
+
+/* GetWithVersion for a client, ErrWrongShard if key isn't ours */
+func (db *DB) shardedGet(key []byte) ([]byte, uint64, error) {
+	db.shardMu.RLock()
+	defer db.shardMu.RUnlock()
+
+	if !db.ownsKey(key) {
+		return nil, 0, ErrWrongShard
+	}
+	return db.GetWithVersion(key)
+}
+
+/*
+	Put, delete, batch or CAS for a client, a wrongShardError for the first of its keys that isn't ours. Keys being
+	handed over are written to their new owner first, so a batch with some of those is only atomic here and at each new
+	owner on its own.
+*/
+func (db *DB) shardedWrite(record *communication.LogRecord) error {
+	db.shardMu.RLock()
+	defer db.shardMu.RUnlock()
+
+	moving := map[string][]*communication.LogRecord{} /* New owner -> writes to keys moving to it */
+	for _, write := range batchWrites(record) {
+		if !db.ownsKey(write.Key) {
+			return &wrongShardError{key: write.Key}
+		}
+		if db.migration != nil && db.movingAway(write.Key) {
+			owner := db.shardTarget.Owner(write.Key).ID
+			if write.Op == communication.Operation_CAS {
+				write = &communication.LogRecord{Op: communication.Operation_PUT, Key: write.Key, Val: write.Val}
+			}
+			moving[owner] = append(moving[owner], write)
+		}
+	}
+	m := db.migration
+	if len(moving) == 0 {
+		return db.write(record)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	db.mu.RLock()
+	floor := db.versionFloor
+	var err error
+	if record.Op == communication.Operation_CAS {
+		/* Only hand the put over if it is going to happen here, dual writes being serialized nothing can change the key in between */
+		err = db.checkCondition(record)
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for owner, writes := range moving {
+		err := m.transfer(context.Background(), owner, writes, floor, db.config.ReplicationToken)
+		if err != nil {
+			return err
+		}
+	}
+	return db.write(record)
+}
+
+/* Start a rebalance to target, a no-op if it is underway or done already */
+func (db *DB) PrepareRebalance(target *sharding.ShardMap) error {
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+
+	switch {
+	case db.shardMap == nil:
+		return fmt.Errorf("%w: the keyspace isn't sharded", ErrInvalidOperation)
+	case target.Version == db.shardMap.Version:
+		return nil
+	case target.Version < db.shardMap.Version:
+		return fmt.Errorf("%w: shard map version %d is older than ours, %d", ErrInvalidOperation, target.Version, db.shardMap.Version)
+	case db.shardTarget != nil && db.shardTarget.Version == target.Version:
+		return nil
+	case db.shardTarget != nil:
+		return fmt.Errorf("%w: to shard map version %d", ErrRebalanceUnderway, db.shardTarget.Version)
+	}
+
+	fmt.Printf("\nRebalancing from shard map version %d to %d", db.shardMap.Version, target.Version)
+	db.shardTarget, db.handedOff = target, map[string]bool{}
+	return nil
+}
+
+/* The target if it is version, ErrNoRebalance otherwise. Call this only with db.shardMu held */
+func (db *DB) rebalanceTarget(version uint64) (*sharding.ShardMap, error) {
+	if db.shardTarget == nil || db.shardTarget.Version != version {
+		return nil, fmt.Errorf("%w %d", ErrNoRebalance, version)
+	}
+	return db.shardTarget, nil
+}
+
+/*
+	Start handing the keys moving away from us in the rebalance to shard map version over to their new owners, see the
+	top of the file, and deleting our copies. Leaders only. It runs in the background, MigrationStatus says when it is
+	done. Starting it again while it runs, or once it is done, is a no-op rather than a second run, and after it failed
+	picks up where it left off.
+*/
+func (db *DB) Migrate(version uint64) error {
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+
+	if db.shardMap != nil && db.shardMap.Version == version {
+		return nil
+	}
+	target, err := db.rebalanceTarget(version)
+	if err != nil {
+		return err
+	}
+	m := db.migration
+	if m != nil && (m.running || m.done) {
+		return nil
+	}
+
+	/* Starting dual writes while holding shardMu means every write from now on is seen by the stream or dual written */
+	if m == nil {
+		m = &migration{mu: &sync.Mutex{}, clients: map[string]*distdbclient.Client{}}
+		for _, group := range target.Groups {
+			if group.ID == db.config.ShardGroup {
+				continue
+			}
+			m.clients[group.ID], err = distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: db.config.ServerProtocol,
+				MaxMessageSize: db.config.MaxMessageSize, Seeds: group.Seeds, LazyConnect: true})
+			if err != nil {
+				m.close()
+				return err
+			}
+		}
+		db.migration = m
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.running, m.err, m.cancel, m.finished = true, nil, cancel, make(chan struct{})
+	go db.runMigration(ctx, m, target)
+	return nil
+}
+
+/* Whether the keys moving away in the rebalance to shard map version have been handed over, or why that failed */
+func (db *DB) MigrationStatus(version uint64) (done bool, err error) {
+	db.shardMu.RLock()
+	defer db.shardMu.RUnlock()
+
+	if db.shardMap != nil && db.shardMap.Version == version {
+		return true, nil
+	}
+	if _, err := db.rebalanceTarget(version); err != nil {
+		return false, err
+	}
+	if db.migration == nil {
+		return false, fmt.Errorf("%w: no keys are being handed over for shard map version %d", ErrInvalidOperation, version)
+	}
+	return db.migration.done, db.migration.err
+}
+
+func (db *DB) runMigration(ctx context.Context, m *migration, target *sharding.ShardMap) {
+	err := db.migrate(ctx, m, target)
+	if err != nil {
+		fmt.Printf("\nError handing keys over for shard map version %d: %v", target.Version, err)
+	} else {
+		fmt.Printf("\nHanded keys over for shard map version %d", target.Version)
+	}
+
+	db.shardMu.Lock()
+	m.running, m.err, m.done = false, err, err == nil
+	m.cancel()
+	close(m.finished)
+	db.shardMu.Unlock()
+
+	/* Dual writes stopped when we handed off, the clients are ours alone now. A failed run keeps them for the next */
+	if err == nil {
+		m.close()
+	}
+}
+
+func (db *DB) migrate(ctx context.Context, m *migration, target *sharding.ShardMap) error {
+	db.shardMu.RLock()
+	handedOff := db.handedOff[db.config.ShardGroup]
+	keys := db.keysMovingAway()
+	db.shardMu.RUnlock()
+
+	if !handedOff {
+		fmt.Printf("\nHanding %d keys over for shard map version %d", len(keys), target.Version)
+		for start := 0; start < len(keys); start += MIGRATE_BATCH_SIZE {
+			end := start + MIGRATE_BATCH_SIZE
+			if end > len(keys) {
+				end = len(keys)
+			}
+			err := db.streamBatch(ctx, m, target, keys[start:end])
+			if err != nil {
+				return err
+			}
+		}
+
+		/* Waits for in-flight dual writes, none are made from now on */
+		db.shardMu.Lock()
+		db.handedOff[db.config.ShardGroup] = true
+		m.handingOff = make(chan struct{})
+		keys = db.keysMovingAway()
+		db.shardMu.Unlock()
+	}
+
+	err := db.notifyHandOff(ctx, m, target.Version)
+	db.shardMu.Lock()
+	if m.handingOff != nil {
+		close(m.handingOff)
+		m.handingOff = nil
+	}
+	db.shardMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	/* Garbage collect, keys written since we started streaming included */
+	for _, key := range keys {
+		err := db.Delete(key)
+		if err != nil && !errors.Is(err, ErrKeyDoesNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Tell every other group's leader that we have handed our keys over for the rebalance to shard map version */
+func (db *DB) notifyHandOff(ctx context.Context, m *migration, version uint64) error {
+	for id, client := range m.clients {
+		req := communication.Request{Op: communication.Operation_SHARD_HANDED_OFF, Key: []byte(db.config.ShardGroup), Seq: version, Token: db.config.ReplicationToken}
+		err := doShardRequest(ctx, client, &req)
+		if err != nil {
+			return fmt.Errorf("handing off to group %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+/* Stop handing keys over and let go of the clients, for shutting down */
+func (db *DB) stopMigration(ctx context.Context) error {
+	db.shardMu.Lock()
+	m := db.migration
+	if m == nil || m.done {
+		db.shardMu.Unlock()
+		return nil
+	}
+	var finished chan struct{}
+	if m.running {
+		m.cancel()
+		finished = m.finished
+	}
+	db.shardMu.Unlock()
+
+	if finished != nil {
+		if err := waitContext(ctx, func() { <-finished }); err != nil {
+			return err
+		}
+	}
+	m.close()
+	return nil
+}
+
+/*
+	Hold a request for key back while its new owner is being told it has it, so that we don't send the client there
+	too early. Call this only with db.shardMu held shared, it is released while waiting
+*/
+func (db *DB) awaitHandOff(key []byte) {
+	for db.migration != nil && db.migration.handingOff != nil && db.movingAway(key) {
+		handingOff := db.migration.handingOff
+		db.shardMu.RUnlock()
+		<-handingOff
+		db.shardMu.RLock()
+	}
+}
+
+/* Every key we have that is moving away. Call this only with db.shardMu held */
+func (db *DB) keysMovingAway() [][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys [][]byte
+	for _, entry := range db.Entries {
+		if db.movingAway(entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	return keys
+}
+
+/* Send keys as they are now to their owners in target, skipping deleted ones as their deletes were dual written */
+func (db *DB) streamBatch(ctx context.Context, m *migration, target *sharding.ShardMap, keys [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	batches := map[string][]*communication.LogRecord{}
+	for _, key := range keys {
+		val, version, err := db.GetWithVersion(key)
+		if errors.Is(err, ErrKeyDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		owner := target.Owner(key).ID
+		batches[owner] = append(batches[owner], &communication.LogRecord{Op: communication.Operation_PUT, Key: key, Val: val, KeyVersion: version})
+	}
+
+	db.mu.RLock()
+	floor := db.versionFloor
+	db.mu.RUnlock()
+	for owner, records := range batches {
+		err := m.transfer(ctx, owner, records, floor, db.config.ReplicationToken)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Apply records at group owner's leader, along with our version floor (see cas.go) */
+func (m *migration) transfer(ctx context.Context, owner string, records []*communication.LogRecord, floor uint64, token string) error {
+	client, ok := m.clients[owner]
+	if !ok {
+		return fmt.Errorf("%w: no group %s to hand over to", ErrInvalidOperation, owner)
+	}
+
+	req := communication.Request{Op: communication.Operation_SHARD_TRANSFER, VersionFloor: floor, Token: token}
+	for _, record := range records {
+		data, err := proto.Marshal(&communication.LogRecord{Op: record.Op, Key: record.Key, Val: record.Val, KeyVersion: record.KeyVersion})
+		if err != nil {
+			return err
+		}
+		req.Records = append(req.Records, data)
+	}
+
+	err := doShardRequest(ctx, client, &req)
+	if err != nil {
+		return fmt.Errorf("handing over to group %s: %w", owner, err)
+	}
+	return nil
+}
+
+func (m *migration) close() {
+	for _, client := range m.clients {
+		client.Close()
+	}
+}
+
+func doShardRequest(ctx context.Context, client *distdbclient.Client, req *communication.Request) error {
+	resp, err := client.DoContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Status != communication.Status_SUCCESS {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+/*
+	Apply writes handed over by another group as a single SHARD_TRANSFER record, whatever the shard map says. Its keys
+	keep their versions, and our version floor is raised to the group's, floor, so that we never give a key one it has had
+*/
+func (db *DB) applyTransfer(records [][]byte, floor uint64) error {
+	batch, err := decodeRecords(records)
+	if err != nil {
+		return err
+	}
+	for _, write := range batch {
+		if write.KeyVersion > floor {
+			floor = write.KeyVersion
+		}
+	}
+	return db.write(&communication.LogRecord{Op: communication.Operation_SHARD_TRANSFER, Batch: batch, KeyVersion: floor})
+}
+
+/* Group from has handed its keys over for the rebalance to shard map version, we own the ones coming to us from now on */
+func (db *DB) handOff(from string, version uint64) error {
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+
+	if db.shardMap != nil && db.shardMap.Version == version {
+		return nil
+	}
+	_, err := db.rebalanceTarget(version)
+	if err != nil {
+		return err
+	}
+	db.handedOff[from] = true
+	return nil
+}
+
+/* Route by the target of the rebalance to shard map version from now on, a no-op if we do already */
+func (db *DB) CommitRebalance(version uint64) error {
+	db.shardMu.Lock()
+	defer db.shardMu.Unlock()
+
+	if db.shardMap != nil && db.shardMap.Version == version {
+		return nil
+	}
+	target, err := db.rebalanceTarget(version)
+	if err != nil {
+		return err
+	}
+	if db.migration != nil && !db.migration.done {
+		return fmt.Errorf("%w: keys are still being handed over", ErrInvalidOperation)
+	}
+
+	fmt.Printf("\nRouting by shard map version %d", version)
+	db.shardMap, db.shardTarget, db.handedOff, db.migration = target, nil, nil, nil
+	return nil
+}
+
+/* Serve the rebalancing requests, see the top of the file */
+func (db *DB) handleRebalance(clientRequest *communication.Request, resp *communication.Response) error {
+	switch clientRequest.Op {
+	case communication.Operation_SHARD_PREPARE:
+		target, err := sharding.Decode(clientRequest.Val)
+		if err != nil {
+			return err
+		}
+		return db.PrepareRebalance(target)
+	case communication.Operation_SHARD_MIGRATE:
+		return db.Migrate(clientRequest.Seq)
+	case communication.Operation_SHARD_MIGRATE_STATUS:
+		done, err := db.MigrationStatus(clientRequest.Seq)
+		resp.Done = done
+		return err
+	case communication.Operation_SHARD_TRANSFER:
+		return db.applyTransfer(clientRequest.Records, clientRequest.VersionFloor)
+	case communication.Operation_SHARD_HANDED_OFF:
+		return db.handOff(string(clientRequest.Key), clientRequest.Seq)
+	case communication.Operation_SHARD_COMMIT:
+		return db.CommitRebalance(clientRequest.Seq)
+	}
+	return ErrInvalidOperation
+}
@@ -0,0 +1,374 @@
+package distdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedCluster(t *testing.T) {
+	groups := []sharding.Group{{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3132"}}, {ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3133"}}}
+	shardMap, err := sharding.NewShardMap(2, groups, 0)
+	require.NoError(t, err)
+
+	_, err = NewDB(DBConfig{Role: LEADER, ShardMap: shardMap})
+	require.ErrorIs(t, err, ErrInvalidOperation)
+
+	dbs := map[string]*DB{
+		"g0": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3132", ShardMap: shardMap, ShardGroup: "g0"}),
+		"g1": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3133", ShardMap: shardMap, ShardGroup: "g1"}),
+	}
+
+	/* The map comes from the servers */
+	client, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: groups[1].Seeds}, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	require.Equal(t, shardMap, client.ShardMap())
+
+	/* Every key ends up on its owner and only there */
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, client.Put(key, key))
+	}
+	require.NotEmpty(t, dbs["g0"].Entries)
+	require.NotEmpty(t, dbs["g1"].Entries)
+	require.Len(t, dbs["g0"].Entries, 100-len(dbs["g1"].Entries))
+	for id, db := range dbs {
+		for _, entry := range db.Entries {
+			require.Equal(t, id, shardMap.Owner(entry.Key).ID)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		val, err := client.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+	require.NoError(t, client.Delete([]byte("key0")))
+	_, err = client.Get([]byte("key0"))
+	require.ErrorContains(t, err, ErrKeyDoesNotExist.Error())
+
+	/* Misrouted keys are turned away */
+	var misrouted []byte
+	for i := 1; misrouted == nil; i++ {
+		if key := []byte(fmt.Sprintf("key%d", i)); shardMap.Owner(key).ID == "g1" {
+			misrouted = key
+		}
+	}
+	plain, err := distdbclient.NewClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3132"})
+	require.NoError(t, err)
+	defer plain.Close()
+	err = plain.Put(misrouted, []byte("v"))
+	require.ErrorIs(t, err, distdbclient.ErrWrongShard)
+	resp, err := plain.Do(&communication.Request{Op: communication.Operation_GET, Key: misrouted})
+	require.NoError(t, err)
+	require.Equal(t, communication.Status_WRONG_SHARD, resp.Status)
+	got, err := sharding.Decode(resp.ShardMap)
+	require.NoError(t, err)
+	require.Equal(t, shardMap, got)
+
+	/* A client with an out of date map that only knows g0 picks up the servers' map as it goes */
+	old, err := sharding.NewShardMap(1, groups[:1], 0)
+	require.NoError(t, err)
+	stale, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, old)
+	require.NoError(t, err)
+	defer stale.Close()
+	val, err := stale.Get(misrouted)
+	require.NoError(t, err)
+	require.Equal(t, misrouted, val)
+	require.Equal(t, uint64(2), stale.ShardMap().Version)
+
+	/* Servers that are behind the client are only gone by for the one call */
+	newer, err := sharding.NewShardMap(3, groups[:1], 0)
+	require.NoError(t, err)
+	ahead, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, newer)
+	require.NoError(t, err)
+	defer ahead.Close()
+	val, err = ahead.Get(misrouted)
+	require.NoError(t, err)
+	require.Equal(t, misrouted, val)
+	require.Equal(t, uint64(3), ahead.ShardMap().Version)
+
+	/* Nowhere to go */
+	lost, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, MaxRedirects: -1}, old)
+	require.NoError(t, err)
+	defer lost.Close()
+	_, err = lost.Get(misrouted)
+	require.ErrorIs(t, err, distdbclient.ErrWrongShard)
+}
+
+/* Migrate runs in the background, a run that failed is picked up again and starting it again once done is a no-op */
+func TestMigrateAsync(t *testing.T) {
+	groups := []sharding.Group{{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3157"}}, {ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3158"}}}
+	before, err := sharding.NewShardMap(1, groups[:1], 0)
+	require.NoError(t, err)
+	after, err := sharding.NewShardMap(2, groups, 0)
+	require.NoError(t, err)
+
+	g0 := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3157", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g0"})
+	var moving []byte
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, g0.Put(key, key))
+		if after.Owner(key).ID == "g1" {
+			moving = key
+		}
+	}
+	require.NotNil(t, moving)
+
+	_, err = g0.MigrationStatus(after.Version)
+	require.ErrorIs(t, err, ErrNoRebalance)
+	require.NoError(t, g0.PrepareRebalance(after))
+	_, err = g0.MigrationStatus(after.Version)
+	require.ErrorIs(t, err, ErrInvalidOperation)
+
+	/* g1 isn't up, the run fails while g0 keeps serving its keys */
+	require.NoError(t, g0.Migrate(after.Version))
+	require.Eventually(t, func() bool {
+		_, err := g0.MigrationStatus(after.Version)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	done, _ := g0.MigrationStatus(after.Version)
+	require.False(t, done)
+	val, _, err := g0.shardedGet(moving)
+	require.NoError(t, err)
+	require.Equal(t, moving, val)
+
+	/* Started again, twice at once, once g1 is up */
+	g1 := startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3158", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g1"})
+	require.NoError(t, g1.PrepareRebalance(after))
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g0.Migrate(after.Version); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool {
+		done, err := g0.MigrationStatus(after.Version)
+		return done && err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	val, _, err = g1.shardedGet(moving)
+	require.NoError(t, err)
+	require.Equal(t, moving, val)
+	_, _, err = g0.shardedGet(moving)
+	require.ErrorIs(t, err, ErrWrongShard)
+	_, err = g0.Get(moving)
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+
+	require.NoError(t, g0.Migrate(after.Version))
+	done, err = g0.MigrationStatus(after.Version)
+	require.NoError(t, err)
+	require.True(t, done)
+
+	require.NoError(t, g0.CommitRebalance(after.Version))
+	require.NoError(t, g1.CommitRebalance(after.Version))
+	done, err = g0.MigrationStatus(after.Version)
+	require.NoError(t, err)
+	require.True(t, done)
+}
+
+/* Keys keep their versions when they move to a new group, and the versions it gives them from then on are above them */
+func TestShardRebalanceCAS(t *testing.T) {
+	groups := []sharding.Group{{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3154"}}, {ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3155"}}}
+	before, err := sharding.NewShardMap(1, groups[:1], 0)
+	require.NoError(t, err)
+	after, err := sharding.NewShardMap(2, groups, 0)
+	require.NoError(t, err)
+
+	/* g1 has a follower, which has to give keys the same versions as its leader */
+	startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3154", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g0"})
+	follower := startDB(t, DBConfig{Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3156", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g1"})
+	startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3155", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g1",
+		ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3156"}}, ReplicationMode: REPLICATION_SYNC_ALL})
+
+	client, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, before)
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* Plenty of writes on g0, so that its versions are well past anything g1 has given out */
+	ctx := context.Background()
+	versions := map[string]uint64{}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, client.Put(key, key))
+		if after.Owner(key).ID == "g1" {
+			_, versions[string(key)], err = client.GetWithVersion(ctx, key)
+			require.NoError(t, err)
+		}
+	}
+	require.NotEmpty(t, versions)
+
+	require.NoError(t, client.Rebalance(ctx, after, "secret"))
+
+	var highest uint64
+	for key, version := range versions {
+		_, got, err := client.GetWithVersion(ctx, []byte(key))
+		require.NoError(t, err)
+		require.Equal(t, version, got, key)
+		if version > highest {
+			highest = version
+		}
+	}
+
+	/* A CAS by a version read before the rebalance still goes through, and only once */
+	for key, version := range versions {
+		newVersion, err := client.PutIfVersion(ctx, []byte(key), []byte("new"), version)
+		require.NoError(t, err, key)
+		require.Greater(t, newVersion, highest, key)
+		_, err = client.PutIfVersion(ctx, []byte(key), []byte("newer"), version)
+		require.ErrorIs(t, err, distdbclient.ErrConditionFailed, key)
+
+		_, followerVersion, err := follower.GetWithVersion([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, newVersion, followerVersion, key)
+	}
+}
+
+/* Keys move over to a new group while clients keep reading and writing them, and no acknowledged write is lost */
+func TestShardRebalance(t *testing.T) {
+	groups := []sharding.Group{
+		{ID: "g0", Seeds: []string{DEFAULT_SERVER_HOST + ":3134", DEFAULT_SERVER_HOST + ":3135"}},
+		{ID: "g1", Seeds: []string{DEFAULT_SERVER_HOST + ":3136"}},
+		{ID: "g2", Seeds: []string{DEFAULT_SERVER_HOST + ":3137"}},
+	}
+	before, err := sharding.NewShardMap(1, groups[:2], 0)
+	require.NoError(t, err)
+	after, err := sharding.NewShardMap(2, groups, 0)
+	require.NoError(t, err)
+
+	/* g0 is a leader and a follower, g2 starts out owning nothing */
+	leaderConfig := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3134"}
+	follower := startDB(t, DBConfig{Role: FOLLOWER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3135",
+		LeaderConfig: &leaderConfig, ReplicationToken: "secret", ShardMap: before, ShardGroup: "g0"})
+	dbs := map[string]*DB{
+		"g0": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3134", ReplicationToken: "secret",
+			ReplicaConfigs: []distdbclient.ClientConfig{{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3135"}}, ShardMap: before, ShardGroup: "g0"}),
+		"g1": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3136", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g1"}),
+		"g2": startDB(t, DBConfig{Role: LEADER, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "3137", ReplicationToken: "secret", ShardMap: before, ShardGroup: "g2"}),
+	}
+
+	client, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, before)
+	require.NoError(t, err)
+	defer client.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, client.Put(key, key))
+	}
+	require.Empty(t, dbs["g2"].Entries)
+
+	/* Writers each with their own keys, reading every write back */
+	const writers, keysPerWriter = 4, 20
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	acked := make([]map[string]int, writers)
+	for w := 0; w < writers; w++ {
+		acked[w] = map[string]int{}
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			writerClient, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}, before)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer writerClient.Close()
+
+			for n := 1; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := fmt.Sprintf("writer%d-%d", w, n%keysPerWriter)
+				val := []byte(fmt.Sprint(n))
+				if n%7 == 0 {
+					err = writerClient.Delete([]byte(key))
+					if err != nil && err.Error() == ErrKeyDoesNotExist.Error() {
+						err = nil
+					}
+					val = nil
+				} else {
+					err = writerClient.Put([]byte(key), val)
+				}
+				if err != nil {
+					t.Errorf("writing %s: %v", key, err)
+					return
+				}
+				acked[w][key] = n
+				if val == nil {
+					delete(acked[w], key)
+				}
+
+				got, err := writerClient.Get([]byte(key))
+				if val == nil && err != nil && err.Error() == ErrKeyDoesNotExist.Error() {
+					continue
+				}
+				if err != nil || !bytes.Equal(got, val) {
+					t.Errorf("reading %s back: got %q, %v, want %q", key, got, err, val)
+					return
+				}
+			}
+		}(w)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, client.Rebalance(context.Background(), after, "secret"))
+	require.Equal(t, after, client.ShardMap())
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	require.False(t, t.Failed())
+
+	/* Every node routes by the new map, and every key is on its new owner only */
+	for _, db := range []*DB{dbs["g0"], dbs["g1"], dbs["g2"], follower} {
+		require.Equal(t, after, db.ShardMap())
+	}
+	require.NotEmpty(t, dbs["g2"].Entries)
+	for id, db := range dbs {
+		for _, entry := range db.Entries {
+			require.Equal(t, id, after.Owner(entry.Key).ID, "%s on %s", entry.Key, id)
+		}
+	}
+	require.Eventually(t, func() bool { return follower.AppliedSeq() == dbs["g0"].AppliedSeq() }, time.Second, 10*time.Millisecond)
+	require.Len(t, follower.Entries, len(dbs["g0"].Entries))
+
+	fresh, err := distdbclient.NewShardedClient(distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: groups[2].Seeds}, nil)
+	require.NoError(t, err)
+	defer fresh.Close()
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		val, err := fresh.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, key, val)
+	}
+	for w := 0; w < writers; w++ {
+		for n := 0; n < keysPerWriter; n++ {
+			key := fmt.Sprintf("writer%d-%d", w, n)
+			val, err := fresh.Get([]byte(key))
+			if want, ok := acked[w][key]; ok {
+				require.NoError(t, err, key)
+				require.Equal(t, fmt.Sprint(want), string(val), key)
+			} else {
+				require.Error(t, err, key)
+			}
+		}
+	}
+
+	/* Running it again is a no-op */
+	require.NoError(t, client.Rebalance(context.Background(), after, "secret"))
+}
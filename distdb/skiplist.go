@@ -0,0 +1,88 @@
+package distdb
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+/*
+	Entries in key order, for scans. A skip list is a sorted linked list with express lanes: every node is on level 0,
+	and each one is on the level above with probability 1/SKIP_LIST_BRANCHING, so a search skips most of the list by
+	starting at the top level and dropping down whenever the next node is past what it is looking for. Inserts,
+	removals and seeks take O(log n) on average.
+
+	The list shares its entries with DB.Entries and DB.index and, like them, is guarded by db.mu.
+*/
+
+const (
+	SKIP_LIST_MAX_LEVEL = 24 /* Plenty for 4^24 entries */
+	SKIP_LIST_BRANCHING = 4
+)
+
+type skipNode struct {
+	entry *DBEntry
+	next  []*skipNode /* Next node on each level the node is on */
+}
+
+type skipList struct {
+	head  *skipNode /* Sentinel before the first entry, on every level */
+	level int       /* Levels in use */
+	rnd   *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{head: &skipNode{next: make([]*skipNode, SKIP_LIST_MAX_LEVEL)}, level: 1, rnd: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+/* The last node on each level with a key before key */
+func (l *skipList) predecessors(key []byte) [SKIP_LIST_MAX_LEVEL]*skipNode {
+	var preds [SKIP_LIST_MAX_LEVEL]*skipNode
+	node := l.head
+	for level := l.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && bytes.Compare(node.next[level].entry.Key, key) < 0 {
+			node = node.next[level]
+		}
+		preds[level] = node
+	}
+	return preds
+}
+
+/* Add entry, whose key mustn't be in the list already */
+func (l *skipList) insert(entry *DBEntry) {
+	level := 1
+	for level < SKIP_LIST_MAX_LEVEL && l.rnd.Intn(SKIP_LIST_BRANCHING) == 0 {
+		level++
+	}
+
+	preds := l.predecessors(entry.Key)
+	for ; l.level < level; l.level++ {
+		preds[l.level] = l.head
+	}
+
+	node := &skipNode{entry: entry, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = preds[i].next[i]
+		preds[i].next[i] = node
+	}
+}
+
+/* Drop key, a no-op if it isn't in the list */
+func (l *skipList) remove(key []byte) {
+	preds := l.predecessors(key)
+	node := preds[0].next[0]
+	if node == nil || !bytes.Equal(node.entry.Key, key) {
+		return
+	}
+
+	for i := range node.next {
+		preds[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+/* The first node with a key at or after key, nil if there is none */
+func (l *skipList) seek(key []byte) *skipNode {
+	return l.predecessors(key)[0].next[0]
+}
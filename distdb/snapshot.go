@@ -0,0 +1,268 @@
+package distdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	Snapshot layout:
+
+	| magic (6 bytes) | version (1 byte) | seq (8 bytes, big endian) | record | record | ...
+
+	with one PUT communication.LogRecord per live entry, framed the same way as write-ahead log records, and seq the
+	sequence number of the last write contained in the snapshot. The version floor (see cas.go) comes first if the
+	snapshot needs it.
+	Snapshots without the magic are legacy JSON dumps of the entry list (e.g. dbdump), these are still
+	loaded and then rewritten in the current format.
+
+	Compaction writes the live entries to a temporary snapshot file, atomically renames it over DiskFileName
+	and only then empties the write-ahead log. A crash at any point leaves either the old snapshot + full log
+	or the new snapshot + a log whose records are already contained in it, both of which replay to the same state.
+*/
+
+const (
+	SNAPSHOT_MAGIC              = "DKVSNP"
+	SNAPSHOT_VERSION            = 1
+	SNAPSHOT_TMP_SUFFIX         = ".tmp"
+	DEFAULT_COMPACTION_MIN_SIZE = 4 << 20
+	DEFAULT_COMPACTION_RATIO    = 1.0
+)
+
+/* Stages of a compaction, used by tests to interrupt a compaction midway */
+const (
+	_ = iota
+	COMPACTION_SNAPSHOT_WRITTEN
+	COMPACTION_SNAPSHOT_RENAMED
+)
+
+var compactionHook = func(stage int) error { return nil }
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+/* Load the snapshot at DiskFileName, legacy is true if it is still in the JSON format */
+func (db *DB) loadSnapshot() (legacy bool, err error) {
+	/* Leftover from a compaction that never made it to the rename */
+	err = os.Remove(db.config.DiskFileName + SNAPSHOT_TMP_SUFFIX)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	f, err := os.OpenFile(db.config.DiskFileName, os.O_RDONLY|os.O_CREATE, 0777)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	db.snapshotSize = info.Size()
+
+	reader := bufio.NewReader(f)
+	header, err := reader.Peek(len(SNAPSHOT_MAGIC) + 1)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	/* Anything without our magic is a legacy JSON dump */
+	if !bytes.HasPrefix(header, []byte(SNAPSHOT_MAGIC)) {
+		var entries []*DBEntry
+		decoder := json.NewDecoder(reader)
+		err = decoder.Decode(&entries)
+		if err != nil {
+			if err != io.EOF {
+				return false, err
+			}
+			/* An empty file is a fresh DB rather than something to migrate */
+			return false, nil
+		}
+
+		for _, entry := range entries {
+			db.insert(entry)
+		}
+		return true, nil
+	}
+
+	if len(header) < len(SNAPSHOT_MAGIC)+1 {
+		return false, fmt.Errorf("%w: %s: short header", ErrInvalidSnapshot, db.config.DiskFileName)
+	}
+	version := header[len(SNAPSHOT_MAGIC)]
+	if version != SNAPSHOT_VERSION {
+		return false, fmt.Errorf("%w: %s: unsupported version %d", ErrInvalidSnapshot, db.config.DiskFileName, version)
+	}
+	reader.Discard(len(header))
+
+	seq := make([]byte, 8)
+	if _, err := io.ReadFull(reader, seq); err != nil {
+		return false, fmt.Errorf("%w: %s: short header", ErrInvalidSnapshot, db.config.DiskFileName)
+	}
+	db.seq = binary.BigEndian.Uint64(seq)
+	offset := int64(len(header) + len(seq))
+
+	records := &countingReader{r: reader}
+	for {
+		payload, err := readRecord(records, info.Size()-offset-records.n)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			/* Snapshots are renamed into place only once complete, so unlike the log there is no torn tail to forgive */
+			return false, fmt.Errorf("%w: %s: %v", ErrInvalidSnapshot, db.config.DiskFileName, err)
+		}
+
+		record, err := decodeLogRecord(payload)
+		if err != nil {
+			return false, err
+		}
+		err = db.apply(record)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+/* Compact the write-ahead log into a fresh snapshot */
+func (db *DB) Compact() error {
+	if !db.config.Persist {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compact()
+}
+
+/* Call this only with db.Mutex held */
+func (db *DB) maybeCompact() {
+	if !db.config.Persist {
+		return
+	}
+
+	minSize, ratio := db.config.CompactionMinSize, db.config.CompactionRatio
+	if minSize <= 0 {
+		minSize = DEFAULT_COMPACTION_MIN_SIZE
+	}
+	if ratio <= 0 {
+		ratio = DEFAULT_COMPACTION_RATIO
+	}
+
+	if db.wal.size < minSize || float64(db.wal.size) < ratio*float64(db.snapshotSize) {
+		return
+	}
+
+	/* The triggering write is already durable in the log, a failed compaction is retried on the next write */
+	err := db.compact()
+	if err != nil {
+		fmt.Printf("\nError compacting %s: %v", db.config.DiskFileName, err)
+	}
+}
+
+/* Call this only with db.Mutex held */
+func (db *DB) compact() error {
+	tmpName := db.config.DiskFileName + SNAPSHOT_TMP_SUFFIX
+	size, err := writeSnapshot(tmpName, db.Entries, db.seq, db.versionFloor)
+	if err != nil {
+		return err
+	}
+	if err := compactionHook(COMPACTION_SNAPSHOT_WRITTEN); err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, db.config.DiskFileName)
+	if err != nil {
+		return err
+	}
+	err = syncDir(filepath.Dir(db.config.DiskFileName))
+	if err != nil {
+		return err
+	}
+	if err := compactionHook(COMPACTION_SNAPSHOT_RENAMED); err != nil {
+		return err
+	}
+
+	err = db.wal.reset()
+	if err != nil {
+		return err
+	}
+	db.snapshotSize = size
+
+	return nil
+}
+
+/* Write entries, as of sequence number seq and version floor floor, to fileName and fsync it, returns the size of the snapshot */
+func writeSnapshot(fileName string, entries []*DBEntry, seq, floor uint64) (int64, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	writer := bufio.NewWriter(f)
+	header := append([]byte(SNAPSHOT_MAGIC), SNAPSHOT_VERSION)
+	header = binary.BigEndian.AppendUint64(header, seq)
+	_, err = writer.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	writeRecord := func(record *communication.LogRecord) error {
+		payload, err := encodeLogRecord(record)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(frameRecord(payload))
+		return err
+	}
+
+	if record := versionFloorRecord(floor, seq); record != nil {
+		if err := writeRecord(record); err != nil {
+			return 0, err
+		}
+	}
+	for _, entry := range entries {
+		if err := writeRecord(entryRecord(entry)); err != nil {
+			return 0, err
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+/* fsync a directory so that a rename inside it is durable */
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,121 @@
+package distdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+	config := DBConfig{Persist: true, Role: LEADER, DiskFileName: fileName, CompactionMinSize: 512, CompactionRatio: 1}
+	db, err := NewDB(config)
+	require.NoError(t, err)
+
+	/* Keep overwriting a handful of hot keys, the log should never grow far past the threshold */
+	for i := 0; i < 500; i++ {
+		err := db.Put([]byte(fmt.Sprintf("key%d", i%5)), []byte(fmt.Sprintf("val%d", i)))
+		require.NoError(t, err)
+	}
+	info, err := os.Stat(fileName + WAL_FILE_SUFFIX)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(1024))
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(config)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 495; i < 500; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", i%5)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val%d", i)), v)
+	}
+}
+
+/* Kill compaction at each stage and check that reopening recovers every write */
+func TestCompactionInterrupted(t *testing.T) {
+	errKilled := errors.New("compaction killed")
+	defer func() { compactionHook = func(stage int) error { return nil } }()
+
+	for _, stage := range []int{COMPACTION_SNAPSHOT_WRITTEN, COMPACTION_SNAPSHOT_RENAMED} {
+		t.Run(fmt.Sprintf("stage=%d", stage), func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "dbdump")
+			config := DBConfig{Persist: true, Role: LEADER, DiskFileName: fileName}
+			db, err := NewDB(config)
+			require.NoError(t, err)
+
+			for i := 0; i < 10; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("old")))
+			}
+			require.NoError(t, db.Compact())
+			for i := 0; i < 5; i++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("new")))
+			}
+
+			compactionHook = func(s int) error {
+				if s == stage {
+					return errKilled
+				}
+				return nil
+			}
+			require.ErrorIs(t, db.Compact(), errKilled)
+			compactionHook = func(stage int) error { return nil }
+
+			/* Abandon the DB as if the process died here */
+			require.NoError(t, db.Close())
+
+			db, err = NewDB(config)
+			require.NoError(t, err)
+			defer db.Close()
+			for i := 0; i < 10; i++ {
+				want := []byte("old")
+				if i < 5 {
+					want = []byte("new")
+				}
+				v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Equal(t, want, v)
+			}
+
+			_, err = os.Stat(fileName + SNAPSHOT_TMP_SUFFIX)
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+/* A legacy JSON dump should be loaded and rewritten in the protobuf format */
+func TestLegacyMigration(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dbdump")
+	err := os.WriteFile(fileName, []byte(`[{"Key":"a2V5MQ==","Val":"dmFsMQ=="},{"Key":"a2V5Mg==","Val":"dmFsMg=="}]`), 0777)
+	require.NoError(t, err)
+
+	verify := func() {
+		config := DBConfig{Persist: true, Role: LEADER, DiskFileName: fileName}
+		db, err := NewDB(config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		v, err := db.Get([]byte("key1"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val1"), v)
+		v, err = db.Get([]byte("key2"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val2"), v)
+	}
+
+	verify()
+
+	/* Both files should now be in the protobuf format */
+	snapshot, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte(SNAPSHOT_MAGIC), SNAPSHOT_VERSION), snapshot[:len(SNAPSHOT_MAGIC)+1])
+	log, err := os.ReadFile(fileName + WAL_FILE_SUFFIX)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte(WAL_MAGIC), WAL_VERSION), log)
+
+	verify()
+}
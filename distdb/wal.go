@@ -0,0 +1,280 @@
+package distdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Write-ahead log layout:
+
+	| magic (6 bytes) | version (1 byte) | record | record | ...
+
+	where each record is
+
+	| payload length (4 bytes, big endian) | crc32c of payload (4 bytes, big endian) | payload |
+
+	and payloads are protobuf encoded communication.LogRecord messages.
+
+	Records are only ever appended, a crash mid-append leaves a torn record at the tail which is
+	detected (short read, a length running past the end of the file or a checksum mismatch on the last record) and
+	truncated away the next time the log is opened. A bad record with more records after it can't be a torn append,
+	the log is refused rather than lose the acknowledged writes that follow it.
+*/
+
+const (
+	WAL_FILE_SUFFIX = ".wal"
+	WAL_MAGIC       = "DKVWAL"
+	WAL_VERSION     = 1
+
+	/* Version of the communication.LogRecord messages we write */
+	LOG_RECORD_VERSION = 1
+
+	walHeaderLen       = len(WAL_MAGIC) + 1
+	walRecordHeaderLen = 8
+)
+
+var ErrInvalidWAL = errors.New("invalid write-ahead log")
+var ErrInvalidWALRecord = errors.New("invalid write-ahead log record")
+var errRecordPastEnd = fmt.Errorf("%w: record runs past the end of the file", ErrInvalidWALRecord)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type wal struct {
+	f      *os.File
+	size   int64 /* Offset at which the next record will be appended */
+	closed bool
+}
+
+/* Open (or create) the log at fileName and validate its header, the log must be replayed before appending to it */
+func openWAL(fileName string) (*wal, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	/* Fresh log, write the header */
+	if info.Size() == 0 {
+		w := &wal{f: f}
+		if err := w.reset(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+
+	header := make([]byte, walHeaderLen)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: short header", ErrInvalidWAL, fileName)
+	}
+	if !bytes.Equal(header[:len(WAL_MAGIC)], []byte(WAL_MAGIC)) {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: bad magic", ErrInvalidWAL, fileName)
+	}
+	version := header[len(WAL_MAGIC)]
+	if version != WAL_VERSION {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: unsupported version %d", ErrInvalidWAL, fileName, version)
+	}
+
+	return &wal{f: f, size: int64(walHeaderLen)}, nil
+}
+
+/* Call fn on every intact record in order, a torn tail is truncated (see tornTail) */
+func (w *wal) replay(fn func(record *communication.LogRecord) error) error {
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(int64(walHeaderLen), io.SeekStart); err != nil {
+		return err
+	}
+
+	offset := int64(walHeaderLen)
+	reader := &countingReader{r: bufio.NewReader(w.f)}
+	for {
+		payload, err := readRecord(reader, info.Size()-offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if tornTail(err, int64(walHeaderLen)+reader.n, info.Size()) {
+				fmt.Printf("\nTruncating torn write-ahead log tail at offset %d: %v", offset, err)
+				break
+			}
+			return fmt.Errorf("%w: %s at offset %d: %v", ErrInvalidWAL, w.f.Name(), offset, err)
+		}
+
+		record, err := decodeLogRecord(payload)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+		offset = int64(walHeaderLen) + reader.n
+	}
+
+	/* Drop everything after the last intact record so that new records are appended right after it */
+	if err := w.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = offset
+
+	return nil
+}
+
+/* Append a record and fsync it, the record is durable once this returns without error */
+func (w *wal) append(record *communication.LogRecord) error {
+	payload, err := encodeLogRecord(record)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.f.Write(frameRecord(payload))
+	if err != nil {
+		/* Don't leave a partial record behind for the next append to follow */
+		w.f.Truncate(w.size)
+		w.f.Seek(w.size, io.SeekStart)
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(n)
+
+	return nil
+}
+
+/* Drop every record and start over with a fresh header, called once the records have made it into a snapshot */
+func (w *wal) reset() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := append([]byte(WAL_MAGIC), WAL_VERSION)
+	if _, err := w.f.Write(header); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.size = int64(walHeaderLen)
+
+	return nil
+}
+
+/* fsync and close, closing more than once is a no-op */
+func (w *wal) close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+/* | payload length | crc32c | payload | framing shared by the log and snapshots */
+func frameRecord(payload []byte) []byte {
+	record := make([]byte, walRecordHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[walRecordHeaderLen:], payload)
+	return record
+}
+
+/*
+	Read the next framed record, remaining is how many bytes r has left. A length that runs past them can only be torn
+	or corrupt, and is reported as errRecordPastEnd (an ErrInvalidWALRecord) rather than trusted with an allocation.
+*/
+func readRecord(r io.Reader, remaining int64) ([]byte, error) {
+	header := make([]byte, walRecordHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	payloadLen := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if int64(payloadLen) > remaining-int64(walRecordHeaderLen) {
+		return nil, fmt.Errorf("%w: length %d", errRecordPastEnd, payloadLen)
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidWALRecord)
+	}
+
+	return payload, nil
+}
+
+/*
+	Whether err reading a record, with read of the file's size bytes read by then, is what a crash mid-append leaves
+	behind: a record cut short or running past the end of the file, or one failing its checksum as the last thing in it.
+*/
+func tornTail(err error, read, size int64) bool {
+	return err == io.ErrUnexpectedEOF || errors.Is(err, errRecordPastEnd) || (errors.Is(err, ErrInvalidWALRecord) && read == size)
+}
+
+func encodeLogRecord(record *communication.LogRecord) ([]byte, error) {
+	/* Records may be shared with concurrent readers (e.g. raft replication), only write to them if we must */
+	if record.Version != LOG_RECORD_VERSION {
+		record.Version = LOG_RECORD_VERSION
+	}
+	return proto.Marshal(record)
+}
+
+func decodeLogRecord(payload []byte) (*communication.LogRecord, error) {
+	var record communication.LogRecord
+	err := proto.Unmarshal(payload, &record)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWALRecord, err)
+	}
+	if record.Version > LOG_RECORD_VERSION {
+		return nil, fmt.Errorf("%w: unsupported record version %d", ErrInvalidWALRecord, record.Version)
+	}
+
+	return &record, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
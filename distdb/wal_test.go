@@ -0,0 +1,147 @@
+package distdb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALAppendReplay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db"+WAL_FILE_SUFFIX)
+	records := []*communication.LogRecord{putRecord("k1", "v1"), putRecord("k2", ""), putRecord("k1", "v3")}
+
+	w, err := openWAL(fileName)
+	require.NoError(t, err)
+	require.NoError(t, w.replay(func(record *communication.LogRecord) error { return nil }))
+	for _, record := range records {
+		require.NoError(t, w.append(record))
+	}
+	require.NoError(t, w.close())
+
+	/* Reopen and check that every record comes back in order */
+	requireRecordsEqual(t, records, replayAll(t, fileName))
+}
+
+func TestWALTornTail(t *testing.T) {
+	records := []*communication.LogRecord{putRecord("k1", "v1"), putRecord("k2", "v2"), putRecord("k3", "v3")}
+	lastPayload, err := encodeLogRecord(records[2])
+	require.NoError(t, err)
+
+	tcs := []struct {
+		name string
+		tear func(t *testing.T, fileName string)
+	}{
+		{name: "partial record header", tear: func(t *testing.T, fileName string) {
+			truncateBy(t, fileName, int64(len(lastPayload)+walRecordHeaderLen-2))
+		}},
+		{name: "partial payload", tear: func(t *testing.T, fileName string) { truncateBy(t, fileName, 1) }},
+		{name: "checksum mismatch", tear: func(t *testing.T, fileName string) {
+			data, err := os.ReadFile(fileName)
+			require.NoError(t, err)
+			data[len(data)-1] ^= 0xff
+			require.NoError(t, os.WriteFile(fileName, data, 0777))
+		}},
+		{name: "length past the end of the file", tear: func(t *testing.T, fileName string) {
+			data, err := os.ReadFile(fileName)
+			require.NoError(t, err)
+			binary.BigEndian.PutUint32(data[len(data)-len(lastPayload)-walRecordHeaderLen:], 0xffffffff)
+			require.NoError(t, os.WriteFile(fileName, data, 0777))
+		}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "db"+WAL_FILE_SUFFIX)
+			w, err := openWAL(fileName)
+			require.NoError(t, err)
+			for _, record := range records {
+				require.NoError(t, w.append(record))
+			}
+			require.NoError(t, w.close())
+
+			/* Only the torn record is lost */
+			tc.tear(t, fileName)
+			requireRecordsEqual(t, records[:2], replayAll(t, fileName))
+
+			/* Appends after recovery land right after the last intact record */
+			w, err = openWAL(fileName)
+			require.NoError(t, err)
+			require.NoError(t, w.replay(func(record *communication.LogRecord) error { return nil }))
+			require.NoError(t, w.append(records[2]))
+			require.NoError(t, w.close())
+			requireRecordsEqual(t, records, replayAll(t, fileName))
+		})
+	}
+}
+
+/* A bad record with intact ones after it isn't a torn append, truncating it would lose the writes after it */
+func TestWALCorruptMiddle(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db"+WAL_FILE_SUFFIX)
+	w, err := openWAL(fileName)
+	require.NoError(t, err)
+	for _, record := range []*communication.LogRecord{putRecord("k1", "v1"), putRecord("k2", "v2"), putRecord("k3", "v3")} {
+		require.NoError(t, w.append(record))
+	}
+	require.NoError(t, w.close())
+
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	data[walHeaderLen+walRecordHeaderLen] ^= 0xff
+	require.NoError(t, os.WriteFile(fileName, data, 0777))
+
+	w, err = openWAL(fileName)
+	require.NoError(t, err)
+	defer w.close()
+	err = w.replay(func(record *communication.LogRecord) error { return nil })
+	require.ErrorIs(t, err, ErrInvalidWAL)
+
+	/* Nothing was truncated */
+	info, err := os.Stat(fileName)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), info.Size())
+}
+
+func TestWALBadHeader(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db"+WAL_FILE_SUFFIX)
+	require.NoError(t, os.WriteFile(fileName, []byte("not a log"), 0777))
+
+	_, err := openWAL(fileName)
+	require.ErrorIs(t, err, ErrInvalidWAL)
+}
+
+func putRecord(k, v string) *communication.LogRecord {
+	return &communication.LogRecord{Op: communication.Operation_PUT, Key: []byte(k), Val: []byte(v)}
+}
+
+func requireRecordsEqual(t *testing.T, want, got []*communication.LogRecord) {
+	require.Len(t, got, len(want))
+	for i := range want {
+		require.Equal(t, want[i].Op, got[i].Op)
+		require.Equal(t, string(want[i].Key), string(got[i].Key))
+		require.Equal(t, string(want[i].Val), string(got[i].Val))
+	}
+}
+
+func replayAll(t *testing.T, fileName string) []*communication.LogRecord {
+	w, err := openWAL(fileName)
+	require.NoError(t, err)
+	defer w.close()
+
+	var records []*communication.LogRecord
+	err = w.replay(func(record *communication.LogRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	require.NoError(t, err)
+	return records
+}
+
+func truncateBy(t *testing.T, fileName string, n int64) {
+	info, err := os.Stat(fileName)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(fileName, info.Size()-n))
+}
@@ -0,0 +1,85 @@
+package distdbclient
+
+import (
+	"context"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/* PUTs and DELETEs to be written together with WriteBatch. The zero value is an empty batch, ready to use */
+type Batch struct {
+	records []*communication.LogRecord
+}
+
+func (b *Batch) Put(key, val []byte) {
+	b.records = append(b.records, &communication.LogRecord{Op: communication.Operation_PUT, Key: key, Val: val})
+}
+
+/* Delete key, a no-op if it doesn't exist when the batch is applied */
+func (b *Batch) Delete(key []byte) {
+	b.records = append(b.records, &communication.LogRecord{Op: communication.Operation_DELETE, Key: key})
+}
+
+/* Writes in the batch */
+func (b *Batch) Len() int {
+	return len(b.records)
+}
+
+func (b *Batch) request() (*communication.Request, error) {
+	req := communication.Request{Op: communication.Operation_BATCH}
+	for _, record := range b.records {
+		data, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		req.Records = append(req.Records, data)
+	}
+	if len(b.records) > 0 {
+		req.Key = b.records[0].Key /* Routed by, see ShardedClient */
+	}
+	return &req, nil
+}
+
+/* Apply every write in batch atomically in a single round trip, later writes to a key win over earlier ones */
+func (c *Client) WriteBatch(ctx context.Context, batch *Batch) error {
+	req, err := batch.request()
+	if err != nil {
+		return err
+	}
+	response, err := c.DoContext(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return responseError(response)
+}
+
+/*
+	Apply every write in batch atomically, see Client.WriteBatch. Batches can't span groups: every key has to belong to
+	the same one, or ErrWrongShard is returned. While a rebalance is moving some of the keys they are written to their new
+	owner first, and the batch is only atomic at each group on its own.
+*/
+func (sc *ShardedClient) WriteBatch(ctx context.Context, batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	shardMap := sc.ShardMap()
+	group := shardMap.Owner(batch.records[0].Key).ID
+	for _, record := range batch.records[1:] {
+		if shardMap.Owner(record.Key).ID != group {
+			return ErrWrongShard
+		}
+	}
+
+	req, err := batch.request()
+	if err != nil {
+		return err
+	}
+	response, err := sc.DoContext(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return responseError(response)
+}
@@ -0,0 +1,86 @@
+package distdbclient
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	Optimistic updates: read a key along with its version with GetWithVersion, and write it back with PutIfVersion,
+	which fails with ErrConditionFailed if anyone wrote the key in between. Versions are only meaningful compared with
+	each other for the same key (see the distdb package for what they are).
+*/
+
+var ErrConditionFailed = errors.New("condition failed")
+
+type doFunc func(ctx context.Context, req *communication.Request) (*communication.Response, error)
+
+/* Get along with key's version */
+func (c *Client) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	return getWithVersion(ctx, c.DoContext, key)
+}
+
+/* Put key if it is at version, returning its new version. ErrConditionFailed if it isn't, or doesn't exist */
+func (c *Client) PutIfVersion(ctx context.Context, key, val []byte, version uint64) (uint64, error) {
+	return compareAndSwap(ctx, c.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VERSION_EQUALS, ExpectedVersion: version})
+}
+
+/* Put key if it doesn't exist, returning its version. ErrConditionFailed if it does */
+func (c *Client) PutIfAbsent(ctx context.Context, key, val []byte) (uint64, error) {
+	return compareAndSwap(ctx, c.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_ABSENT})
+}
+
+/* Put key if its value is expected, returning its new version. ErrConditionFailed if it isn't, or doesn't exist */
+func (c *Client) PutIfValue(ctx context.Context, key, val, expected []byte) (uint64, error) {
+	return compareAndSwap(ctx, c.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VALUE_EQUALS, ExpectedVal: expected})
+}
+
+/* See Client.GetWithVersion */
+func (sc *ShardedClient) GetWithVersion(ctx context.Context, key []byte) ([]byte, uint64, error) {
+	return getWithVersion(ctx, sc.DoContext, key)
+}
+
+/* See Client.PutIfVersion */
+func (sc *ShardedClient) PutIfVersion(ctx context.Context, key, val []byte, version uint64) (uint64, error) {
+	return compareAndSwap(ctx, sc.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VERSION_EQUALS, ExpectedVersion: version})
+}
+
+/* See Client.PutIfAbsent */
+func (sc *ShardedClient) PutIfAbsent(ctx context.Context, key, val []byte) (uint64, error) {
+	return compareAndSwap(ctx, sc.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_ABSENT})
+}
+
+/* See Client.PutIfValue */
+func (sc *ShardedClient) PutIfValue(ctx context.Context, key, val, expected []byte) (uint64, error) {
+	return compareAndSwap(ctx, sc.DoContext, &communication.Request{Op: communication.Operation_CAS, Key: key, Val: val, Condition: communication.Condition_VALUE_EQUALS, ExpectedVal: expected})
+}
+
+func getWithVersion(ctx context.Context, do doFunc, key []byte) ([]byte, uint64, error) {
+	response, err := do(ctx, &communication.Request{Key: key, Op: communication.Operation_GET})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = responseError(response)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return response.Val, response.Version, nil
+}
+
+func compareAndSwap(ctx context.Context, do doFunc, req *communication.Request) (uint64, error) {
+	response, err := do(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	err = responseError(response)
+	if err != nil {
+		return 0, err
+	}
+
+	return response.Version, nil
+}
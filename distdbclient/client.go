@@ -1,9 +1,13 @@
 package distdbclient
 
 import (
+	"context"
 	"errors"
-	"net"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
 	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
 	"google.golang.org/protobuf/proto"
 )
@@ -12,103 +16,413 @@ const (
 	SERVER_PROTOCOL = "tcp"
 	SERVER_HOST     = "localhost"
 	SERVER_PORT     = "3108"
+
+	DEFAULT_DIAL_TIMEOUT          = 5 * time.Second
+	DEFAULT_READ_TIMEOUT          = 10 * time.Second
+	DEFAULT_WRITE_TIMEOUT         = 5 * time.Second
+	DEFAULT_POOL_SIZE             = 1
+	DEFAULT_HEALTH_CHECK_INTERVAL = 10 * time.Second
+	DEFAULT_RECONNECT_BASE_DELAY  = 50 * time.Millisecond
+	DEFAULT_RECONNECT_MAX_DELAY   = 5 * time.Second
+	DEFAULT_RECONNECT_ATTEMPTS    = 3
+	DEFAULT_MAX_REDIRECTS         = 8
+	DEFAULT_SCAN_PAGE_SIZE        = 100
 )
 
 var ErrInvalidOperation = errors.New("invalid operation")
+var ErrConnectionClosed = errors.New("connection to server closed")
+var ErrTimeout = errors.New("timed out")
+var ErrClientClosed = errors.New("client closed")
+var ErrUnhealthy = errors.New("connection failed health check")
+var ErrNotLeader = errors.New("not the leader")
+var ErrNoRequestPending = errors.New("no request waiting on a response")
 
 type ClientConfig struct {
 	ServerProtocol string
 	ServerHost     string
 	ServerPort     string
+	MaxMessageSize int           /* Largest request or response in bytes, defaults to framing.DEFAULT_MAX_MESSAGE_SIZE */
+	DialTimeout    time.Duration /* Defaults to DEFAULT_DIAL_TIMEOUT */
+	ReadTimeout    time.Duration /* How long a call waits for its response, defaults to DEFAULT_READ_TIMEOUT */
+	WriteTimeout   time.Duration /* How long a call may take to write its request, defaults to DEFAULT_WRITE_TIMEOUT */
+
+	PoolSize            int           /* Connections kept to the server, defaults to DEFAULT_POOL_SIZE */
+	HealthCheckInterval time.Duration /* How often connections are pinged, defaults to DEFAULT_HEALTH_CHECK_INTERVAL, negative disables */
+	ReconnectBaseDelay  time.Duration /* Backoff after the first failed reconnect, doubled on every failure after, defaults to DEFAULT_RECONNECT_BASE_DELAY */
+	ReconnectMaxDelay   time.Duration /* Cap on the backoff, defaults to DEFAULT_RECONNECT_MAX_DELAY */
+	ReconnectAttempts   int           /* Dials a single call makes before giving up, defaults to DEFAULT_RECONNECT_ATTEMPTS */
+	LazyConnect         bool          /* Don't dial in NewClient, connect on the first call instead */
+
+	Seeds        []string /* host:port of nodes in the cluster, used instead of ServerHost:ServerPort if set. The leader is found among them, see cluster */
+	StaleReads   bool     /* Spread GETs and scans over every seed, followers may answer them with stale values (if they allow it, see distdb.DBConfig.FollowerReads) */
+	MaxRedirects int      /* NOT_LEADER redirects and unreachable nodes a call moves on from before giving up, defaults to DEFAULT_MAX_REDIRECTS, negative disables */
+	ScanPageSize int      /* Entries a Scan fetches per request, defaults to DEFAULT_SCAN_PAGE_SIZE */
+}
+
+/* Returned when a dial, write or read runs past its timeout or the caller's deadline, matches ErrTimeout with errors.Is */
+type TimeoutError struct {
+	Op    string /* "dial", "write" or "read" */
+	Cause error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, ErrTimeout, e.Cause)
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Cause
+}
+
+/* Returned when a request the server's role doesn't allow is sent to a follower and the leader couldn't be found within MaxRedirects, matches ErrNotLeader with errors.Is */
+type NotLeaderError struct {
+	Leader string /* host:port of the leader, empty if the follower doesn't know it */
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return ErrNotLeader.Error()
+	}
+	return fmt.Sprintf("%s, leader is %s", ErrNotLeader, e.Leader)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+/* The error a response carries, nil if it succeeded */
+func responseError(response *communication.Response) error {
+	switch response.Status {
+	case communication.Status_FAILURE:
+		return errors.New(response.Error)
+	case communication.Status_NOT_LEADER:
+		return &NotLeaderError{Leader: response.Leader}
+	case communication.Status_WRONG_SHARD:
+		return ErrWrongShard
+	case communication.Status_CONDITION_FAILED:
+		return ErrConditionFailed
+	}
+	return nil
+}
+
+func (config ClientConfig) withDefaults() ClientConfig {
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = DEFAULT_READ_TIMEOUT
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DEFAULT_WRITE_TIMEOUT
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = DEFAULT_POOL_SIZE
+	}
+	if config.HealthCheckInterval == 0 {
+		config.HealthCheckInterval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if config.ReconnectBaseDelay <= 0 {
+		config.ReconnectBaseDelay = DEFAULT_RECONNECT_BASE_DELAY
+	}
+	if config.ReconnectMaxDelay <= 0 {
+		config.ReconnectMaxDelay = DEFAULT_RECONNECT_MAX_DELAY
+	}
+	if config.ReconnectAttempts <= 0 {
+		config.ReconnectAttempts = DEFAULT_RECONNECT_ATTEMPTS
+	}
+	if config.MaxRedirects == 0 {
+		config.MaxRedirects = DEFAULT_MAX_REDIRECTS
+	}
+	if config.ScanPageSize <= 0 {
+		config.ScanPageSize = DEFAULT_SCAN_PAGE_SIZE
+	}
+	return config
 }
+
+/*
+	A Client is safe for concurrent use. Calls go to the cluster's leader (see cluster) and are spread over a pool of
+	connections to it (see pool), each of which pipelines requests from multiple goroutines, and broken connections are
+	transparently redialled.
+*/
 type Client struct {
-	serverConn net.Conn
-	config     ClientConfig
+	config  ClientConfig
+	cluster *cluster
+
+	mu        *sync.Mutex
+	requested []*requested /* Requests made with MakeRequest whose responses RcvResponse hasn't returned yet, oldest first */
+}
+
+/* A request made with MakeRequest, waiting on its response */
+type requested struct {
+	conn   *conn
+	id     uint64
+	respCh chan *communication.Response
 }
 
 func NewClient(config ClientConfig) (*Client, error) {
-	serverConn, err := net.Dial(config.ServerProtocol, config.ServerHost+":"+config.ServerPort)
-	if err != nil {
+	config = config.withDefaults()
+	c := &Client{config: config, cluster: newCluster(config), mu: &sync.Mutex{}}
+
+	/* Fail fast if none of the servers are there, unless asked not to */
+	if !config.LazyConnect {
+		var err error
+		for _, addr := range c.cluster.seeds {
+			err = c.connect(addr)
+			if err == nil {
+				c.cluster.redirect(c.cluster.leaderAddr(), addr)
+				return c, nil
+			}
+		}
+		c.cluster.close()
 		return nil, err
 	}
 
-	return &Client{serverConn: serverConn, config: config}, nil
+	return c, nil
+}
+
+func (c *Client) connect(addr string) error {
+	p, err := c.cluster.pool(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.DialTimeout)
+	defer cancel()
+	_, err = p.connect(ctx, p.slots[0], 1)
+	return err
+}
+
+/* host:port of the node calls currently go to, the leader as far as we know */
+func (c *Client) Leader() string {
+	return c.cluster.leaderAddr()
 }
 
 func (c *Client) Get(key []byte) ([]byte, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+func (c *Client) GetContext(ctx context.Context, key []byte) ([]byte, error) {
 	req := communication.Request{Key: key, Op: communication.Operation_GET}
-	err := c.MakeRequest(&req)
+	response, err := c.DoContext(ctx, &req)
 	if err != nil {
 		return nil, err
 	}
 
-	respData, err := c.RcvResponse()
+	err = responseError(response)
 	if err != nil {
 		return nil, err
 	}
 
-	var response communication.Response
-	err = proto.Unmarshal(respData, &response)
+	return response.Val, nil
+}
+
+func (c *Client) Put(key, val []byte) error {
+	return c.PutContext(context.Background(), key, val)
+}
+
+func (c *Client) PutContext(ctx context.Context, key, val []byte) error {
+	req := communication.Request{Key: key, Val: val, Op: communication.Operation_PUT}
+	response, err := c.DoContext(ctx, &req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if response.Status == communication.Status_FAILURE {
-		return nil, errors.New(response.Error)
-	}
+	return responseError(response)
+}
 
-	return response.Val, err
+func (c *Client) Delete(key []byte) error {
+	return c.DeleteContext(context.Background(), key)
 }
 
-func (c *Client) Put(key, val []byte) error {
-	req := communication.Request{Key: key, Val: val, Op: communication.Operation_PUT}
-	err := c.MakeRequest(&req)
+func (c *Client) DeleteContext(ctx context.Context, key []byte) error {
+	req := communication.Request{Key: key, Op: communication.Operation_DELETE}
+	response, err := c.DoContext(ctx, &req)
 	if err != nil {
 		return err
 	}
 
-	respData, err := c.RcvResponse()
+	return responseError(response)
+}
+
+/* Add node id, listening on host:port addr, to the server's raft cluster. token is the cluster's replication secret */
+func (c *Client) AddMember(ctx context.Context, id, addr, token string) error {
+	req := communication.Request{Key: []byte(id), Val: []byte(addr), Token: token, Op: communication.Operation_ADD_MEMBER}
+	response, err := c.DoContext(ctx, &req)
 	if err != nil {
 		return err
 	}
 
-	var response communication.Response
-	err = proto.Unmarshal(respData, &response)
+	return responseError(response)
+}
+
+/* Remove node id from the server's raft cluster. token is the cluster's replication secret */
+func (c *Client) RemoveMember(ctx context.Context, id, token string) error {
+	req := communication.Request{Key: []byte(id), Token: token, Op: communication.Operation_REMOVE_MEMBER}
+	response, err := c.DoContext(ctx, &req)
 	if err != nil {
 		return err
 	}
 
-	if response.Status == communication.Status_FAILURE {
-		return errors.New(response.Error)
+	return responseError(response)
+}
+
+/*
+	Compare the server, a follower, with its leader. Returns how they differ, after taking the leader's entries for the
+	keys that do if repair is set. token is the cluster's replication secret
+*/
+func (c *Client) CheckReplica(ctx context.Context, repair bool, token string) (*communication.Divergence, error) {
+	req := communication.Request{Op: communication.Operation_CHECK_REPLICA, Repair: repair, Token: token}
+	response, err := c.DoContext(ctx, &req)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	err = responseError(response)
+	if err != nil {
+		return nil, err
+	}
+
+	var divergence communication.Divergence
+	err = proto.Unmarshal(response.Divergence, &divergence)
+	if err != nil {
+		return nil, err
+	}
+	return &divergence, nil
 }
 
+func (c *Client) Do(req *communication.Request) (*communication.Response, error) {
+	return c.DoContext(context.Background(), req)
+}
+
+/*
+	Send req and wait for its response, errors are only returned if no response was received.
+	A request that never made it onto the wire because its connection broke is retried once on a fresh connection.
+	NOT_LEADER responses and unreachable nodes are moved on from up to MaxRedirects times (see cluster), after which
+	the last response or error is returned.
+*/
+func (c *Client) DoContext(ctx context.Context, req *communication.Request) (*communication.Response, error) {
+	read := req.Op == communication.Operation_GET || req.Op == communication.Operation_MGET || req.Op == communication.Operation_SCAN || req.Op == communication.Operation_PREFIX_SCAN
+	stale := c.config.StaleReads && read
+	for redirects := 0; ; redirects++ {
+		addr := c.cluster.leaderAddr()
+		if stale {
+			addr = c.cluster.readAddr()
+		}
+
+		resp, sent, err := c.doOn(ctx, addr, req)
+		unreachable := err != nil && !sent && ctx.Err() == nil && len(c.cluster.seeds) > 1 &&
+			!errors.Is(err, ErrClientClosed) && !errors.Is(err, framing.ErrMessageTooLarge)
+		notLeader := err == nil && resp.Status == communication.Status_NOT_LEADER
+		if (!unreachable && !notLeader) || redirects >= c.config.MaxRedirects {
+			return resp, err
+		}
+
+		/* The next read goes to the next seed anyway, unless this one doesn't serve stale reads at all */
+		if stale && unreachable {
+			continue
+		}
+		stale = false
+
+		/* Straight over to the leader if we were told where it is, otherwise give the cluster a moment */
+		if notLeader && resp.Leader != "" && resp.Leader != addr {
+			c.cluster.redirect(addr, resp.Leader)
+			continue
+		}
+		c.cluster.redirect(addr, "")
+		timer := time.NewTimer(backoff(c.config.ReconnectBaseDelay, c.config.ReconnectMaxDelay, redirects+1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, contextError(ctx.Err(), "redirect")
+		case <-timer.C:
+		}
+	}
+}
+
+/* Send req to node addr */
+func (c *Client) doOn(ctx context.Context, addr string, req *communication.Request) (resp *communication.Response, sent bool, err error) {
+	p, err := c.cluster.pool(addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var cn *conn
+		cn, err = p.get(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		resp, sent, err = cn.do(ctx, req)
+		if err == nil {
+			return resp, true, nil
+		}
+		if sent || ctx.Err() != nil || errors.Is(err, framing.ErrMessageTooLarge) {
+			return nil, sent, err
+		}
+	}
+
+	return nil, false, err
+}
+
+/* Send req to the leader without waiting for its response, RcvResponse returns it */
 func (c *Client) MakeRequest(req *communication.Request) error {
-	data, err := proto.Marshal(req)
+	p, err := c.cluster.pool(c.cluster.leaderAddr())
+	if err != nil {
+		return err
+	}
+	cn, err := p.get(context.Background())
 	if err != nil {
 		return err
 	}
 
-	return c.Send(data)
+	/* Held while sending, so requests queue up for RcvResponse in the order they went out */
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	respCh, err := cn.start(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	c.requested = append(c.requested, &requested{conn: cn, id: req.RequestId, respCh: respCh})
+	return nil
 }
 
+/* Wait for the response to the oldest request made with MakeRequest or Send that hasn't had it returned yet, marshalled */
 func (c *Client) RcvResponse() ([]byte, error) {
-	buffer := make([]byte, 1024)
-	respLen, err := c.serverConn.Read(buffer)
+	c.mu.Lock()
+	if len(c.requested) == 0 {
+		c.mu.Unlock()
+		return nil, ErrNoRequestPending
+	}
+	req := c.requested[0]
+	c.requested = c.requested[1:]
+	c.mu.Unlock()
+
+	response, err := req.conn.wait(context.Background(), req.id, req.respCh)
 	if err != nil {
 		return nil, err
 	}
-	response := buffer[:respLen]
-	return response, nil
+	return proto.Marshal(response)
 }
 
+/* Send a marshalled request, see MakeRequest */
 func (c *Client) Send(data []byte) error {
-	_, err := c.serverConn.Write(data)
+	var req communication.Request
+	err := proto.Unmarshal(data, &req)
 	if err != nil {
 		return err
 	}
 
+	return c.MakeRequest(&req)
+}
+
+func (c *Client) Close() error {
+	c.cluster.close()
 	return nil
 }
@@ -1,9 +1,15 @@
 package distdbclient
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
 	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -52,10 +58,8 @@ func TestClientMakeRequest(t *testing.T) {
 
 		var clientRequestParsedAtServer communication.Request
 		/* Receive response at server */
-		buffer := make([]byte, 1024)
-		clientRequestLen, err := clientConn.Read(buffer)
+		clientRequestRcvdAtServer, err := framing.ReadMessage(clientConn, 0)
 		require.NoError(t, err)
-		clientRequestRcvdAtServer := buffer[:clientRequestLen]
 
 		/* Unmarshal and check if all relevant fields match */
 		err = proto.Unmarshal(clientRequestRcvdAtServer, &clientRequestParsedAtServer)
@@ -63,9 +67,148 @@ func TestClientMakeRequest(t *testing.T) {
 		require.Equal(t, req.Key, clientRequestParsedAtServer.Key)
 		require.Equal(t, req.Val, clientRequestParsedAtServer.Val)
 		require.Equal(t, req.Op, clientRequestParsedAtServer.Op)
+		/* Tagged like any other call, so its response can't be mistaken for another's */
+		require.NotZero(t, clientRequestParsedAtServer.RequestId)
 
+		/* Respond from server, RcvResponse should return it */
+		respData, err := proto.Marshal(&communication.Response{RequestId: clientRequestParsedAtServer.RequestId, Status: communication.Status_SUCCESS, Val: req.Val})
+		require.NoError(t, err)
+		require.NoError(t, framing.WriteMessage(clientConn, respData, 0))
+		respRcvdAtClient, err := client.RcvResponse()
+		require.NoError(t, err)
+		var response communication.Response
+		require.NoError(t, proto.Unmarshal(respRcvdAtClient, &response))
+		require.Equal(t, req.Val, response.Val)
+	}
+
+	/* Every response has been returned */
+	_, err = client.RcvResponse()
+	require.ErrorIs(t, err, ErrNoRequestPending)
+
+}
+
+/* Responses coming back in a different order than the requests went out should still reach the right caller */
+func TestClientPipelining(t *testing.T) {
+	server, err := net.Listen(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	const n = 20
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		/* Collect every request, then answer them in reverse with Val = Key */
+		var reqs []*communication.Request
+		for len(reqs) < n {
+			reqData, err := framing.ReadMessage(conn, 0)
+			if err != nil {
+				return
+			}
+			var req communication.Request
+			if err := proto.Unmarshal(reqData, &req); err != nil {
+				return
+			}
+			reqs = append(reqs, &req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			respData, _ := proto.Marshal(&communication.Response{Status: communication.Status_SUCCESS, Val: reqs[i].Key, RequestId: reqs[i].RequestId})
+			framing.WriteMessage(conn, respData, 0)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(server.Addr().String())
+	require.NoError(t, err)
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port})
+	require.NoError(t, err)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := []byte(fmt.Sprintf("key%d", i))
+			v, err := client.Get(k)
+			require.NoError(t, err)
+			require.Equal(t, k, v)
+		}(i)
 	}
+	wg.Wait()
+
+	/* Server hung up and is gone for good, later calls fail instead of hanging */
+	server.Close()
+	_, err = client.Get([]byte("gone"))
+	require.Error(t, err)
+}
+
+/* A server that accepts but never answers should not hang the caller */
+func TestClientTimeouts(t *testing.T) {
+	server, err := net.Listen(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":0")
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(server.Addr().String())
+	require.NoError(t, err)
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port, ReadTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* Caller's deadline */
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.GetContext(ctx, []byte("key1"))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "read", timeoutErr.Op)
+
+	/* Caller cancels */
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err = client.PutContext(ctx, []byte("key1"), []byte("val1"))
+	require.ErrorIs(t, err, context.Canceled)
+	require.NotErrorIs(t, err, ErrTimeout)
+
+	/* Configured read timeout, no deadline on the context */
+	start := time.Now()
+	err = client.Delete([]byte("key1"))
+	require.ErrorIs(t, err, ErrTimeout)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	/* Already expired context never hits the wire */
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = client.GetContext(ctx, []byte("key1"))
+	require.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestClientConfigDefaults(t *testing.T) {
+	config := ClientConfig{}.withDefaults()
+	require.Equal(t, DEFAULT_DIAL_TIMEOUT, config.DialTimeout)
+	require.Equal(t, DEFAULT_READ_TIMEOUT, config.ReadTimeout)
+	require.Equal(t, DEFAULT_WRITE_TIMEOUT, config.WriteTimeout)
+	require.Equal(t, DEFAULT_MAX_REDIRECTS, config.MaxRedirects)
 
+	config = ClientConfig{ReadTimeout: time.Second, MaxRedirects: -1}.withDefaults()
+	require.Equal(t, time.Second, config.ReadTimeout)
+	require.Equal(t, -1, config.MaxRedirects)
 }
 
-/* Note: ClientRcvResponse tested in db_test */
+/* Note: Client.Do against a real server tested in db_test */
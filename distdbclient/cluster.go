@@ -0,0 +1,106 @@
+package distdbclient
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	A cluster is every node the client knows of: the Seeds (or ServerHost:ServerPort if there are none) and any leader
+	a node redirected us to. Each node gets its own pool, dialled the first time the node is needed.
+
+	Calls go to the node we believe to be the leader, the first seed to start with. A NOT_LEADER response naming the
+	leader moves us over to it and the call is retried there right away. One that doesn't name it (an election is
+	underway, or the node doesn't know) moves us on to the next seed after a backoff, and so does a node we can't
+	reach, as long as the request never went out. GETs with StaleReads set are spread over every seed instead.
+*/
+
+type cluster struct {
+	config   ClientConfig
+	seeds    []string /* host:port */
+	nextRead uint64
+
+	mu     *sync.Mutex /* Guards everything below */
+	pools  map[string]*pool
+	leader string
+	closed bool
+}
+
+func newCluster(config ClientConfig) *cluster {
+	seeds := config.Seeds
+	if len(seeds) == 0 {
+		seeds = []string{net.JoinHostPort(config.ServerHost, config.ServerPort)}
+	}
+	return &cluster{config: config, seeds: seeds, mu: &sync.Mutex{}, pools: map[string]*pool{}, leader: seeds[0]}
+}
+
+/* The pool for node addr, created if we haven't talked to it before */
+func (cl *cluster) pool(addr string) (*pool, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.closed {
+		return nil, ErrClientClosed
+	}
+	if p, ok := cl.pools[addr]; ok {
+		return p, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := cl.config
+	config.ServerHost, config.ServerPort = host, port
+	p := newPool(config)
+	cl.pools[addr] = p
+	return p, nil
+}
+
+func (cl *cluster) leaderAddr() string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.leader
+}
+
+/* The next seed to read from */
+func (cl *cluster) readAddr() string {
+	return cl.seeds[atomic.AddUint64(&cl.nextRead, 1)%uint64(len(cl.seeds))]
+}
+
+/*
+	from isn't the leader: move over to leader if we were told who it is, otherwise on to the seed after from unless
+	someone else moved us on from from already.
+*/
+func (cl *cluster) redirect(from, leader string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if leader != "" {
+		cl.leader = leader
+		return
+	}
+	if cl.leader != from {
+		return
+	}
+
+	/* A leader we were redirected to that isn't a seed starts over from the first seed */
+	next := 0
+	for i, seed := range cl.seeds {
+		if seed == from {
+			next = (i + 1) % len(cl.seeds)
+		}
+	}
+	cl.leader = cl.seeds[next]
+}
+
+func (cl *cluster) close() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.closed = true
+	for _, p := range cl.pools {
+		p.close()
+	}
+}
@@ -0,0 +1,169 @@
+package distdbclient
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+/* Dummy cluster node: the leader answers everything with SUCCESS, followers only GETs and only if followerReads is set */
+type fakeNode struct {
+	listener net.Listener
+	addr     string
+
+	mu            sync.Mutex
+	leader        bool
+	leaderHint    string /* Sent along with NOT_LEADER */
+	followerReads bool
+	requests      map[communication.Operation]int
+}
+
+func startFakeNode(t *testing.T) *fakeNode {
+	listener, err := net.Listen(DEFAULT_SERVER_PROTOCOL, DEFAULT_SERVER_HOST+":0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	n := &fakeNode{listener: listener, addr: listener.Addr().String(), requests: map[communication.Operation]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		reqData, err := framing.ReadMessage(conn, 0)
+		if err != nil {
+			return
+		}
+		var req communication.Request
+		if err := proto.Unmarshal(reqData, &req); err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		n.requests[req.Op]++
+		resp := &communication.Response{Status: communication.Status_SUCCESS, Val: []byte(n.addr), RequestId: req.RequestId}
+		if !n.leader && !(req.Op == communication.Operation_GET && n.followerReads) {
+			resp = &communication.Response{Status: communication.Status_NOT_LEADER, Leader: n.leaderHint, RequestId: req.RequestId}
+		}
+		n.mu.Unlock()
+
+		respData, _ := proto.Marshal(resp)
+		if err := framing.WriteMessage(conn, respData, 0); err != nil {
+			return
+		}
+	}
+}
+
+func (n *fakeNode) set(leader bool, leaderHint string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.leader, n.leaderHint = leader, leaderHint
+}
+
+func (n *fakeNode) requestCount(op communication.Operation) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.requests[op]
+}
+
+func TestClientRedirects(t *testing.T) {
+	nodes := []*fakeNode{startFakeNode(t), startFakeNode(t), startFakeNode(t)}
+	seeds := []string{nodes[0].addr, nodes[1].addr, nodes[2].addr}
+	nodes[2].set(true, "")
+
+	/* Told where the leader is */
+	nodes[0].set(false, nodes[2].addr)
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds})
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Put([]byte("k"), []byte("v")))
+	require.Equal(t, nodes[2].addr, client.Leader())
+	require.Equal(t, 1, nodes[0].requestCount(communication.Operation_PUT))
+	require.Equal(t, 0, nodes[1].requestCount(communication.Operation_PUT))
+
+	/* Leadership moves to a node that doesn't let on where to, the client tries the others until it finds it */
+	nodes[2].set(false, "")
+	nodes[0].set(true, "")
+	require.NoError(t, client.Put([]byte("k"), []byte("v")))
+	require.Equal(t, nodes[0].addr, client.Leader())
+
+	/* The leader goes away */
+	nodes[0].listener.Close()
+	client.Close()
+	client, err = NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds})
+	require.NoError(t, err)
+	defer client.Close()
+	nodes[1].set(true, "")
+	require.NoError(t, client.Put([]byte("k"), []byte("v")))
+	require.Equal(t, nodes[1].addr, client.Leader())
+
+	/* No leader to be found */
+	nodes[1].set(false, "")
+	client.Close()
+	client, err = NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds, MaxRedirects: 3, ReconnectBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+	err = client.Put([]byte("k"), []byte("v"))
+	require.ErrorIs(t, err, ErrNotLeader)
+
+	/* Or not looking for it */
+	client.Close()
+	nodes[1].set(false, nodes[2].addr)
+	client, err = NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds[1:], MaxRedirects: -1})
+	require.NoError(t, err)
+	defer client.Close()
+	err = client.Put([]byte("k"), []byte("v"))
+	var notLeader *NotLeaderError
+	require.ErrorAs(t, err, &notLeader)
+	require.Equal(t, nodes[2].addr, notLeader.Leader)
+}
+
+func TestClientStaleReads(t *testing.T) {
+	nodes := []*fakeNode{startFakeNode(t), startFakeNode(t), startFakeNode(t)}
+	nodes[0].set(true, "")
+	nodes[1].followerReads = true
+	nodes[2].set(false, nodes[0].addr)
+	seeds := []string{nodes[0].addr, nodes[1].addr, nodes[2].addr}
+
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds, StaleReads: true})
+	require.NoError(t, err)
+	defer client.Close()
+
+	/* Node 2 doesn't serve stale reads and sends them on to the leader */
+	for i := 0; i < 30; i++ {
+		_, err := client.Get([]byte("k"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, 10, nodes[1].requestCount(communication.Operation_GET))
+	require.Equal(t, 10, nodes[2].requestCount(communication.Operation_GET))
+	require.Equal(t, 20, nodes[0].requestCount(communication.Operation_GET))
+
+	/* Writes still go to the leader */
+	require.NoError(t, client.Put([]byte("k"), []byte("v")))
+	require.Equal(t, 1, nodes[0].requestCount(communication.Operation_PUT))
+	require.Equal(t, 0, nodes[1].requestCount(communication.Operation_PUT))
+
+	/* Without StaleReads everything goes to the leader */
+	plain, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, Seeds: seeds})
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, 21, nodes[0].requestCount(communication.Operation_GET))
+	require.Equal(t, 10, nodes[1].requestCount(communication.Operation_GET))
+}
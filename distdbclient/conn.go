@@ -0,0 +1,239 @@
+package distdbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	A single connection to the server, safe for concurrent use: calls from multiple goroutines are pipelined over it.
+	Each request is tagged with a request ID and a background reader hands every response to the call waiting on its ID.
+*/
+type conn struct {
+	serverConn net.Conn
+	reader     *bufio.Reader
+	config     ClientConfig
+
+	writeMu *sync.Mutex
+	mu      *sync.Mutex /* Guards everything below */
+	nextID  uint64
+	pending map[uint64]chan *communication.Response
+	err     error /* Set once the connection is broken, every later call fails with it */
+}
+
+func dialConn(ctx context.Context, config ClientConfig) (*conn, error) {
+	dialer := net.Dialer{Timeout: config.DialTimeout}
+	serverConn, err := dialer.DialContext(ctx, config.ServerProtocol, config.ServerHost+":"+config.ServerPort)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, &TimeoutError{Op: "dial", Cause: err}
+		}
+		return nil, contextError(err, "dial")
+	}
+
+	c := &conn{
+		serverConn: serverConn,
+		reader:     bufio.NewReader(serverConn),
+		config:     config,
+		writeMu:    &sync.Mutex{},
+		mu:         &sync.Mutex{},
+		nextID:     1,
+		pending:    map[uint64]chan *communication.Response{},
+	}
+	go c.readResponses()
+
+	return c, nil
+}
+
+/*
+	Send req with a fresh request ID and wait for its response, errors are only returned if no response was received.
+	Gives up once ctx is done or ReadTimeout passes, whichever comes first, a response arriving afterwards is dropped.
+	sent is false if the request never made it onto the wire, in which case it is safe to retry on another connection.
+*/
+func (c *conn) do(ctx context.Context, req *communication.Request) (resp *communication.Response, sent bool, err error) {
+	respCh, err := c.start(ctx, req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err = c.wait(ctx, req.RequestId, respCh)
+	return resp, true, err
+}
+
+/* Send req with a fresh request ID, its response is handed to the returned channel which is closed if the connection breaks first */
+func (c *conn) start(ctx context.Context, req *communication.Request) (chan *communication.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err, "write")
+	}
+
+	respCh := make(chan *communication.Response, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	req.RequestId = c.nextID
+	c.nextID++
+	c.pending[req.RequestId] = respCh
+	c.mu.Unlock()
+
+	err := c.makeRequest(ctx, req)
+	if err != nil {
+		c.abandon(req.RequestId)
+		return nil, err
+	}
+
+	return respCh, nil
+}
+
+/* Wait for the response to request id on respCh, see do */
+func (c *conn) wait(ctx context.Context, id uint64, respCh chan *communication.Response) (*communication.Response, error) {
+	/* A single timer for whichever comes first, so that ctx's deadline is reported as such even if ReadTimeout is up too */
+	deadline := time.Now().Add(c.config.ReadTimeout)
+	ctxDeadline, ok := ctx.Deadline()
+	ctxFirst := ok && !ctxDeadline.After(deadline)
+	if ctxFirst {
+		deadline = ctxDeadline
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case response, ok := <-respCh:
+		if !ok {
+			return nil, c.broken()
+		}
+		return response, nil
+	case <-ctx.Done():
+		c.abandon(id)
+		return nil, contextError(ctx.Err(), "read")
+	case <-timer.C:
+		c.abandon(id)
+		if ctxFirst {
+			return nil, contextError(context.DeadlineExceeded, "read")
+		}
+		return nil, &TimeoutError{Op: "read", Cause: fmt.Errorf("no response within %s", c.config.ReadTimeout)}
+	}
+}
+
+/* Stop waiting on request id, its response is dropped if it still arrives */
+func (c *conn) abandon(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+/* Hand every response to the call waiting on its ID, until the connection breaks */
+func (c *conn) readResponses() {
+	for {
+		respData, err := framing.ReadMessage(c.reader, c.config.MaxMessageSize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		var response communication.Response
+		err = proto.Unmarshal(respData, &response)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		/* Request ID 0 is the server reporting an error against the whole connection */
+		if response.RequestId == 0 {
+			c.fail(errors.New(response.Error))
+			return
+		}
+
+		c.mu.Lock()
+		respCh, ok := c.pending[response.RequestId]
+		delete(c.pending, response.RequestId)
+		c.mu.Unlock()
+		if ok {
+			respCh <- &response
+		}
+	}
+}
+
+/* Error the connection broke with, nil while it is healthy */
+func (c *conn) broken() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+/* Mark the connection broken and fail every call still waiting on a response */
+func (c *conn) fail(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		err = ErrConnectionClosed
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, respCh := range c.pending {
+		close(respCh)
+		delete(c.pending, id)
+	}
+	c.serverConn.Close()
+}
+
+func (c *conn) makeRequest(ctx context.Context, req *communication.Request) error {
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return c.send(ctx, data)
+}
+
+/* Write data within WriteTimeout or ctx's deadline, whichever is sooner */
+func (c *conn) send(ctx context.Context, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline := time.Now().Add(c.config.WriteTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err := c.serverConn.SetWriteDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	err = framing.WriteMessage(c.serverConn, data, c.config.MaxMessageSize)
+	if err != nil {
+		if errors.Is(err, framing.ErrMessageTooLarge) {
+			return err
+		}
+
+		/* A partially written frame leaves the stream unusable */
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = &TimeoutError{Op: "write", Cause: err}
+		}
+		c.fail(err)
+		return err
+	}
+
+	return nil
+}
+
+func contextError(err error, op string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{Op: op, Cause: err}
+	}
+	return err
+}
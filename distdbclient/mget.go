@@ -0,0 +1,170 @@
+package distdbclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+)
+
+/* Most keys sent in a single MGET, see distdb.MAX_MGET_KEYS. Bigger lookups are split up */
+const MGET_BATCH_SIZE = 1000
+
+/* A key's value as looked up by GetMany */
+type GetResult struct {
+	Val     []byte
+	Version uint64 /* See GetWithVersion */
+	Found   bool
+}
+
+/*
+	The values of keys in order, in one round trip per MGET_BATCH_SIZE keys. Keys that don't exist come back with Found
+	unset rather than as an error. Every batch is looked up as of a single point in time.
+*/
+func (c *Client) GetMany(ctx context.Context, keys [][]byte) ([]GetResult, error) {
+	results, _, err := c.mget(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]GetResult, 0, len(results))
+	for _, result := range results {
+		if result.Status == communication.Status_WRONG_SHARD {
+			return nil, ErrWrongShard
+		}
+		values = append(values, getResult(result))
+	}
+	return values, nil
+}
+
+/* The results for keys in order, and the shard map the last response with WRONG_SHARD results came with */
+func (c *Client) mget(ctx context.Context, keys [][]byte) ([]*communication.KeyResult, []byte, error) {
+	var results []*communication.KeyResult
+	var shardMap []byte
+	for start := 0; start < len(keys); start += MGET_BATCH_SIZE {
+		end := start + MGET_BATCH_SIZE
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		req := communication.Request{Op: communication.Operation_MGET, Keys: keys[start:end]}
+		response, err := c.DoContext(ctx, &req)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = responseError(response)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(response.Results) != end-start {
+			return nil, nil, fmt.Errorf("%w: %d results for %d keys", ErrInvalidOperation, len(response.Results), end-start)
+		}
+
+		results = append(results, response.Results...)
+		if response.ShardMap != nil {
+			shardMap = response.ShardMap
+		}
+	}
+	return results, shardMap, nil
+}
+
+func getResult(result *communication.KeyResult) GetResult {
+	return GetResult{Val: result.Val, Version: result.Version, Found: result.Status == communication.Status_SUCCESS}
+}
+
+/*
+	The values of keys in order, see Client.GetMany. Keys are looked up at their groups in parallel, one MGET per group
+	(per MGET_BATCH_SIZE keys), so unlike a single Client's, a lookup spanning groups isn't as of one point in time.
+	Keys a group turns away are retried like DoContext would, up to MaxRedirects times.
+*/
+func (sc *ShardedClient) GetMany(ctx context.Context, keys [][]byte) ([]GetResult, error) {
+	type lookup struct {
+		client   *Client
+		pending  []int /* Indexes into keys */
+		results  []*communication.KeyResult
+		shardMap []byte
+		err      error
+	}
+
+	values := make([]GetResult, len(keys))
+	routeBy := make([]*sharding.ShardMap, len(keys)) /* The map of the last server to turn a key away, if it is older than ours */
+	pending := make([]int, len(keys))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for redirects := 0; len(pending) > 0; redirects++ {
+		/* Group the keys by the client they go to */
+		lookups := map[*Client]*lookup{}
+		sc.mu.Lock()
+		version := sc.shardMap.Version
+		for _, i := range pending {
+			shardMap := routeBy[i]
+			if shardMap == nil {
+				shardMap = sc.shardMap
+			}
+			client, err := sc.groupClient(shardMap.Owner(keys[i]))
+			if err != nil {
+				sc.mu.Unlock()
+				return nil, err
+			}
+			if lookups[client] == nil {
+				lookups[client] = &lookup{client: client}
+			}
+			lookups[client].pending = append(lookups[client].pending, i)
+		}
+		sc.mu.Unlock()
+
+		wg := sync.WaitGroup{}
+		for _, l := range lookups {
+			wg.Add(1)
+			go func(l *lookup) {
+				defer wg.Done()
+				groupKeys := make([][]byte, 0, len(l.pending))
+				for _, i := range l.pending {
+					groupKeys = append(groupKeys, keys[i])
+				}
+				l.results, l.shardMap, l.err = l.client.mget(ctx, groupKeys)
+			}(l)
+		}
+		wg.Wait()
+
+		pending = nil
+		for _, l := range lookups {
+			if l.err != nil {
+				return nil, l.err
+			}
+			for j, result := range l.results {
+				i := l.pending[j]
+				if result.Status != communication.Status_WRONG_SHARD {
+					values[i] = getResult(result)
+					continue
+				}
+				if redirects >= sc.config.MaxRedirects {
+					return nil, ErrWrongShard
+				}
+				pending = append(pending, i)
+			}
+			if l.shardMap == nil {
+				continue
+			}
+
+			shardMap, err := sharding.Decode(l.shardMap)
+			if err != nil {
+				return nil, ErrWrongShard
+			}
+			for _, i := range l.pending {
+				routeBy[i] = nil
+				if shardMap.Version <= version {
+					routeBy[i] = shardMap
+				}
+			}
+			if shardMap.Version > version {
+				sc.setShardMap(shardMap)
+			}
+		}
+	}
+	return values, nil
+}
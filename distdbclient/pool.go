@@ -0,0 +1,171 @@
+package distdbclient
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+)
+
+/*
+	A pool keeps PoolSize connections to the server and hands them out round robin.
+
+	A broken connection is redialled the next time its slot is picked, retrying with exponential backoff and jitter
+	so that a restarting server isn't hammered by every client at once. A background health checker pings idle
+	connections every HealthCheckInterval so that dead ones are noticed (and replaced) before a call trips over them.
+*/
+
+type slot struct {
+	mu       *sync.Mutex /* Held while dialing so that only one caller reconnects a slot */
+	conn     *conn
+	failures int       /* Consecutive failed dials */
+	nextDial time.Time /* No dial before this, set by the backoff after a failed dial */
+}
+
+type pool struct {
+	config ClientConfig
+	slots  []*slot
+	next   uint64
+	done   chan struct{}
+	closed int32
+}
+
+func newPool(config ClientConfig) *pool {
+	p := &pool{config: config, done: make(chan struct{})}
+	for i := 0; i < config.PoolSize; i++ {
+		p.slots = append(p.slots, &slot{mu: &sync.Mutex{}})
+	}
+
+	if config.HealthCheckInterval > 0 {
+		go p.healthCheck()
+	}
+
+	return p
+}
+
+/* A healthy connection, reconnecting the picked slot if needed */
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	s := p.slots[atomic.AddUint64(&p.next, 1)%uint64(len(p.slots))]
+	return p.connect(ctx, s, p.config.ReconnectAttempts)
+}
+
+/* Return the slot's connection if it is healthy, otherwise make up to attempts dials, backing off between them */
+func (p *pool) connect(ctx context.Context, s *slot, attempts int) (*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil && s.conn.broken() == nil {
+		return s.conn, nil
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if atomic.LoadInt32(&p.closed) == 1 {
+			return nil, ErrClientClosed
+		}
+
+		/* Wait out the backoff from the previous failure */
+		if wait := time.Until(s.nextDial); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, contextError(ctx.Err(), "dial")
+			case <-p.done:
+				timer.Stop()
+				return nil, ErrClientClosed
+			case <-timer.C:
+			}
+		}
+
+		var c *conn
+		c, err = dialConn(ctx, p.config)
+		if err == nil {
+			s.conn, s.failures, s.nextDial = c, 0, time.Time{}
+			return c, nil
+		}
+
+		s.failures++
+		s.nextDial = time.Now().Add(backoff(p.config.ReconnectBaseDelay, p.config.ReconnectMaxDelay, s.failures))
+		if ctx.Err() != nil {
+			return nil, contextError(ctx.Err(), "dial")
+		}
+	}
+
+	return nil, err
+}
+
+/* Exponential backoff capped at maxDelay, with "equal jitter": a random delay in [d/2, d] */
+func backoff(baseDelay, maxDelay time.Duration, failures int) time.Duration {
+	d := baseDelay
+	for i := 1; i < failures && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+/* Ping every live connection and redial broken ones, until the pool is closed */
+func (p *pool) healthCheck() {
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, s := range p.slots {
+			s.mu.Lock()
+			c := s.conn
+			s.mu.Unlock()
+
+			if c != nil && c.broken() == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), p.config.ReadTimeout)
+				resp, _, err := c.do(ctx, &communication.Request{Op: communication.Operation_PING})
+				cancel()
+				if err == nil && resp.Status != communication.Status_SUCCESS {
+					err = ErrUnhealthy
+				}
+				if err != nil {
+					c.fail(err)
+				}
+				continue
+			}
+
+			/* Reconnect in the background so that the next call finds a healthy connection, skipped while backing off */
+			s.mu.Lock()
+			backingOff := time.Now().Before(s.nextDial)
+			s.mu.Unlock()
+			if !backingOff {
+				ctx, cancel := context.WithTimeout(context.Background(), p.config.DialTimeout)
+				p.connect(ctx, s, 1)
+				cancel()
+			}
+		}
+	}
+}
+
+func (p *pool) close() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	close(p.done)
+
+	for _, s := range p.slots {
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.fail(ErrClientClosed)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+package distdbclient
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/framing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+/* Dummy server answering every request with SUCCESS and Val = Key, keeps track of its connections so they can be killed */
+type echoServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func startEchoServer(t *testing.T, addr string) *echoServer {
+	listener, err := net.Listen(DEFAULT_SERVER_PROTOCOL, addr)
+	require.NoError(t, err)
+
+	s := &echoServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.accepted++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *echoServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		reqData, err := framing.ReadMessage(conn, 0)
+		if err != nil {
+			return
+		}
+		var req communication.Request
+		if err := proto.Unmarshal(reqData, &req); err != nil {
+			return
+		}
+		respData, _ := proto.Marshal(&communication.Response{Status: communication.Status_SUCCESS, Val: req.Key, RequestId: req.RequestId})
+		if err := framing.WriteMessage(conn, respData, 0); err != nil {
+			return
+		}
+	}
+}
+
+/* Drop every open connection, optionally stop listening too */
+func (s *echoServer) kill(stopListening bool) {
+	if stopListening {
+		s.listener.Close()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *echoServer) acceptedConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+func TestPoolSize(t *testing.T) {
+	server := startEchoServer(t, DEFAULT_SERVER_HOST+":0")
+	defer server.kill(true)
+
+	_, port, err := net.SplitHostPort(server.listener.Addr().String())
+	require.NoError(t, err)
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port, PoolSize: 3})
+	require.NoError(t, err)
+	defer client.Close()
+
+	for i := 0; i < 30; i++ {
+		v, err := client.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("key"), v)
+	}
+	require.Eventually(t, func() bool { return server.acceptedConns() == 3 }, time.Second, 5*time.Millisecond)
+}
+
+/* Calls fail while the server is down and go through again, without a new client, once it is back */
+func TestPoolReconnect(t *testing.T) {
+	server := startEchoServer(t, DEFAULT_SERVER_HOST+":0")
+	addr := server.listener.Addr().String()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	config := ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port, PoolSize: 2, ReconnectBaseDelay: time.Millisecond, ReconnectMaxDelay: 10 * time.Millisecond, HealthCheckInterval: -1}
+	client, err := NewClient(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Get([]byte("key"))
+	require.NoError(t, err)
+
+	/* Server restarts */
+	server.kill(true)
+	_, err = client.Get([]byte("key"))
+	require.Error(t, err)
+
+	server = startEchoServer(t, addr)
+	defer server.kill(true)
+	require.Eventually(t, func() bool {
+		v, err := client.Get([]byte("key"))
+		return err == nil && string(v) == "key"
+	}, time.Second, 10*time.Millisecond)
+}
+
+/* Health checks should notice a dead connection and replace it without any call having to fail first */
+func TestPoolHealthCheck(t *testing.T) {
+	server := startEchoServer(t, DEFAULT_SERVER_HOST+":0")
+	defer server.kill(true)
+
+	_, port, err := net.SplitHostPort(server.listener.Addr().String())
+	require.NoError(t, err)
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: port, HealthCheckInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+	require.Eventually(t, func() bool { return server.acceptedConns() == 1 }, time.Second, 5*time.Millisecond)
+
+	server.kill(false)
+	require.Eventually(t, func() bool { return server.acceptedConns() == 2 }, time.Second, 5*time.Millisecond)
+	_, err = client.Get([]byte("key"))
+	require.NoError(t, err)
+}
+
+func TestLazyConnect(t *testing.T) {
+	_, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "1"})
+	require.Error(t, err)
+
+	client, err := NewClient(ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST, ServerPort: "1", LazyConnect: true, ReconnectBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Get([]byte("key"))
+	require.Error(t, err)
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Millisecond, 200*time.Millisecond
+	tcs := []struct {
+		failures int
+		ceiling  time.Duration
+	}{
+		{failures: 1, ceiling: 10 * time.Millisecond},
+		{failures: 2, ceiling: 20 * time.Millisecond},
+		{failures: 4, ceiling: 80 * time.Millisecond},
+		{failures: 10, ceiling: max},
+		{failures: 1000, ceiling: max},
+	}
+
+	for _, tc := range tcs {
+		for i := 0; i < 100; i++ {
+			d := backoff(base, max, tc.failures)
+			require.GreaterOrEqual(t, d, tc.ceiling/2)
+			require.LessOrEqual(t, d, tc.ceiling)
+		}
+	}
+}
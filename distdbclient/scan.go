@@ -0,0 +1,120 @@
+package distdbclient
+
+import (
+	"context"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Iterates over a Scan or ListPrefix, fetching a page of ScanPageSize entries at a time as it goes. Not safe for concurrent use.
+
+		it := client.Scan(ctx, start, end, 0)
+		for it.Next() {
+			use(it.Key(), it.Val())
+		}
+		if it.Err() != nil { ... }
+*/
+type ScanIterator struct {
+	client    *Client
+	ctx       context.Context
+	op        communication.Operation
+	next, end []byte /* Where the next page starts, and where a SCAN ends */
+	prefix    []byte /* What a PREFIX_SCAN's keys start with */
+	keysOnly  bool
+	remaining int  /* Entries left to return, negative for no limit */
+	done      bool /* No pages left to fetch */
+
+	page []*communication.LogRecord
+	pos  int /* Index into page of the current entry, plus one */
+	err  error
+}
+
+/*
+	Entries with keys from start up to but not including end in key order, at most limit of them. nil end and limit <= 0
+	don't bound the scan. Pages are fetched separately, so writes made during the scan may or may not be seen.
+*/
+func (c *Client) Scan(ctx context.Context, start, end []byte, limit int) *ScanIterator {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &ScanIterator{client: c, ctx: ctx, op: communication.Operation_SCAN, next: start, end: end, remaining: limit}
+}
+
+/*
+	Entries with keys starting with prefix in key order, at most limit of them (limit <= 0 doesn't bound it). With
+	keysOnly set values are left out and Val returns nil. Like Scan, pages are fetched separately.
+*/
+func (c *Client) ListPrefix(ctx context.Context, prefix []byte, limit int, keysOnly bool) *ScanIterator {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &ScanIterator{client: c, ctx: ctx, op: communication.Operation_PREFIX_SCAN, next: prefix, prefix: prefix, keysOnly: keysOnly, remaining: limit}
+}
+
+/* Move on to the next entry, false once there are no more or the scan failed, see Err */
+func (it *ScanIterator) Next() bool {
+	if it.err != nil || it.remaining == 0 {
+		return false
+	}
+	for it.pos >= len(it.page) {
+		if it.done {
+			return false
+		}
+		it.err = it.fetch()
+		if it.err != nil {
+			return false
+		}
+	}
+
+	it.pos++
+	if it.remaining > 0 {
+		it.remaining--
+	}
+	return true
+}
+
+func (it *ScanIterator) fetch() error {
+	limit := it.client.config.ScanPageSize
+	if it.remaining > 0 && it.remaining < limit {
+		limit = it.remaining
+	}
+
+	req := communication.Request{Op: it.op, Key: it.next, End: it.end, Prefix: it.prefix, KeysOnly: it.keysOnly, Limit: uint32(limit)}
+	response, err := it.client.DoContext(it.ctx, &req)
+	if err != nil {
+		return err
+	}
+	err = responseError(response)
+	if err != nil {
+		return err
+	}
+
+	it.page, it.pos = it.page[:0], 0
+	for _, data := range response.Records {
+		var record communication.LogRecord
+		err := proto.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		it.page = append(it.page, &record)
+	}
+	it.next, it.done = response.Continuation, response.Continuation == nil
+	return nil
+}
+
+/* The current entry's key */
+func (it *ScanIterator) Key() []byte {
+	return it.page[it.pos-1].Key
+}
+
+/* The current entry's value */
+func (it *ScanIterator) Val() []byte {
+	return it.page[it.pos-1].Val
+}
+
+/* Why Next returned false, nil if the scan got to its end */
+func (it *ScanIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,306 @@
+package distdbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"github.com/chettriyuvraj/distributed-kv-store/sharding"
+)
+
+/*
+	A ShardedClient talks to a keyspace split between replica groups, see the sharding package. It keeps a Client per
+	group, with the group's nodes as its Seeds, and sends every call to the group the shard map says owns its key.
+	Group clients connect lazily, so a group being down only fails the calls that go to it.
+
+	Servers check ownership against their own map. A WRONG_SHARD response carries it, and if it is newer than ours we
+	switch over to it and retry, up to MaxRedirects times, so a client doesn't need to be told when the map changes.
+	One that isn't newer (the server hasn't caught up, or a rebalance is underway, see Rebalance) only has that call
+	retried at the owner it names.
+*/
+
+const MIGRATE_POLL_INTERVAL = 20 * time.Millisecond
+
+var ErrWrongShard = errors.New("key belongs to another shard group")
+
+type ShardedClient struct {
+	config ClientConfig
+
+	mu       *sync.Mutex /* Guards everything below */
+	shardMap *sharding.ShardMap
+	clients  map[string]*Client /* A group's seeds joined with commas -> client, kept until Close as calls may be in flight on them */
+	closed   bool
+}
+
+/* Route by shardMap, or if it is nil by the map the first reachable node in config's Seeds (or ServerHost:ServerPort) has */
+func NewShardedClient(config ClientConfig, shardMap *sharding.ShardMap) (*ShardedClient, error) {
+	config = config.withDefaults()
+	if shardMap == nil {
+		client, err := NewClient(config)
+		if err != nil {
+			return nil, err
+		}
+		shardMap, err = client.ShardMap(context.Background())
+		client.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ShardedClient{config: config, mu: &sync.Mutex{}, shardMap: shardMap, clients: map[string]*Client{}}, nil
+}
+
+/* Switch over to shardMap, unless ours is newer */
+func (sc *ShardedClient) setShardMap(shardMap *sharding.ShardMap) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if shardMap.Version > sc.shardMap.Version {
+		sc.shardMap = shardMap
+	}
+}
+
+/* The shard map calls are currently routed by */
+func (sc *ShardedClient) ShardMap() *sharding.ShardMap {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.shardMap
+}
+
+/* The client for the group owning key in shardMap, ours if that is nil, and the version of ours */
+func (sc *ShardedClient) clientFor(key []byte, shardMap *sharding.ShardMap) (*Client, uint64, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	version := sc.shardMap.Version
+	if shardMap == nil {
+		shardMap = sc.shardMap
+	}
+	client, err := sc.groupClient(shardMap.Owner(key))
+	return client, version, err
+}
+
+/* The client for group, created if we haven't talked to it before. Call this only with sc.mu held */
+func (sc *ShardedClient) groupClient(group sharding.Group) (*Client, error) {
+	if sc.closed {
+		return nil, ErrClientClosed
+	}
+	seeds := strings.Join(group.Seeds, ",")
+	if client, ok := sc.clients[seeds]; ok {
+		return client, nil
+	}
+
+	config := sc.config
+	config.Seeds, config.LazyConnect = group.Seeds, true
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	sc.clients[seeds] = client
+	return client, nil
+}
+
+func (sc *ShardedClient) Get(key []byte) ([]byte, error) {
+	return sc.GetContext(context.Background(), key)
+}
+
+func (sc *ShardedClient) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	req := communication.Request{Key: key, Op: communication.Operation_GET}
+	response, err := sc.DoContext(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = responseError(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Val, nil
+}
+
+func (sc *ShardedClient) Put(key, val []byte) error {
+	return sc.PutContext(context.Background(), key, val)
+}
+
+func (sc *ShardedClient) PutContext(ctx context.Context, key, val []byte) error {
+	req := communication.Request{Key: key, Val: val, Op: communication.Operation_PUT}
+	response, err := sc.DoContext(ctx, &req)
+	if err != nil {
+		return err
+	}
+
+	return responseError(response)
+}
+
+func (sc *ShardedClient) Delete(key []byte) error {
+	return sc.DeleteContext(context.Background(), key)
+}
+
+func (sc *ShardedClient) DeleteContext(ctx context.Context, key []byte) error {
+	req := communication.Request{Key: key, Op: communication.Operation_DELETE}
+	response, err := sc.DoContext(ctx, &req)
+	if err != nil {
+		return err
+	}
+
+	return responseError(response)
+}
+
+/*
+	Send req to the group owning req.Key and wait for its response, see Client.DoContext. WRONG_SHARD responses are
+	retried against the owner in the map they carry up to MaxRedirects times, switching over to the map if it is newer.
+*/
+func (sc *ShardedClient) DoContext(ctx context.Context, req *communication.Request) (*communication.Response, error) {
+	var routeBy *sharding.ShardMap /* The last server's map, if it is older than ours */
+	for redirects := 0; ; redirects++ {
+		client, version, err := sc.clientFor(req.Key, routeBy)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.DoContext(ctx, req)
+		if err != nil || resp.Status != communication.Status_WRONG_SHARD || redirects >= sc.config.MaxRedirects {
+			return resp, err
+		}
+
+		shardMap, err := sharding.Decode(resp.ShardMap)
+		if err != nil {
+			return resp, nil
+		}
+		routeBy = shardMap
+		if shardMap.Version > version {
+			routeBy = nil
+			sc.setShardMap(shardMap)
+		}
+	}
+}
+
+func (sc *ShardedClient) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.closed = true
+	for _, client := range sc.clients {
+		client.Close()
+	}
+	return nil
+}
+
+/* The shard map the server routes by */
+func (c *Client) ShardMap(ctx context.Context) (*sharding.ShardMap, error) {
+	req := communication.Request{Op: communication.Operation_SHARD_MAP}
+	response, err := c.DoContext(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = responseError(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return sharding.Decode(response.ShardMap)
+}
+
+/*
+	Move the keyspace over to target without downtime, see the distdb package for how. token is the servers'
+	replication secret. Every node in our map and in target has to be up. Each group's leader hands its keys over in the
+	background, polled every MIGRATE_POLL_INTERVAL until ctx is done. Running it again after a failure picks up where it
+	left off.
+*/
+func (sc *ShardedClient) Rebalance(ctx context.Context, target *sharding.ShardMap, token string) error {
+	current := sc.ShardMap()
+	if target.Version < current.Version {
+		return fmt.Errorf("%w: shard map version %d is older than %d", ErrInvalidOperation, target.Version, current.Version)
+	}
+	encoded, err := target.Encode()
+	if err != nil {
+		return err
+	}
+
+	groups := append([]sharding.Group{}, target.Groups...)
+	for _, group := range current.Groups {
+		if _, ok := target.Group(group.ID); !ok {
+			groups = append(groups, group)
+		}
+	}
+
+	err = sc.broadcast(ctx, groups, &communication.Request{Op: communication.Operation_SHARD_PREPARE, Val: encoded, Token: token})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range current.Groups {
+		sc.mu.Lock()
+		client, err := sc.groupClient(group)
+		sc.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		err = requestError(client.DoContext(ctx, &communication.Request{Op: communication.Operation_SHARD_MIGRATE, Seq: target.Version, Token: token}))
+		if err == nil {
+			err = awaitMigration(ctx, client, target.Version, token)
+		}
+		if err != nil {
+			return fmt.Errorf("migrating group %s: %w", group.ID, err)
+		}
+	}
+
+	err = sc.broadcast(ctx, groups, &communication.Request{Op: communication.Operation_SHARD_COMMIT, Seq: target.Version, Token: token})
+	if err != nil {
+		return err
+	}
+	sc.setShardMap(target)
+	return nil
+}
+
+/* Poll a group's leader until it has handed its keys over for the rebalance to shard map version */
+func awaitMigration(ctx context.Context, client *Client, version uint64, token string) error {
+	ticker := time.NewTicker(MIGRATE_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		resp, err := client.DoContext(ctx, &communication.Request{Op: communication.Operation_SHARD_MIGRATE_STATUS, Seq: version, Token: token})
+		err = requestError(resp, err)
+		if err != nil || resp.Done {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+/* Send req to every node in groups, followers included */
+func (sc *ShardedClient) broadcast(ctx context.Context, groups []sharding.Group, req *communication.Request) error {
+	for _, group := range groups {
+		for _, seed := range group.Seeds {
+			config := sc.config
+			config.Seeds, config.LazyConnect, config.MaxRedirects = []string{seed}, true, -1
+			client, err := NewClient(config)
+			if err != nil {
+				return err
+			}
+			err = requestError(client.DoContext(ctx, req))
+			client.Close()
+			if err != nil {
+				return fmt.Errorf("%s to %s: %w", req.Op, seed, err)
+			}
+		}
+	}
+	return nil
+}
+
+func requestError(response *communication.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return responseError(response)
+}
@@ -0,0 +1,92 @@
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	Every message on the wire is
+
+	| payload length (4 bytes, big endian) | payload |
+
+	so that a message can be read back exactly no matter how the bytes were split or coalesced by the connection.
+*/
+
+const (
+	HEADER_LEN               = 4
+	DEFAULT_MAX_MESSAGE_SIZE = 64 << 20
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds maximum message size")
+
+/* Write msg as a single frame, maxSize <= 0 means DEFAULT_MAX_MESSAGE_SIZE */
+func WriteMessage(w io.Writer, msg []byte, maxSize int) error {
+	maxSize = maxMessageSize(maxSize)
+	if len(msg) > maxSize {
+		return fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, len(msg), maxSize)
+	}
+
+	/* Single write so that concurrent writers never interleave a header with someone else's payload */
+	frame := make([]byte, HEADER_LEN+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[HEADER_LEN:], msg)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+/*
+	Read a single frame, returns io.EOF only if the reader ended cleanly between frames.
+	An oversized frame is skipped over and reported as ErrMessageTooLarge, so the reader can carry on with the next frame.
+*/
+func ReadMessage(r io.Reader, maxSize int) ([]byte, error) {
+	return ReadMessageOrSkip(r, maxSize, nil)
+}
+
+/*
+	Like ReadMessage, but an oversized frame's payload is first handed to skip (if not nil), limited to the frame, so that
+	the caller can pick out what it needs on the way past. Whatever skip leaves unread is discarded.
+*/
+func ReadMessageOrSkip(r io.Reader, maxSize int, skip func(payload io.Reader)) ([]byte, error) {
+	maxSize = maxMessageSize(maxSize)
+
+	header := make([]byte, HEADER_LEN)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	msgLen := binary.BigEndian.Uint32(header)
+	if uint64(msgLen) > uint64(maxSize) {
+		payload := &io.LimitedReader{R: r, N: int64(msgLen)}
+		if skip != nil {
+			skip(payload)
+		}
+		if _, err := io.CopyN(io.Discard, payload, payload.N); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, msgLen, maxSize)
+	}
+
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func maxMessageSize(maxSize int) int {
+	if maxSize <= 0 {
+		return DEFAULT_MAX_MESSAGE_SIZE
+	}
+	return maxSize
+}
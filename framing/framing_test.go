@@ -0,0 +1,102 @@
+package framing
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadWriteMessage(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 800000) /* 8MB */
+
+	tcs := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{name: "whole reads", wrap: func(r io.Reader) io.Reader { return r }},
+		{name: "one byte reads", wrap: iotest.OneByteReader},
+		{name: "half reads", wrap: iotest.HalfReader},
+		{name: "data error on last read", wrap: iotest.DataErrReader},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			/* Back to back messages coalesced into one buffer */
+			msgs := [][]byte{[]byte("first"), {}, large, []byte("last")}
+			var buf bytes.Buffer
+			for _, msg := range msgs {
+				require.NoError(t, WriteMessage(&buf, msg, 16<<20))
+			}
+
+			r := tc.wrap(&buf)
+			for _, msg := range msgs {
+				got, err := ReadMessage(r, 16<<20)
+				require.NoError(t, err)
+				require.Equal(t, msg, got)
+			}
+			_, err := ReadMessage(r, 16<<20)
+			require.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+/* A multi megabyte message over a real connection arrives split across many reads */
+func TestReadMessageOverConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	msg := bytes.Repeat([]byte("x"), 5<<20)
+	go func() {
+		WriteMessage(client, msg, 0)
+	}()
+
+	got, err := ReadMessage(server, 0)
+	require.NoError(t, err)
+	require.Equal(t, msg, got)
+}
+
+func TestPartialMessage(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteMessage(&buf, []byte("truncated"), 0))
+	buf.Truncate(buf.Len() - 3)
+
+	_, err := ReadMessage(&buf, 0)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteMessage(&buf, make([]byte, 11), 10)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Zero(t, buf.Len())
+
+	/* The oversized frame is skipped, the next one is still readable */
+	require.NoError(t, WriteMessage(&buf, make([]byte, 11), 0))
+	require.NoError(t, WriteMessage(&buf, []byte("next"), 0))
+	_, err = ReadMessage(&buf, 10)
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	msg, err := ReadMessage(&buf, 10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), msg)
+
+	/* skip sees the start of the oversized payload, and never reads past it */
+	require.NoError(t, WriteMessage(&buf, []byte("oversized payload"), 0))
+	require.NoError(t, WriteMessage(&buf, []byte("next"), 0))
+	var head []byte
+	_, err = ReadMessageOrSkip(&buf, 10, func(payload io.Reader) {
+		head = make([]byte, 9)
+		io.ReadFull(payload, head)
+		rest, _ := io.ReadAll(payload)
+		require.Equal(t, []byte(" payload"), rest)
+	})
+	require.ErrorIs(t, err, ErrMessageTooLarge)
+	require.Equal(t, []byte("oversized"), head)
+	msg, err = ReadMessage(&buf, 10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), msg)
+}
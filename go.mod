@@ -2,10 +2,13 @@ module github.com/chettriyuvraj/distributed-kv-store
 
 go 1.20
 
+require (
+	github.com/stretchr/testify v1.9.0
+	google.golang.org/protobuf v1.34.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
-	google.golang.org/protobuf v1.34.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,11 @@
+package hashing
+
+/* Spread the bits of x over the whole word (the murmur3 finalizer), FNV alone leaves similar inputs with similar high bits */
+func Mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
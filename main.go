@@ -3,12 +3,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/chettriyuvraj/distributed-kv-store/distdb"
 	"github.com/chettriyuvraj/distributed-kv-store/distdbclient"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
 )
 
 const (
@@ -16,41 +24,115 @@ const (
 	CLIENT                  = "client"
 	DEFAULT_SERVER_PROTOCOL = "tcp"
 	DEFAULT_SERVER_HOST     = "localhost"
+	SHUTDOWN_TIMEOUT        = 10 * time.Second
+	JOIN                    = "join"
+	REPLICATION_TOKEN_ENV   = "KV_REPLICATION_TOKEN" /* Shared secret of the cluster, sent by its nodes and by the client for membership changes and checks, see distdb.DBConfig.ReplicationToken */
 )
 
 func main() {
 	if len(os.Args) < 3 {
-		log.Fatalf("usage: kv <'client'|'server'> <port> [filename]")
+		log.Fatalf("usage: kv <'client'|'server'> <port[,port...]> [filename] [raft id] [raft peers as id=host:port,... | 'join']")
 	}
 
 	switch os.Args[1] {
 	case SERVER:
 		port, filename := os.Args[2], os.Args[3]
-		runServer(port, filename)
+		var raftID, raftPeers string
+		if len(os.Args) > 5 {
+			raftID, raftPeers = os.Args[4], os.Args[5]
+		}
+		runServer(port, filename, raftID, raftPeers)
 	case CLIENT:
-		port := os.Args[2]
-		runClient(port)
+		ports := os.Args[2]
+		runClient(ports)
 	default:
 		log.Fatalf("invalid argument")
 	}
 
 }
 
-func runServer(port, filename string) {
-	config := distdb.DBConfig{Persist: true, Role: distdb.LEADER, DiskFileName: filename, ServerPort: port, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST}
+/*
+	Run alone as the leader, or as part of a raft cluster if raftID is given. raftPeers "join" waits to be added to a
+	running cluster. Raft nodes need the same REPLICATION_TOKEN_ENV set.
+*/
+func runServer(port, filename, raftID, raftPeers string) {
+	config := distdb.DBConfig{Persist: true, Role: distdb.LEADER, DiskFileName: filename, ServerPort: port, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST,
+		ReplicationToken: os.Getenv(REPLICATION_TOKEN_ENV)}
+	if raftID != "" && config.ReplicationToken == "" {
+		log.Fatalf("raft nodes need a replication token, set %s", REPLICATION_TOKEN_ENV)
+	}
+	if raftPeers == JOIN {
+		config.RaftID, config.RaftJoin = raftID, true
+	} else if raftID != "" {
+		peers, err := parseRaftPeers(raftPeers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.RaftID, config.RaftPeers = raftID, peers
+	}
 	db, err := distdb.NewDB(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	/* Shut down gracefully on SIGINT/SIGTERM */
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		fmt.Printf("\nReceived %s, shutting down...\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		err := db.Shutdown(ctx)
+		if err != nil {
+			log.Printf("error shutting down: %v", err)
+		}
+	}()
+
 	err = db.Listen()
-	if err != nil {
+	if err != nil && !errors.Is(err, distdb.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	<-shutdownDone
 }
 
-func runClient(port string) {
-	config := distdbclient.ClientConfig{ServerPort: port, ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: DEFAULT_SERVER_HOST}
+/* Parse id=host:port,id=host:port,... (every node, including this one) */
+func parseRaftPeers(s string) (map[string]distdbclient.ClientConfig, error) {
+	peers := map[string]distdbclient.ClientConfig{}
+	for _, peer := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(peer, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid raft peer %q, want id=host:port", peer)
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid raft peer %q: %w", peer, err)
+		}
+		peers[id] = distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL, ServerHost: host, ServerPort: port}
+	}
+	return peers, nil
+}
+
+/* Ask the follower at addr how it differs from its leader, without repairing anything. Needs REPLICATION_TOKEN_ENV set */
+func checkReplica(config distdbclient.ClientConfig, addr string) (*communication.Divergence, error) {
+	config.Seeds, config.MaxRedirects = []string{addr}, -1
+	client, err := distdbclient.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.CheckReplica(context.Background(), false, os.Getenv(REPLICATION_TOKEN_ENV))
+}
+
+/* ports may list every node in a cluster separated by commas, the client finds the leader among them */
+func runClient(ports string) {
+	config := distdbclient.ClientConfig{ServerProtocol: DEFAULT_SERVER_PROTOCOL}
+	for _, port := range strings.Split(ports, ",") {
+		config.Seeds = append(config.Seeds, net.JoinHostPort(DEFAULT_SERVER_HOST, port))
+	}
 	client, err := distdbclient.NewClient(config)
 	if err != nil {
 		log.Fatal(err)
@@ -77,6 +159,26 @@ func runClient(port string) {
 			}
 			fmt.Printf("\nVal is %s\n", string(v))
 
+		case bytes.Equal(op, []byte("MGET")):
+			/* Ask for the keys to GET, separated by spaces */
+			fmt.Println("Enter keys to GET!")
+			if !scanner.Scan() {
+				return
+			}
+			keys := bytes.Fields(append([]byte{}, scanner.Bytes()...))
+			results, err := client.GetMany(context.Background(), keys)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for i, result := range results {
+				if !result.Found {
+					fmt.Printf("%s not found\n", keys[i])
+					continue
+				}
+				fmt.Printf("%s: %s\n", keys[i], result.Val)
+			}
+
 		case bytes.Equal(op, []byte("PUT")):
 			/* Ask for key and val to PUT */
 			fmt.Println("Enter key and val to PUT!")
@@ -99,6 +201,95 @@ func runClient(port string) {
 				return
 			}
 			fmt.Println("Success!")
+
+		case bytes.Equal(op, []byte("DELETE")):
+			/* Ask for key to DELETE */
+			fmt.Println("Enter key to DELETE!")
+			isNext := scanner.Scan()
+			if !isNext {
+				fmt.Printf("error accepting key for DELETE %v", err)
+				return
+			}
+			k := scanner.Bytes()
+			err := client.Delete(k)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println("Success!")
+
+		case bytes.Equal(op, []byte("ADD_MEMBER")), bytes.Equal(op, []byte("REMOVE_MEMBER")):
+			/* Ask for the node's raft ID, and its host:port if adding. Needs REPLICATION_TOKEN_ENV set */
+			add := bytes.Equal(op, []byte("ADD_MEMBER"))
+			fmt.Println("Enter raft ID!")
+			if !scanner.Scan() {
+				return
+			}
+			id := scanner.Text()
+			if add {
+				fmt.Println("Enter host:port!")
+				if !scanner.Scan() {
+					return
+				}
+				err = client.AddMember(context.Background(), id, scanner.Text(), os.Getenv(REPLICATION_TOKEN_ENV))
+			} else {
+				err = client.RemoveMember(context.Background(), id, os.Getenv(REPLICATION_TOKEN_ENV))
+			}
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println("Success!")
+		case bytes.Equal(op, []byte("CHECK")):
+			/* Ask for the follower to compare with its leader, differences are reported but not repaired */
+			fmt.Println("Enter host:port of the follower!")
+			if !scanner.Scan() {
+				return
+			}
+			divergence, err := checkReplica(config, scanner.Text())
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("\nFollower at seq %d, leader at seq %d, %d ranges differ: %d keys missing, %d extra, %d different\n",
+				divergence.Seq, divergence.LeaderSeq, len(divergence.Ranges), len(divergence.Missing), len(divergence.Extra), len(divergence.Different))
+			if divergence.Lagging {
+				fmt.Println("The follower was behind the leader, some of these may be writes it has yet to get")
+			}
+		case bytes.Equal(op, []byte("SCAN")):
+			/* Ask for the start and end of the range, an empty end scans to the last key */
+			fmt.Println("Enter start and end keys to SCAN!")
+			if !scanner.Scan() {
+				return
+			}
+			start := append([]byte{}, scanner.Bytes()...)
+			if !scanner.Scan() {
+				return
+			}
+			var end []byte
+			if len(scanner.Bytes()) > 0 {
+				end = append([]byte{}, scanner.Bytes()...)
+			}
+			it := client.Scan(context.Background(), start, end, 0)
+			for it.Next() {
+				fmt.Printf("%s: %s\n", it.Key(), it.Val())
+			}
+			if it.Err() != nil {
+				fmt.Println(it.Err())
+			}
+		case bytes.Equal(op, []byte("LIST")):
+			/* Ask for the prefix, only keys are listed */
+			fmt.Println("Enter prefix to LIST!")
+			if !scanner.Scan() {
+				return
+			}
+			it := client.ListPrefix(context.Background(), append([]byte{}, scanner.Bytes()...), 0, true)
+			for it.Next() {
+				fmt.Printf("%s\n", it.Key())
+			}
+			if it.Err() != nil {
+				fmt.Println(it.Err())
+			}
 		default:
 			fmt.Println("Invalid operation!")
 		}
@@ -0,0 +1,214 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.0
+// 	protoc        v5.26.1
+// source: antientropy.proto
+
+package communication
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// How a follower's entries differ from its leader's, see distdb's anti-entropy
+type Divergence struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LeaderSeq uint64   `protobuf:"varint,1,opt,name=leader_seq,json=leaderSeq,proto3" json:"leader_seq,omitempty"` // Last write the leader had applied when it was compared with
+	Seq       uint64   `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`                              // Last write the follower had applied, differences are expected while this is behind leader_seq
+	Ranges    []uint64 `protobuf:"varint,3,rep,packed,name=ranges,proto3" json:"ranges,omitempty"`                 // Merkle tree leaves that differ
+	Missing   [][]byte `protobuf:"bytes,4,rep,name=missing,proto3" json:"missing,omitempty"`                       // Keys the leader has and the follower doesn't
+	Extra     [][]byte `protobuf:"bytes,5,rep,name=extra,proto3" json:"extra,omitempty"`                           // Keys the follower has and the leader doesn't
+	Different [][]byte `protobuf:"bytes,6,rep,name=different,proto3" json:"different,omitempty"`                   // Keys whose values differ
+	Repaired  bool     `protobuf:"varint,7,opt,name=repaired,proto3" json:"repaired,omitempty"`                    // The follower has taken the leader's entries for every differing key
+	Lagging   bool     `protobuf:"varint,8,opt,name=lagging,proto3" json:"lagging,omitempty"`                      // seq was behind leader_seq during the comparison, some of the differences may be writes still on their way
+}
+
+func (x *Divergence) Reset() {
+	*x = Divergence{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_antientropy_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Divergence) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Divergence) ProtoMessage() {}
+
+func (x *Divergence) ProtoReflect() protoreflect.Message {
+	mi := &file_antientropy_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Divergence.ProtoReflect.Descriptor instead.
+func (*Divergence) Descriptor() ([]byte, []int) {
+	return file_antientropy_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Divergence) GetLeaderSeq() uint64 {
+	if x != nil {
+		return x.LeaderSeq
+	}
+	return 0
+}
+
+func (x *Divergence) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Divergence) GetRanges() []uint64 {
+	if x != nil {
+		return x.Ranges
+	}
+	return nil
+}
+
+func (x *Divergence) GetMissing() [][]byte {
+	if x != nil {
+		return x.Missing
+	}
+	return nil
+}
+
+func (x *Divergence) GetExtra() [][]byte {
+	if x != nil {
+		return x.Extra
+	}
+	return nil
+}
+
+func (x *Divergence) GetDifferent() [][]byte {
+	if x != nil {
+		return x.Different
+	}
+	return nil
+}
+
+func (x *Divergence) GetRepaired() bool {
+	if x != nil {
+		return x.Repaired
+	}
+	return false
+}
+
+func (x *Divergence) GetLagging() bool {
+	if x != nil {
+		return x.Lagging
+	}
+	return false
+}
+
+var File_antientropy_proto protoreflect.FileDescriptor
+
+var file_antientropy_proto_rawDesc = []byte{
+	0x0a, 0x11, 0x61, 0x6e, 0x74, 0x69, 0x65, 0x6e, 0x74, 0x72, 0x6f, 0x70, 0x79, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x22, 0xd9, 0x01, 0x0a, 0x0a, 0x44, 0x69, 0x76, 0x65, 0x72, 0x67, 0x65, 0x6e, 0x63,
+	0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x5f, 0x73, 0x65, 0x71, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x53, 0x65, 0x71,
+	0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73,
+	0x65, 0x71, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x04, 0x52, 0x06, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x69,
+	0x73, 0x73, 0x69, 0x6e, 0x67, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x07, 0x6d, 0x69, 0x73,
+	0x73, 0x69, 0x6e, 0x67, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x78, 0x74, 0x72, 0x61, 0x18, 0x05, 0x20,
+	0x03, 0x28, 0x0c, 0x52, 0x05, 0x65, 0x78, 0x74, 0x72, 0x61, 0x12, 0x1c, 0x0a, 0x09, 0x64, 0x69,
+	0x66, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x74, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x09, 0x64,
+	0x69, 0x66, 0x66, 0x65, 0x72, 0x65, 0x6e, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x72, 0x65, 0x70, 0x61,
+	0x69, 0x72, 0x65, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x72, 0x65, 0x70, 0x61,
+	0x69, 0x72, 0x65, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x6c, 0x61, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x18,
+	0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x6c, 0x61, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x42, 0x3d,
+	0x5a, 0x3b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x68, 0x65,
+	0x74, 0x74, 0x72, 0x69, 0x79, 0x75, 0x76, 0x72, 0x61, 0x6a, 0x2f, 0x64, 0x69, 0x73, 0x74, 0x72,
+	0x69, 0x62, 0x75, 0x74, 0x65, 0x64, 0x2d, 0x6b, 0x76, 0x2d, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2f,
+	0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_antientropy_proto_rawDescOnce sync.Once
+	file_antientropy_proto_rawDescData = file_antientropy_proto_rawDesc
+)
+
+func file_antientropy_proto_rawDescGZIP() []byte {
+	file_antientropy_proto_rawDescOnce.Do(func() {
+		file_antientropy_proto_rawDescData = protoimpl.X.CompressGZIP(file_antientropy_proto_rawDescData)
+	})
+	return file_antientropy_proto_rawDescData
+}
+
+var file_antientropy_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_antientropy_proto_goTypes = []interface{}{
+	(*Divergence)(nil), // 0: communication.Divergence
+}
+var file_antientropy_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_antientropy_proto_init() }
+func file_antientropy_proto_init() {
+	if File_antientropy_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_antientropy_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Divergence); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_antientropy_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_antientropy_proto_goTypes,
+		DependencyIndexes: file_antientropy_proto_depIdxs,
+		MessageInfos:      file_antientropy_proto_msgTypes,
+	}.Build()
+	File_antientropy_proto = out.File
+	file_antientropy_proto_rawDesc = nil
+	file_antientropy_proto_goTypes = nil
+	file_antientropy_proto_depIdxs = nil
+}
@@ -0,0 +1,540 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.0
+// 	protoc        v5.26.1
+// source: raft.proto
+
+package communication
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type RaftMessageType int32
+
+const (
+	RaftMessageType_DUMMYRAFT              RaftMessageType = 0
+	RaftMessageType_RAFT_VOTE              RaftMessageType = 1
+	RaftMessageType_RAFT_VOTE_RESPONSE     RaftMessageType = 2
+	RaftMessageType_RAFT_APPEND            RaftMessageType = 3
+	RaftMessageType_RAFT_APPEND_RESPONSE   RaftMessageType = 4
+	RaftMessageType_RAFT_SNAPSHOT          RaftMessageType = 5
+	RaftMessageType_RAFT_SNAPSHOT_RESPONSE RaftMessageType = 6
+)
+
+// Enum value maps for RaftMessageType.
+var (
+	RaftMessageType_name = map[int32]string{
+		0: "DUMMYRAFT",
+		1: "RAFT_VOTE",
+		2: "RAFT_VOTE_RESPONSE",
+		3: "RAFT_APPEND",
+		4: "RAFT_APPEND_RESPONSE",
+		5: "RAFT_SNAPSHOT",
+		6: "RAFT_SNAPSHOT_RESPONSE",
+	}
+	RaftMessageType_value = map[string]int32{
+		"DUMMYRAFT":              0,
+		"RAFT_VOTE":              1,
+		"RAFT_VOTE_RESPONSE":     2,
+		"RAFT_APPEND":            3,
+		"RAFT_APPEND_RESPONSE":   4,
+		"RAFT_SNAPSHOT":          5,
+		"RAFT_SNAPSHOT_RESPONSE": 6,
+	}
+)
+
+func (x RaftMessageType) Enum() *RaftMessageType {
+	p := new(RaftMessageType)
+	*p = x
+	return p
+}
+
+func (x RaftMessageType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (RaftMessageType) Descriptor() protoreflect.EnumDescriptor {
+	return file_raft_proto_enumTypes[0].Descriptor()
+}
+
+func (RaftMessageType) Type() protoreflect.EnumType {
+	return &file_raft_proto_enumTypes[0]
+}
+
+func (x RaftMessageType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use RaftMessageType.Descriptor instead.
+func (RaftMessageType) EnumDescriptor() ([]byte, []int) {
+	return file_raft_proto_rawDescGZIP(), []int{0}
+}
+
+// Every raft RPC and its response, fields are only set for the types noted next to them
+type RaftMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type           RaftMessageType `protobuf:"varint,1,opt,name=type,proto3,enum=communication.RaftMessageType" json:"type,omitempty"`
+	Term           uint64          `protobuf:"varint,2,opt,name=term,proto3" json:"term,omitempty"`
+	From           string          `protobuf:"bytes,3,opt,name=from,proto3" json:"from,omitempty"`
+	LastLogIndex   uint64          `protobuf:"varint,4,opt,name=last_log_index,json=lastLogIndex,proto3" json:"last_log_index,omitempty"`      // RAFT_VOTE
+	LastLogTerm    uint64          `protobuf:"varint,5,opt,name=last_log_term,json=lastLogTerm,proto3" json:"last_log_term,omitempty"`         // RAFT_VOTE
+	Granted        bool            `protobuf:"varint,6,opt,name=granted,proto3" json:"granted,omitempty"`                                      // RAFT_VOTE_RESPONSE
+	PrevLogIndex   uint64          `protobuf:"varint,7,opt,name=prev_log_index,json=prevLogIndex,proto3" json:"prev_log_index,omitempty"`      // RAFT_APPEND
+	PrevLogTerm    uint64          `protobuf:"varint,8,opt,name=prev_log_term,json=prevLogTerm,proto3" json:"prev_log_term,omitempty"`         // RAFT_APPEND
+	Entries        []*LogRecord    `protobuf:"bytes,9,rep,name=entries,proto3" json:"entries,omitempty"`                                       // RAFT_APPEND, and a page of every live entry as PUTs for RAFT_SNAPSHOT
+	LeaderCommit   uint64          `protobuf:"varint,10,opt,name=leader_commit,json=leaderCommit,proto3" json:"leader_commit,omitempty"`       // RAFT_APPEND
+	Success        bool            `protobuf:"varint,11,opt,name=success,proto3" json:"success,omitempty"`                                     // RAFT_APPEND_RESPONSE, RAFT_SNAPSHOT_RESPONSE
+	MatchIndex     uint64          `protobuf:"varint,12,opt,name=match_index,json=matchIndex,proto3" json:"match_index,omitempty"`             // RAFT_APPEND_RESPONSE: last index known to match the leader's log, on failure a hint where to retry from. RAFT_SNAPSHOT_RESPONSE: snapshot_index once installed, 0 while pages are being staged
+	SnapshotIndex  uint64          `protobuf:"varint,13,opt,name=snapshot_index,json=snapshotIndex,proto3" json:"snapshot_index,omitempty"`    // RAFT_SNAPSHOT
+	SnapshotTerm   uint64          `protobuf:"varint,14,opt,name=snapshot_term,json=snapshotTerm,proto3" json:"snapshot_term,omitempty"`       // RAFT_SNAPSHOT
+	Members        []*RaftMember   `protobuf:"bytes,15,rep,name=members,proto3" json:"members,omitempty"`                                      // RAFT_SNAPSHOT, the cluster's membership as of snapshot_index
+	NeedsSnapshot  bool            `protobuf:"varint,16,opt,name=needs_snapshot,json=needsSnapshot,proto3" json:"needs_snapshot,omitempty"`    // RAFT_APPEND_RESPONSE, the node has just joined and has no membership to apply the log on top of
+	SnapshotOffset uint64          `protobuf:"varint,17,opt,name=snapshot_offset,json=snapshotOffset,proto3" json:"snapshot_offset,omitempty"` // RAFT_SNAPSHOT, entries sent in the earlier pages of the snapshot
+	SnapshotDone   bool            `protobuf:"varint,18,opt,name=snapshot_done,json=snapshotDone,proto3" json:"snapshot_done,omitempty"`       // RAFT_SNAPSHOT, the last page, the snapshot is installed once it is in
+}
+
+func (x *RaftMessage) Reset() {
+	*x = RaftMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_raft_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaftMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaftMessage) ProtoMessage() {}
+
+func (x *RaftMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_raft_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaftMessage.ProtoReflect.Descriptor instead.
+func (*RaftMessage) Descriptor() ([]byte, []int) {
+	return file_raft_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RaftMessage) GetType() RaftMessageType {
+	if x != nil {
+		return x.Type
+	}
+	return RaftMessageType_DUMMYRAFT
+}
+
+func (x *RaftMessage) GetTerm() uint64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *RaftMessage) GetLastLogIndex() uint64 {
+	if x != nil {
+		return x.LastLogIndex
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetLastLogTerm() uint64 {
+	if x != nil {
+		return x.LastLogTerm
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetGranted() bool {
+	if x != nil {
+		return x.Granted
+	}
+	return false
+}
+
+func (x *RaftMessage) GetPrevLogIndex() uint64 {
+	if x != nil {
+		return x.PrevLogIndex
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetPrevLogTerm() uint64 {
+	if x != nil {
+		return x.PrevLogTerm
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetEntries() []*LogRecord {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+func (x *RaftMessage) GetLeaderCommit() uint64 {
+	if x != nil {
+		return x.LeaderCommit
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *RaftMessage) GetMatchIndex() uint64 {
+	if x != nil {
+		return x.MatchIndex
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetSnapshotIndex() uint64 {
+	if x != nil {
+		return x.SnapshotIndex
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetSnapshotTerm() uint64 {
+	if x != nil {
+		return x.SnapshotTerm
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetMembers() []*RaftMember {
+	if x != nil {
+		return x.Members
+	}
+	return nil
+}
+
+func (x *RaftMessage) GetNeedsSnapshot() bool {
+	if x != nil {
+		return x.NeedsSnapshot
+	}
+	return false
+}
+
+func (x *RaftMessage) GetSnapshotOffset() uint64 {
+	if x != nil {
+		return x.SnapshotOffset
+	}
+	return 0
+}
+
+func (x *RaftMessage) GetSnapshotDone() bool {
+	if x != nil {
+		return x.SnapshotDone
+	}
+	return false
+}
+
+type RaftMember struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Addr string `protobuf:"bytes,2,opt,name=addr,proto3" json:"addr,omitempty"` // host:port
+}
+
+func (x *RaftMember) Reset() {
+	*x = RaftMember{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_raft_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaftMember) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaftMember) ProtoMessage() {}
+
+func (x *RaftMember) ProtoReflect() protoreflect.Message {
+	mi := &file_raft_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaftMember.ProtoReflect.Descriptor instead.
+func (*RaftMember) Descriptor() ([]byte, []int) {
+	return file_raft_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RaftMember) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *RaftMember) GetAddr() string {
+	if x != nil {
+		return x.Addr
+	}
+	return ""
+}
+
+// Membership as of a raft log's snapshot index, kept in the log's header
+type RaftMembership struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Members []*RaftMember `protobuf:"bytes,1,rep,name=members,proto3" json:"members,omitempty"`
+}
+
+func (x *RaftMembership) Reset() {
+	*x = RaftMembership{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_raft_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RaftMembership) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RaftMembership) ProtoMessage() {}
+
+func (x *RaftMembership) ProtoReflect() protoreflect.Message {
+	mi := &file_raft_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RaftMembership.ProtoReflect.Descriptor instead.
+func (*RaftMembership) Descriptor() ([]byte, []int) {
+	return file_raft_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RaftMembership) GetMembers() []*RaftMember {
+	if x != nil {
+		return x.Members
+	}
+	return nil
+}
+
+var File_raft_proto protoreflect.FileDescriptor
+
+var file_raft_proto_rawDesc = []byte{
+	0x0a, 0x0a, 0x72, 0x61, 0x66, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x63, 0x6f,
+	0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x1a, 0x11, 0x70, 0x65, 0x72,
+	0x73, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x63, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xa1,
+	0x05, 0x0a, 0x0b, 0x52, 0x61, 0x66, 0x74, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x32,
+	0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1e, 0x2e, 0x63,
+	0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x52, 0x61, 0x66,
+	0x74, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79,
+	0x70, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x24, 0x0a, 0x0e, 0x6c, 0x61,
+	0x73, 0x74, 0x5f, 0x6c, 0x6f, 0x67, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x04, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x0c, 0x6c, 0x61, 0x73, 0x74, 0x4c, 0x6f, 0x67, 0x49, 0x6e, 0x64, 0x65, 0x78,
+	0x12, 0x22, 0x0a, 0x0d, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x6c, 0x6f, 0x67, 0x5f, 0x74, 0x65, 0x72,
+	0x6d, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x6c, 0x61, 0x73, 0x74, 0x4c, 0x6f, 0x67,
+	0x54, 0x65, 0x72, 0x6d, 0x12, 0x18, 0x0a, 0x07, 0x67, 0x72, 0x61, 0x6e, 0x74, 0x65, 0x64, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x67, 0x72, 0x61, 0x6e, 0x74, 0x65, 0x64, 0x12, 0x24,
+	0x0a, 0x0e, 0x70, 0x72, 0x65, 0x76, 0x5f, 0x6c, 0x6f, 0x67, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78,
+	0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x70, 0x72, 0x65, 0x76, 0x4c, 0x6f, 0x67, 0x49,
+	0x6e, 0x64, 0x65, 0x78, 0x12, 0x22, 0x0a, 0x0d, 0x70, 0x72, 0x65, 0x76, 0x5f, 0x6c, 0x6f, 0x67,
+	0x5f, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x08, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0b, 0x70, 0x72, 0x65,
+	0x76, 0x4c, 0x6f, 0x67, 0x54, 0x65, 0x72, 0x6d, 0x12, 0x32, 0x0a, 0x07, 0x65, 0x6e, 0x74, 0x72,
+	0x69, 0x65, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d,
+	0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x4c, 0x6f, 0x67, 0x52, 0x65, 0x63,
+	0x6f, 0x72, 0x64, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x12, 0x23, 0x0a, 0x0d,
+	0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x5f, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x18, 0x0a, 0x20,
+	0x01, 0x28, 0x04, 0x52, 0x0c, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x43, 0x6f, 0x6d, 0x6d, 0x69,
+	0x74, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x18, 0x0b, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x07, 0x73, 0x75, 0x63, 0x63, 0x65, 0x73, 0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x6d,
+	0x61, 0x74, 0x63, 0x68, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x0a, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x25, 0x0a, 0x0e,
+	0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x0d,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x0d, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x49, 0x6e,
+	0x64, 0x65, 0x78, 0x12, 0x23, 0x0a, 0x0d, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f,
+	0x74, 0x65, 0x72, 0x6d, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x73, 0x6e, 0x61, 0x70,
+	0x73, 0x68, 0x6f, 0x74, 0x54, 0x65, 0x72, 0x6d, 0x12, 0x33, 0x0a, 0x07, 0x6d, 0x65, 0x6d, 0x62,
+	0x65, 0x72, 0x73, 0x18, 0x0f, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x6d, 0x6d,
+	0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x52, 0x61, 0x66, 0x74, 0x4d, 0x65,
+	0x6d, 0x62, 0x65, 0x72, 0x52, 0x07, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x73, 0x12, 0x25, 0x0a,
+	0x0e, 0x6e, 0x65, 0x65, 0x64, 0x73, 0x5f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x18,
+	0x10, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0d, 0x6e, 0x65, 0x65, 0x64, 0x73, 0x53, 0x6e, 0x61, 0x70,
+	0x73, 0x68, 0x6f, 0x74, 0x12, 0x27, 0x0a, 0x0f, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74,
+	0x5f, 0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x11, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0e, 0x73,
+	0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x23, 0x0a,
+	0x0d, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x5f, 0x64, 0x6f, 0x6e, 0x65, 0x18, 0x12,
+	0x20, 0x01, 0x28, 0x08, 0x52, 0x0c, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x44, 0x6f,
+	0x6e, 0x65, 0x22, 0x30, 0x0a, 0x0a, 0x52, 0x61, 0x66, 0x74, 0x4d, 0x65, 0x6d, 0x62, 0x65, 0x72,
+	0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64,
+	0x12, 0x12, 0x0a, 0x04, 0x61, 0x64, 0x64, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
+	0x61, 0x64, 0x64, 0x72, 0x22, 0x45, 0x0a, 0x0e, 0x52, 0x61, 0x66, 0x74, 0x4d, 0x65, 0x6d, 0x62,
+	0x65, 0x72, 0x73, 0x68, 0x69, 0x70, 0x12, 0x33, 0x0a, 0x07, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72,
+	0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e,
+	0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x52, 0x61, 0x66, 0x74, 0x4d, 0x65, 0x6d, 0x62,
+	0x65, 0x72, 0x52, 0x07, 0x6d, 0x65, 0x6d, 0x62, 0x65, 0x72, 0x73, 0x2a, 0xa1, 0x01, 0x0a, 0x0f,
+	0x52, 0x61, 0x66, 0x74, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12,
+	0x0d, 0x0a, 0x09, 0x44, 0x55, 0x4d, 0x4d, 0x59, 0x52, 0x41, 0x46, 0x54, 0x10, 0x00, 0x12, 0x0d,
+	0x0a, 0x09, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x56, 0x4f, 0x54, 0x45, 0x10, 0x01, 0x12, 0x16, 0x0a,
+	0x12, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x56, 0x4f, 0x54, 0x45, 0x5f, 0x52, 0x45, 0x53, 0x50, 0x4f,
+	0x4e, 0x53, 0x45, 0x10, 0x02, 0x12, 0x0f, 0x0a, 0x0b, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x41, 0x50,
+	0x50, 0x45, 0x4e, 0x44, 0x10, 0x03, 0x12, 0x18, 0x0a, 0x14, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x41,
+	0x50, 0x50, 0x45, 0x4e, 0x44, 0x5f, 0x52, 0x45, 0x53, 0x50, 0x4f, 0x4e, 0x53, 0x45, 0x10, 0x04,
+	0x12, 0x11, 0x0a, 0x0d, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x53, 0x4e, 0x41, 0x50, 0x53, 0x48, 0x4f,
+	0x54, 0x10, 0x05, 0x12, 0x1a, 0x0a, 0x16, 0x52, 0x41, 0x46, 0x54, 0x5f, 0x53, 0x4e, 0x41, 0x50,
+	0x53, 0x48, 0x4f, 0x54, 0x5f, 0x52, 0x45, 0x53, 0x50, 0x4f, 0x4e, 0x53, 0x45, 0x10, 0x06, 0x42,
+	0x3d, 0x5a, 0x3b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x68,
+	0x65, 0x74, 0x74, 0x72, 0x69, 0x79, 0x75, 0x76, 0x72, 0x61, 0x6a, 0x2f, 0x64, 0x69, 0x73, 0x74,
+	0x72, 0x69, 0x62, 0x75, 0x74, 0x65, 0x64, 0x2d, 0x6b, 0x76, 0x2d, 0x73, 0x74, 0x6f, 0x72, 0x65,
+	0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x62, 0x06,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_raft_proto_rawDescOnce sync.Once
+	file_raft_proto_rawDescData = file_raft_proto_rawDesc
+)
+
+func file_raft_proto_rawDescGZIP() []byte {
+	file_raft_proto_rawDescOnce.Do(func() {
+		file_raft_proto_rawDescData = protoimpl.X.CompressGZIP(file_raft_proto_rawDescData)
+	})
+	return file_raft_proto_rawDescData
+}
+
+var file_raft_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_raft_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_raft_proto_goTypes = []interface{}{
+	(RaftMessageType)(0),   // 0: communication.RaftMessageType
+	(*RaftMessage)(nil),    // 1: communication.RaftMessage
+	(*RaftMember)(nil),     // 2: communication.RaftMember
+	(*RaftMembership)(nil), // 3: communication.RaftMembership
+	(*LogRecord)(nil),      // 4: communication.LogRecord
+}
+var file_raft_proto_depIdxs = []int32{
+	0, // 0: communication.RaftMessage.type:type_name -> communication.RaftMessageType
+	4, // 1: communication.RaftMessage.entries:type_name -> communication.LogRecord
+	2, // 2: communication.RaftMessage.members:type_name -> communication.RaftMember
+	2, // 3: communication.RaftMembership.members:type_name -> communication.RaftMember
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_raft_proto_init() }
+func file_raft_proto_init() {
+	if File_raft_proto != nil {
+		return
+	}
+	file_persistence_proto_init()
+	if !protoimpl.UnsafeEnabled {
+		file_raft_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RaftMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_raft_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RaftMember); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_raft_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*RaftMembership); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_raft_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_raft_proto_goTypes,
+		DependencyIndexes: file_raft_proto_depIdxs,
+		EnumInfos:         file_raft_proto_enumTypes,
+		MessageInfos:      file_raft_proto_msgTypes,
+	}.Build()
+	File_raft_proto = out.File
+	file_raft_proto_rawDesc = nil
+	file_raft_proto_goTypes = nil
+	file_raft_proto_depIdxs = nil
+}
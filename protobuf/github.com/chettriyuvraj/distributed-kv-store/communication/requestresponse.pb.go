@@ -23,22 +23,91 @@ const (
 type Operation int32
 
 const (
-	Operation_DUMMYOP Operation = 0
-	Operation_GET     Operation = 1
-	Operation_PUT     Operation = 2
+	Operation_DUMMYOP              Operation = 0
+	Operation_GET                  Operation = 1
+	Operation_PUT                  Operation = 2
+	Operation_DELETE               Operation = 3
+	Operation_PING                 Operation = 4  // Health check, always answered with SUCCESS
+	Operation_REPLICATE            Operation = 5  // Leader -> follower, apply the LogRecord in record
+	Operation_FETCH                Operation = 6  // Follower -> leader, writes after seq or a snapshot if the leader no longer has them
+	Operation_RAFT                 Operation = 7  // Node -> node, the RaftMessage in raft
+	Operation_NOOP                 Operation = 8  // Only in LogRecords, committed by a raft leader at the start of its term
+	Operation_ADD_MEMBER           Operation = 9  // Admin -> raft leader, add node key at host:port val to the cluster. Also in LogRecords
+	Operation_REMOVE_MEMBER        Operation = 10 // Admin -> raft leader, remove node key from the cluster. Also in LogRecords
+	Operation_SHARD_MAP            Operation = 11 // Client -> any node, the shard map the node routes by
+	Operation_SHARD_PREPARE        Operation = 12 // Admin -> every node, val is the encoded ShardMap a rebalance moves to
+	Operation_SHARD_MIGRATE        Operation = 13 // Admin -> group leader, start handing the keys moving away over to their owners in the map version seq
+	Operation_SHARD_TRANSFER       Operation = 14 // Group leader -> group leader, apply the LogRecords in records, keeping their key versions, whatever the shard map says
+	Operation_SHARD_HANDED_OFF     Operation = 15 // Group leader -> group leader, group key has handed over its keys moving to the map version seq
+	Operation_SHARD_COMMIT         Operation = 16 // Admin -> every node, route by the map version seq from now on
+	Operation_MERKLE               Operation = 17 // Follower -> leader, hashes of the Merkle tree nodes in nodes
+	Operation_MERKLE_RANGE         Operation = 18 // Follower -> leader, every entry in the Merkle tree leaves in nodes
+	Operation_CHECK_REPLICA        Operation = 19 // Admin -> follower, compare with the leader and report (and repair if repair is set) the differences
+	Operation_SCAN                 Operation = 20 // Client -> leader, a page of the entries from key up to end in key order
+	Operation_PREFIX_SCAN          Operation = 21 // Client -> leader, a page of the entries from key on that start with prefix in key order
+	Operation_BATCH                Operation = 22 // Client -> leader, apply the PUTs and DELETEs in records atomically. Also in LogRecords, with them in batch
+	Operation_MGET                 Operation = 23 // Client -> leader, the values of every key in keys
+	Operation_CAS                  Operation = 24 // Client -> leader, put val at key if condition holds. Also in the LogRecords of raft clusters
+	Operation_SHARD_MIGRATE_STATUS Operation = 25 // Admin -> group leader, whether SHARD_MIGRATE to the map version seq is done
 )
 
 // Enum value maps for Operation.
 var (
 	Operation_name = map[int32]string{
-		0: "DUMMYOP",
-		1: "GET",
-		2: "PUT",
+		0:  "DUMMYOP",
+		1:  "GET",
+		2:  "PUT",
+		3:  "DELETE",
+		4:  "PING",
+		5:  "REPLICATE",
+		6:  "FETCH",
+		7:  "RAFT",
+		8:  "NOOP",
+		9:  "ADD_MEMBER",
+		10: "REMOVE_MEMBER",
+		11: "SHARD_MAP",
+		12: "SHARD_PREPARE",
+		13: "SHARD_MIGRATE",
+		14: "SHARD_TRANSFER",
+		15: "SHARD_HANDED_OFF",
+		16: "SHARD_COMMIT",
+		17: "MERKLE",
+		18: "MERKLE_RANGE",
+		19: "CHECK_REPLICA",
+		20: "SCAN",
+		21: "PREFIX_SCAN",
+		22: "BATCH",
+		23: "MGET",
+		24: "CAS",
+		25: "SHARD_MIGRATE_STATUS",
 	}
 	Operation_value = map[string]int32{
-		"DUMMYOP": 0,
-		"GET":     1,
-		"PUT":     2,
+		"DUMMYOP":              0,
+		"GET":                  1,
+		"PUT":                  2,
+		"DELETE":               3,
+		"PING":                 4,
+		"REPLICATE":            5,
+		"FETCH":                6,
+		"RAFT":                 7,
+		"NOOP":                 8,
+		"ADD_MEMBER":           9,
+		"REMOVE_MEMBER":        10,
+		"SHARD_MAP":            11,
+		"SHARD_PREPARE":        12,
+		"SHARD_MIGRATE":        13,
+		"SHARD_TRANSFER":       14,
+		"SHARD_HANDED_OFF":     15,
+		"SHARD_COMMIT":         16,
+		"MERKLE":               17,
+		"MERKLE_RANGE":         18,
+		"CHECK_REPLICA":        19,
+		"SCAN":                 20,
+		"PREFIX_SCAN":          21,
+		"BATCH":                22,
+		"MGET":                 23,
+		"CAS":                  24,
+		"SHARD_MIGRATE_STATUS": 25,
 	}
 )
 
@@ -69,12 +138,68 @@ func (Operation) EnumDescriptor() ([]byte, []int) {
 	return file_requestresponse_proto_rawDescGZIP(), []int{0}
 }
 
+type Condition int32
+
+const (
+	Condition_DUMMYCONDITION Condition = 0
+	Condition_VERSION_EQUALS Condition = 1 // The key exists at expected_version
+	Condition_ABSENT         Condition = 2 // The key doesn't exist
+	Condition_VALUE_EQUALS   Condition = 3 // The key exists with expected_val
+)
+
+// Enum value maps for Condition.
+var (
+	Condition_name = map[int32]string{
+		0: "DUMMYCONDITION",
+		1: "VERSION_EQUALS",
+		2: "ABSENT",
+		3: "VALUE_EQUALS",
+	}
+	Condition_value = map[string]int32{
+		"DUMMYCONDITION": 0,
+		"VERSION_EQUALS": 1,
+		"ABSENT":         2,
+		"VALUE_EQUALS":   3,
+	}
+)
+
+func (x Condition) Enum() *Condition {
+	p := new(Condition)
+	*p = x
+	return p
+}
+
+func (x Condition) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Condition) Descriptor() protoreflect.EnumDescriptor {
+	return file_requestresponse_proto_enumTypes[1].Descriptor()
+}
+
+func (Condition) Type() protoreflect.EnumType {
+	return &file_requestresponse_proto_enumTypes[1]
+}
+
+func (x Condition) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Condition.Descriptor instead.
+func (Condition) EnumDescriptor() ([]byte, []int) {
+	return file_requestresponse_proto_rawDescGZIP(), []int{1}
+}
+
 type Status int32
 
 const (
-	Status_DUMMYSTATUS Status = 0
-	Status_SUCCESS     Status = 1
-	Status_FAILURE     Status = 2
+	Status_DUMMYSTATUS      Status = 0
+	Status_SUCCESS          Status = 1
+	Status_FAILURE          Status = 2
+	Status_NOT_LEADER       Status = 3 // Sent to a follower, retry against leader
+	Status_WRONG_SHARD      Status = 4 // Key belongs to another group, retry against its owner in shard_map
+	Status_NOT_FOUND        Status = 5 // Only in KeyResults, the key doesn't exist
+	Status_CONDITION_FAILED Status = 6 // A CAS's condition didn't hold, nothing was written
 )
 
 // Enum value maps for Status.
@@ -83,11 +208,19 @@ var (
 		0: "DUMMYSTATUS",
 		1: "SUCCESS",
 		2: "FAILURE",
+		3: "NOT_LEADER",
+		4: "WRONG_SHARD",
+		5: "NOT_FOUND",
+		6: "CONDITION_FAILED",
 	}
 	Status_value = map[string]int32{
-		"DUMMYSTATUS": 0,
-		"SUCCESS":     1,
-		"FAILURE":     2,
+		"DUMMYSTATUS":      0,
+		"SUCCESS":          1,
+		"FAILURE":          2,
+		"NOT_LEADER":       3,
+		"WRONG_SHARD":      4,
+		"NOT_FOUND":        5,
+		"CONDITION_FAILED": 6,
 	}
 )
 
@@ -102,11 +235,11 @@ func (x Status) String() string {
 }
 
 func (Status) Descriptor() protoreflect.EnumDescriptor {
-	return file_requestresponse_proto_enumTypes[1].Descriptor()
+	return file_requestresponse_proto_enumTypes[2].Descriptor()
 }
 
 func (Status) Type() protoreflect.EnumType {
-	return &file_requestresponse_proto_enumTypes[1]
+	return &file_requestresponse_proto_enumTypes[2]
 }
 
 func (x Status) Number() protoreflect.EnumNumber {
@@ -115,7 +248,7 @@ func (x Status) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use Status.Descriptor instead.
 func (Status) EnumDescriptor() ([]byte, []int) {
-	return file_requestresponse_proto_rawDescGZIP(), []int{1}
+	return file_requestresponse_proto_rawDescGZIP(), []int{2}
 }
 
 type Request struct {
@@ -123,9 +256,26 @@ type Request struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Key []byte    `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
-	Val []byte    `protobuf:"bytes,2,opt,name=val,proto3" json:"val,omitempty"`
-	Op  Operation `protobuf:"varint,3,opt,name=op,proto3,enum=communication.Operation" json:"op,omitempty"`
+	Key             []byte    `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Val             []byte    `protobuf:"bytes,2,opt,name=val,proto3" json:"val,omitempty"`
+	Op              Operation `protobuf:"varint,3,opt,name=op,proto3,enum=communication.Operation" json:"op,omitempty"`
+	RequestId       uint64    `protobuf:"varint,4,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`                    // Echoed back in the response so that pipelined requests can be matched up
+	Record          []byte    `protobuf:"bytes,5,opt,name=record,proto3" json:"record,omitempty"`                                            // Encoded LogRecord, set on REPLICATE requests
+	Seq             uint64    `protobuf:"varint,6,opt,name=seq,proto3" json:"seq,omitempty"`                                                 // Last sequence number the follower applied, set on FETCH requests
+	Token           string    `protobuf:"bytes,7,opt,name=token,proto3" json:"token,omitempty"`                                              // Shared replication secret, set on REPLICATE, FETCH, RAFT, ADD_MEMBER, REMOVE_MEMBER, MERKLE, MERKLE_RANGE, CHECK_REPLICA and the rebalancing SHARD_ requests
+	Raft            []byte    `protobuf:"bytes,8,opt,name=raft,proto3" json:"raft,omitempty"`                                                // Encoded RaftMessage, set on RAFT requests
+	Records         [][]byte  `protobuf:"bytes,9,rep,name=records,proto3" json:"records,omitempty"`                                          // Encoded LogRecords, set on SHARD_TRANSFER and BATCH requests
+	Nodes           []uint64  `protobuf:"varint,10,rep,packed,name=nodes,proto3" json:"nodes,omitempty"`                                     // Merkle tree nodes, set on MERKLE and MERKLE_RANGE requests
+	Repair          bool      `protobuf:"varint,11,opt,name=repair,proto3" json:"repair,omitempty"`                                          // Set on CHECK_REPLICA requests to fix what differs rather than only report it
+	End             []byte    `protobuf:"bytes,12,opt,name=end,proto3" json:"end,omitempty"`                                                 // Keys before this are scanned, set on SCAN requests, empty scans to the last key
+	Limit           uint32    `protobuf:"varint,13,opt,name=limit,proto3" json:"limit,omitempty"`                                            // Most entries to return, set on SCAN and PREFIX_SCAN requests
+	Prefix          []byte    `protobuf:"bytes,14,opt,name=prefix,proto3" json:"prefix,omitempty"`                                           // Keys starting with this are scanned, set on PREFIX_SCAN requests
+	KeysOnly        bool      `protobuf:"varint,15,opt,name=keys_only,json=keysOnly,proto3" json:"keys_only,omitempty"`                      // Set on PREFIX_SCAN requests to leave the values out
+	Keys            [][]byte  `protobuf:"bytes,16,rep,name=keys,proto3" json:"keys,omitempty"`                                               // Set on MGET requests
+	Condition       Condition `protobuf:"varint,17,opt,name=condition,proto3,enum=communication.Condition" json:"condition,omitempty"`       // What has to hold for a CAS to put val at key
+	ExpectedVersion uint64    `protobuf:"varint,18,opt,name=expected_version,json=expectedVersion,proto3" json:"expected_version,omitempty"` // Set on CAS requests with VERSION_EQUALS
+	ExpectedVal     []byte    `protobuf:"bytes,19,opt,name=expected_val,json=expectedVal,proto3" json:"expected_val,omitempty"`              // Set on CAS requests with VALUE_EQUALS
+	VersionFloor    uint64    `protobuf:"varint,20,opt,name=version_floor,json=versionFloor,proto3" json:"version_floor,omitempty"`          // Set on SHARD_TRANSFER requests, every key version the sending group has given out is at most this
 }
 
 func (x *Request) Reset() {
@@ -181,14 +331,146 @@ func (x *Request) GetOp() Operation {
 	return Operation_DUMMYOP
 }
 
+func (x *Request) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *Request) GetRecord() []byte {
+	if x != nil {
+		return x.Record
+	}
+	return nil
+}
+
+func (x *Request) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Request) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *Request) GetRaft() []byte {
+	if x != nil {
+		return x.Raft
+	}
+	return nil
+}
+
+func (x *Request) GetRecords() [][]byte {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *Request) GetNodes() []uint64 {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+func (x *Request) GetRepair() bool {
+	if x != nil {
+		return x.Repair
+	}
+	return false
+}
+
+func (x *Request) GetEnd() []byte {
+	if x != nil {
+		return x.End
+	}
+	return nil
+}
+
+func (x *Request) GetLimit() uint32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *Request) GetPrefix() []byte {
+	if x != nil {
+		return x.Prefix
+	}
+	return nil
+}
+
+func (x *Request) GetKeysOnly() bool {
+	if x != nil {
+		return x.KeysOnly
+	}
+	return false
+}
+
+func (x *Request) GetKeys() [][]byte {
+	if x != nil {
+		return x.Keys
+	}
+	return nil
+}
+
+func (x *Request) GetCondition() Condition {
+	if x != nil {
+		return x.Condition
+	}
+	return Condition_DUMMYCONDITION
+}
+
+func (x *Request) GetExpectedVersion() uint64 {
+	if x != nil {
+		return x.ExpectedVersion
+	}
+	return 0
+}
+
+func (x *Request) GetExpectedVal() []byte {
+	if x != nil {
+		return x.ExpectedVal
+	}
+	return nil
+}
+
+func (x *Request) GetVersionFloor() uint64 {
+	if x != nil {
+		return x.VersionFloor
+	}
+	return 0
+}
+
 type Response struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Status Status `protobuf:"varint,1,opt,name=status,proto3,enum=communication.Status" json:"status,omitempty"`
-	Error  string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
-	Val    []byte `protobuf:"bytes,3,opt,name=val,proto3" json:"val,omitempty"`
+	Status       Status       `protobuf:"varint,1,opt,name=status,proto3,enum=communication.Status" json:"status,omitempty"`
+	Error        string       `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	Val          []byte       `protobuf:"bytes,3,opt,name=val,proto3" json:"val,omitempty"`
+	RequestId    uint64       `protobuf:"varint,4,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Seq          uint64       `protobuf:"varint,5,opt,name=seq,proto3" json:"seq,omitempty"`                           // Sequence number of the last write the server applied, set on REPLICATE, FETCH, PING, MERKLE and MERKLE_RANGE responses
+	Records      [][]byte     `protobuf:"bytes,6,rep,name=records,proto3" json:"records,omitempty"`                    // Encoded LogRecords, set on FETCH, MERKLE_RANGE, SCAN and PREFIX_SCAN responses
+	Snapshot     bool         `protobuf:"varint,7,opt,name=snapshot,proto3" json:"snapshot,omitempty"`                 // records are a page of a snapshot of every live entry, as of seq, rather than the writes after the requested seq
+	Leader       string       `protobuf:"bytes,8,opt,name=leader,proto3" json:"leader,omitempty"`                      // host:port of the leader, set on NOT_LEADER responses if the server knows it
+	Raft         []byte       `protobuf:"bytes,9,opt,name=raft,proto3" json:"raft,omitempty"`                          // Encoded RaftMessage, set on RAFT responses
+	ShardMap     []byte       `protobuf:"bytes,10,opt,name=shard_map,json=shardMap,proto3" json:"shard_map,omitempty"` // Encoded ShardMap, set on SHARD_MAP and WRONG_SHARD responses, and MGET responses with WRONG_SHARD results
+	Hashes       []uint64     `protobuf:"varint,11,rep,packed,name=hashes,proto3" json:"hashes,omitempty"`             // Hashes of the requested Merkle tree nodes in order, set on MERKLE responses
+	Divergence   []byte       `protobuf:"bytes,12,opt,name=divergence,proto3" json:"divergence,omitempty"`             // Encoded Divergence, set on CHECK_REPLICA responses
+	Continuation []byte       `protobuf:"bytes,13,opt,name=continuation,proto3" json:"continuation,omitempty"`         // Set on SCAN, PREFIX_SCAN and snapshot FETCH responses when there are more entries, send it as key to get the next page
+	Results      []*KeyResult `protobuf:"bytes,14,rep,name=results,proto3" json:"results,omitempty"`                   // One for every requested key in order, set on MGET responses
+	Version      uint64       `protobuf:"varint,15,opt,name=version,proto3" json:"version,omitempty"`                  // The key's version, set on GET responses and CAS responses (the version the write gave the key)
+	Done         bool         `protobuf:"varint,16,opt,name=done,proto3" json:"done,omitempty"`                        // Set on SHARD_MIGRATE_STATUS responses once the group's keys have been handed over
 }
 
 func (x *Response) Reset() {
@@ -244,34 +526,279 @@ func (x *Response) GetVal() []byte {
 	return nil
 }
 
+func (x *Response) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *Response) GetSeq() uint64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *Response) GetRecords() [][]byte {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *Response) GetSnapshot() bool {
+	if x != nil {
+		return x.Snapshot
+	}
+	return false
+}
+
+func (x *Response) GetLeader() string {
+	if x != nil {
+		return x.Leader
+	}
+	return ""
+}
+
+func (x *Response) GetRaft() []byte {
+	if x != nil {
+		return x.Raft
+	}
+	return nil
+}
+
+func (x *Response) GetShardMap() []byte {
+	if x != nil {
+		return x.ShardMap
+	}
+	return nil
+}
+
+func (x *Response) GetHashes() []uint64 {
+	if x != nil {
+		return x.Hashes
+	}
+	return nil
+}
+
+func (x *Response) GetDivergence() []byte {
+	if x != nil {
+		return x.Divergence
+	}
+	return nil
+}
+
+func (x *Response) GetContinuation() []byte {
+	if x != nil {
+		return x.Continuation
+	}
+	return nil
+}
+
+func (x *Response) GetResults() []*KeyResult {
+	if x != nil {
+		return x.Results
+	}
+	return nil
+}
+
+func (x *Response) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Response) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+// A key's lookup in an MGET
+type KeyResult struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Status  Status `protobuf:"varint,1,opt,name=status,proto3,enum=communication.Status" json:"status,omitempty"` // SUCCESS, NOT_FOUND or WRONG_SHARD (the response's shard_map says where the key belongs)
+	Val     []byte `protobuf:"bytes,2,opt,name=val,proto3" json:"val,omitempty"`
+	Version uint64 `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+}
+
+func (x *KeyResult) Reset() {
+	*x = KeyResult{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_requestresponse_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *KeyResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*KeyResult) ProtoMessage() {}
+
+func (x *KeyResult) ProtoReflect() protoreflect.Message {
+	mi := &file_requestresponse_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use KeyResult.ProtoReflect.Descriptor instead.
+func (*KeyResult) Descriptor() ([]byte, []int) {
+	return file_requestresponse_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *KeyResult) GetStatus() Status {
+	if x != nil {
+		return x.Status
+	}
+	return Status_DUMMYSTATUS
+}
+
+func (x *KeyResult) GetVal() []byte {
+	if x != nil {
+		return x.Val
+	}
+	return nil
+}
+
+func (x *KeyResult) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
 var File_requestresponse_proto protoreflect.FileDescriptor
 
 var file_requestresponse_proto_rawDesc = []byte{
 	0x0a, 0x15, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
 	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69,
-	0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x57, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03,
-	0x6b, 0x65, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x76, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c,
-	0x52, 0x03, 0x76, 0x61, 0x6c, 0x12, 0x28, 0x0a, 0x02, 0x6f, 0x70, 0x18, 0x03, 0x20, 0x01, 0x28,
-	0x0e, 0x32, 0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f,
-	0x6e, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x02, 0x6f, 0x70, 0x22,
-	0x61, 0x0a, 0x08, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2d, 0x0a, 0x06, 0x73,
-	0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x63, 0x6f,
-	0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x53, 0x74, 0x61, 0x74,
-	0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72,
-	0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72,
-	0x12, 0x10, 0x0a, 0x03, 0x76, 0x61, 0x6c, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x76,
-	0x61, 0x6c, 0x2a, 0x2a, 0x0a, 0x09, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12,
+	0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0xae, 0x04, 0x0a, 0x07, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x03, 0x6b, 0x65, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x76, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x03, 0x76, 0x61, 0x6c, 0x12, 0x28, 0x0a, 0x02, 0x6f, 0x70, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0e, 0x32, 0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x02, 0x6f, 0x70,
+	0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x64, 0x12,
+	0x16, 0x0a, 0x06, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x06, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x6b,
+	0x65, 0x6e, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x6b, 0x65, 0x6e, 0x12,
+	0x12, 0x0a, 0x04, 0x72, 0x61, 0x66, 0x74, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x72,
+	0x61, 0x66, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x18, 0x09,
+	0x20, 0x03, 0x28, 0x0c, 0x52, 0x07, 0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x12, 0x14, 0x0a,
+	0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x0a, 0x20, 0x03, 0x28, 0x04, 0x52, 0x05, 0x6e, 0x6f,
+	0x64, 0x65, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x70, 0x61, 0x69, 0x72, 0x18, 0x0b, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x06, 0x72, 0x65, 0x70, 0x61, 0x69, 0x72, 0x12, 0x10, 0x0a, 0x03, 0x65,
+	0x6e, 0x64, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x65, 0x6e, 0x64, 0x12, 0x14, 0x0a,
+	0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x6c, 0x69,
+	0x6d, 0x69, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x18, 0x0e, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x12, 0x1b, 0x0a, 0x09, 0x6b,
+	0x65, 0x79, 0x73, 0x5f, 0x6f, 0x6e, 0x6c, 0x79, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08,
+	0x6b, 0x65, 0x79, 0x73, 0x4f, 0x6e, 0x6c, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x6b, 0x65, 0x79, 0x73,
+	0x18, 0x10, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x04, 0x6b, 0x65, 0x79, 0x73, 0x12, 0x36, 0x0a, 0x09,
+	0x63, 0x6f, 0x6e, 0x64, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x11, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e,
+	0x43, 0x6f, 0x6e, 0x64, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x63, 0x6f, 0x6e, 0x64, 0x69,
+	0x74, 0x69, 0x6f, 0x6e, 0x12, 0x29, 0x0a, 0x10, 0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64,
+	0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x12, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0f,
+	0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x21, 0x0a, 0x0c, 0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64, 0x5f, 0x76, 0x61, 0x6c, 0x18,
+	0x13, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0b, 0x65, 0x78, 0x70, 0x65, 0x63, 0x74, 0x65, 0x64, 0x56,
+	0x61, 0x6c, 0x12, 0x23, 0x0a, 0x0d, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x5f, 0x66, 0x6c,
+	0x6f, 0x6f, 0x72, 0x18, 0x14, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x46, 0x6c, 0x6f, 0x6f, 0x72, 0x22, 0xcf, 0x03, 0x0a, 0x08, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2d, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61,
+	0x74, 0x75, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x10, 0x0a, 0x03, 0x76, 0x61, 0x6c,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x76, 0x61, 0x6c, 0x12, 0x1d, 0x0a, 0x0a, 0x72,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x65,
+	0x71, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12, 0x18, 0x0a, 0x07,
+	0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x18, 0x06, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x07, 0x72,
+	0x65, 0x63, 0x6f, 0x72, 0x64, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68,
+	0x6f, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x73, 0x6e, 0x61, 0x70, 0x73, 0x68,
+	0x6f, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18, 0x08, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x6c, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x61,
+	0x66, 0x74, 0x18, 0x09, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x72, 0x61, 0x66, 0x74, 0x12, 0x1b,
+	0x0a, 0x09, 0x73, 0x68, 0x61, 0x72, 0x64, 0x5f, 0x6d, 0x61, 0x70, 0x18, 0x0a, 0x20, 0x01, 0x28,
+	0x0c, 0x52, 0x08, 0x73, 0x68, 0x61, 0x72, 0x64, 0x4d, 0x61, 0x70, 0x12, 0x16, 0x0a, 0x06, 0x68,
+	0x61, 0x73, 0x68, 0x65, 0x73, 0x18, 0x0b, 0x20, 0x03, 0x28, 0x04, 0x52, 0x06, 0x68, 0x61, 0x73,
+	0x68, 0x65, 0x73, 0x12, 0x1e, 0x0a, 0x0a, 0x64, 0x69, 0x76, 0x65, 0x72, 0x67, 0x65, 0x6e, 0x63,
+	0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x64, 0x69, 0x76, 0x65, 0x72, 0x67, 0x65,
+	0x6e, 0x63, 0x65, 0x12, 0x22, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x74, 0x69, 0x6e, 0x75, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0c, 0x63, 0x6f, 0x6e, 0x74, 0x69,
+	0x6e, 0x75, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x32, 0x0a, 0x07, 0x72, 0x65, 0x73, 0x75, 0x6c,
+	0x74, 0x73, 0x18, 0x0e, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75,
+	0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x4b, 0x65, 0x79, 0x52, 0x65, 0x73, 0x75,
+	0x6c, 0x74, 0x52, 0x07, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x76,
+	0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x76, 0x65,
+	0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x18, 0x10, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x22, 0x66, 0x0a, 0x09, 0x4b, 0x65, 0x79,
+	0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x2d, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69,
+	0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x76, 0x61, 0x6c, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x03, 0x76, 0x61, 0x6c, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x2a, 0x86, 0x03, 0x0a, 0x09, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12,
 	0x0b, 0x0a, 0x07, 0x44, 0x55, 0x4d, 0x4d, 0x59, 0x4f, 0x50, 0x10, 0x00, 0x12, 0x07, 0x0a, 0x03,
-	0x47, 0x45, 0x54, 0x10, 0x01, 0x12, 0x07, 0x0a, 0x03, 0x50, 0x55, 0x54, 0x10, 0x02, 0x2a, 0x33,
-	0x0a, 0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x0f, 0x0a, 0x0b, 0x44, 0x55, 0x4d, 0x4d,
-	0x59, 0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x55, 0x43,
-	0x43, 0x45, 0x53, 0x53, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x46, 0x41, 0x49, 0x4c, 0x55, 0x52,
-	0x45, 0x10, 0x02, 0x42, 0x3d, 0x5a, 0x3b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
-	0x6d, 0x2f, 0x63, 0x68, 0x65, 0x74, 0x74, 0x72, 0x69, 0x79, 0x75, 0x76, 0x72, 0x61, 0x6a, 0x2f,
-	0x64, 0x69, 0x73, 0x74, 0x72, 0x69, 0x62, 0x75, 0x74, 0x65, 0x64, 0x2d, 0x6b, 0x76, 0x2d, 0x73,
-	0x74, 0x6f, 0x72, 0x65, 0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69,
-	0x6f, 0x6e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x47, 0x45, 0x54, 0x10, 0x01, 0x12, 0x07, 0x0a, 0x03, 0x50, 0x55, 0x54, 0x10, 0x02, 0x12, 0x0a,
+	0x0a, 0x06, 0x44, 0x45, 0x4c, 0x45, 0x54, 0x45, 0x10, 0x03, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x49,
+	0x4e, 0x47, 0x10, 0x04, 0x12, 0x0d, 0x0a, 0x09, 0x52, 0x45, 0x50, 0x4c, 0x49, 0x43, 0x41, 0x54,
+	0x45, 0x10, 0x05, 0x12, 0x09, 0x0a, 0x05, 0x46, 0x45, 0x54, 0x43, 0x48, 0x10, 0x06, 0x12, 0x08,
+	0x0a, 0x04, 0x52, 0x41, 0x46, 0x54, 0x10, 0x07, 0x12, 0x08, 0x0a, 0x04, 0x4e, 0x4f, 0x4f, 0x50,
+	0x10, 0x08, 0x12, 0x0e, 0x0a, 0x0a, 0x41, 0x44, 0x44, 0x5f, 0x4d, 0x45, 0x4d, 0x42, 0x45, 0x52,
+	0x10, 0x09, 0x12, 0x11, 0x0a, 0x0d, 0x52, 0x45, 0x4d, 0x4f, 0x56, 0x45, 0x5f, 0x4d, 0x45, 0x4d,
+	0x42, 0x45, 0x52, 0x10, 0x0a, 0x12, 0x0d, 0x0a, 0x09, 0x53, 0x48, 0x41, 0x52, 0x44, 0x5f, 0x4d,
+	0x41, 0x50, 0x10, 0x0b, 0x12, 0x11, 0x0a, 0x0d, 0x53, 0x48, 0x41, 0x52, 0x44, 0x5f, 0x50, 0x52,
+	0x45, 0x50, 0x41, 0x52, 0x45, 0x10, 0x0c, 0x12, 0x11, 0x0a, 0x0d, 0x53, 0x48, 0x41, 0x52, 0x44,
+	0x5f, 0x4d, 0x49, 0x47, 0x52, 0x41, 0x54, 0x45, 0x10, 0x0d, 0x12, 0x12, 0x0a, 0x0e, 0x53, 0x48,
+	0x41, 0x52, 0x44, 0x5f, 0x54, 0x52, 0x41, 0x4e, 0x53, 0x46, 0x45, 0x52, 0x10, 0x0e, 0x12, 0x14,
+	0x0a, 0x10, 0x53, 0x48, 0x41, 0x52, 0x44, 0x5f, 0x48, 0x41, 0x4e, 0x44, 0x45, 0x44, 0x5f, 0x4f,
+	0x46, 0x46, 0x10, 0x0f, 0x12, 0x10, 0x0a, 0x0c, 0x53, 0x48, 0x41, 0x52, 0x44, 0x5f, 0x43, 0x4f,
+	0x4d, 0x4d, 0x49, 0x54, 0x10, 0x10, 0x12, 0x0a, 0x0a, 0x06, 0x4d, 0x45, 0x52, 0x4b, 0x4c, 0x45,
+	0x10, 0x11, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x45, 0x52, 0x4b, 0x4c, 0x45, 0x5f, 0x52, 0x41, 0x4e,
+	0x47, 0x45, 0x10, 0x12, 0x12, 0x11, 0x0a, 0x0d, 0x43, 0x48, 0x45, 0x43, 0x4b, 0x5f, 0x52, 0x45,
+	0x50, 0x4c, 0x49, 0x43, 0x41, 0x10, 0x13, 0x12, 0x08, 0x0a, 0x04, 0x53, 0x43, 0x41, 0x4e, 0x10,
+	0x14, 0x12, 0x0f, 0x0a, 0x0b, 0x50, 0x52, 0x45, 0x46, 0x49, 0x58, 0x5f, 0x53, 0x43, 0x41, 0x4e,
+	0x10, 0x15, 0x12, 0x09, 0x0a, 0x05, 0x42, 0x41, 0x54, 0x43, 0x48, 0x10, 0x16, 0x12, 0x08, 0x0a,
+	0x04, 0x4d, 0x47, 0x45, 0x54, 0x10, 0x17, 0x12, 0x07, 0x0a, 0x03, 0x43, 0x41, 0x53, 0x10, 0x18,
+	0x12, 0x18, 0x0a, 0x14, 0x53, 0x48, 0x41, 0x52, 0x44, 0x5f, 0x4d, 0x49, 0x47, 0x52, 0x41, 0x54,
+	0x45, 0x5f, 0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x10, 0x19, 0x2a, 0x51, 0x0a, 0x09, 0x43, 0x6f,
+	0x6e, 0x64, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x0e, 0x44, 0x55, 0x4d, 0x4d, 0x59,
+	0x43, 0x4f, 0x4e, 0x44, 0x49, 0x54, 0x49, 0x4f, 0x4e, 0x10, 0x00, 0x12, 0x12, 0x0a, 0x0e, 0x56,
+	0x45, 0x52, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x45, 0x51, 0x55, 0x41, 0x4c, 0x53, 0x10, 0x01, 0x12,
+	0x0a, 0x0a, 0x06, 0x41, 0x42, 0x53, 0x45, 0x4e, 0x54, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x56,
+	0x41, 0x4c, 0x55, 0x45, 0x5f, 0x45, 0x51, 0x55, 0x41, 0x4c, 0x53, 0x10, 0x03, 0x2a, 0x79, 0x0a,
+	0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x0f, 0x0a, 0x0b, 0x44, 0x55, 0x4d, 0x4d, 0x59,
+	0x53, 0x54, 0x41, 0x54, 0x55, 0x53, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x55, 0x43, 0x43,
+	0x45, 0x53, 0x53, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x46, 0x41, 0x49, 0x4c, 0x55, 0x52, 0x45,
+	0x10, 0x02, 0x12, 0x0e, 0x0a, 0x0a, 0x4e, 0x4f, 0x54, 0x5f, 0x4c, 0x45, 0x41, 0x44, 0x45, 0x52,
+	0x10, 0x03, 0x12, 0x0f, 0x0a, 0x0b, 0x57, 0x52, 0x4f, 0x4e, 0x47, 0x5f, 0x53, 0x48, 0x41, 0x52,
+	0x44, 0x10, 0x04, 0x12, 0x0d, 0x0a, 0x09, 0x4e, 0x4f, 0x54, 0x5f, 0x46, 0x4f, 0x55, 0x4e, 0x44,
+	0x10, 0x05, 0x12, 0x14, 0x0a, 0x10, 0x43, 0x4f, 0x4e, 0x44, 0x49, 0x54, 0x49, 0x4f, 0x4e, 0x5f,
+	0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x06, 0x42, 0x3d, 0x5a, 0x3b, 0x67, 0x69, 0x74, 0x68,
+	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x63, 0x68, 0x65, 0x74, 0x74, 0x72, 0x69, 0x79, 0x75,
+	0x76, 0x72, 0x61, 0x6a, 0x2f, 0x64, 0x69, 0x73, 0x74, 0x72, 0x69, 0x62, 0x75, 0x74, 0x65, 0x64,
+	0x2d, 0x6b, 0x76, 0x2d, 0x73, 0x74, 0x6f, 0x72, 0x65, 0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e,
+	0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -286,22 +813,27 @@ func file_requestresponse_proto_rawDescGZIP() []byte {
 	return file_requestresponse_proto_rawDescData
 }
 
-var file_requestresponse_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
-var file_requestresponse_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_requestresponse_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_requestresponse_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_requestresponse_proto_goTypes = []interface{}{
-	(Operation)(0),   // 0: communication.Operation
-	(Status)(0),      // 1: communication.Status
-	(*Request)(nil),  // 2: communication.Request
-	(*Response)(nil), // 3: communication.Response
+	(Operation)(0),    // 0: communication.Operation
+	(Condition)(0),    // 1: communication.Condition
+	(Status)(0),       // 2: communication.Status
+	(*Request)(nil),   // 3: communication.Request
+	(*Response)(nil),  // 4: communication.Response
+	(*KeyResult)(nil), // 5: communication.KeyResult
 }
 var file_requestresponse_proto_depIdxs = []int32{
 	0, // 0: communication.Request.op:type_name -> communication.Operation
-	1, // 1: communication.Response.status:type_name -> communication.Status
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	1, // 1: communication.Request.condition:type_name -> communication.Condition
+	2, // 2: communication.Response.status:type_name -> communication.Status
+	5, // 3: communication.Response.results:type_name -> communication.KeyResult
+	2, // 4: communication.KeyResult.status:type_name -> communication.Status
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_requestresponse_proto_init() }
@@ -334,14 +866,26 @@ func file_requestresponse_proto_init() {
 				return nil
 			}
 		}
+		file_requestresponse_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*KeyResult); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_requestresponse_proto_rawDesc,
-			NumEnums:      2,
-			NumMessages:   2,
+			NumEnums:      3,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
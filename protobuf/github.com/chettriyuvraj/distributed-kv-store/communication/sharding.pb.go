@@ -0,0 +1,241 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.0
+// 	protoc        v5.26.1
+// source: sharding.proto
+
+package communication
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// A leader/follower (or raft) group owning a share of the keyspace
+type ShardGroup struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id    string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Seeds []string `protobuf:"bytes,2,rep,name=seeds,proto3" json:"seeds,omitempty"` // host:port of the group's nodes
+}
+
+func (x *ShardGroup) Reset() {
+	*x = ShardGroup{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sharding_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ShardGroup) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ShardGroup) ProtoMessage() {}
+
+func (x *ShardGroup) ProtoReflect() protoreflect.Message {
+	mi := &file_sharding_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ShardGroup.ProtoReflect.Descriptor instead.
+func (*ShardGroup) Descriptor() ([]byte, []int) {
+	return file_sharding_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ShardGroup) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ShardGroup) GetSeeds() []string {
+	if x != nil {
+		return x.Seeds
+	}
+	return nil
+}
+
+// Which group owns which keys, see package sharding
+type ShardMap struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Version      uint64        `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"` // Bumped on every change, the higher version wins
+	Groups       []*ShardGroup `protobuf:"bytes,2,rep,name=groups,proto3" json:"groups,omitempty"`
+	VirtualNodes uint32        `protobuf:"varint,3,opt,name=virtual_nodes,json=virtualNodes,proto3" json:"virtual_nodes,omitempty"` // Points on the hash ring per group
+}
+
+func (x *ShardMap) Reset() {
+	*x = ShardMap{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_sharding_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ShardMap) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ShardMap) ProtoMessage() {}
+
+func (x *ShardMap) ProtoReflect() protoreflect.Message {
+	mi := &file_sharding_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ShardMap.ProtoReflect.Descriptor instead.
+func (*ShardMap) Descriptor() ([]byte, []int) {
+	return file_sharding_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ShardMap) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *ShardMap) GetGroups() []*ShardGroup {
+	if x != nil {
+		return x.Groups
+	}
+	return nil
+}
+
+func (x *ShardMap) GetVirtualNodes() uint32 {
+	if x != nil {
+		return x.VirtualNodes
+	}
+	return 0
+}
+
+var File_sharding_proto protoreflect.FileDescriptor
+
+var file_sharding_proto_rawDesc = []byte{
+	0x0a, 0x0e, 0x73, 0x68, 0x61, 0x72, 0x64, 0x69, 0x6e, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x12, 0x0d, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22,
+	0x32, 0x0a, 0x0a, 0x53, 0x68, 0x61, 0x72, 0x64, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x14, 0x0a,
+	0x05, 0x73, 0x65, 0x65, 0x64, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x73, 0x65,
+	0x65, 0x64, 0x73, 0x22, 0x7c, 0x0a, 0x08, 0x53, 0x68, 0x61, 0x72, 0x64, 0x4d, 0x61, 0x70, 0x12,
+	0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x31, 0x0a, 0x06, 0x67, 0x72, 0x6f,
+	0x75, 0x70, 0x73, 0x18, 0x02, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x63, 0x6f, 0x6d, 0x6d,
+	0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x53, 0x68, 0x61, 0x72, 0x64, 0x47,
+	0x72, 0x6f, 0x75, 0x70, 0x52, 0x06, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x73, 0x12, 0x23, 0x0a, 0x0d,
+	0x76, 0x69, 0x72, 0x74, 0x75, 0x61, 0x6c, 0x5f, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x0c, 0x76, 0x69, 0x72, 0x74, 0x75, 0x61, 0x6c, 0x4e, 0x6f, 0x64, 0x65,
+	0x73, 0x42, 0x3d, 0x5a, 0x3b, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
+	0x63, 0x68, 0x65, 0x74, 0x74, 0x72, 0x69, 0x79, 0x75, 0x76, 0x72, 0x61, 0x6a, 0x2f, 0x64, 0x69,
+	0x73, 0x74, 0x72, 0x69, 0x62, 0x75, 0x74, 0x65, 0x64, 0x2d, 0x6b, 0x76, 0x2d, 0x73, 0x74, 0x6f,
+	0x72, 0x65, 0x2f, 0x63, 0x6f, 0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e,
+	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_sharding_proto_rawDescOnce sync.Once
+	file_sharding_proto_rawDescData = file_sharding_proto_rawDesc
+)
+
+func file_sharding_proto_rawDescGZIP() []byte {
+	file_sharding_proto_rawDescOnce.Do(func() {
+		file_sharding_proto_rawDescData = protoimpl.X.CompressGZIP(file_sharding_proto_rawDescData)
+	})
+	return file_sharding_proto_rawDescData
+}
+
+var file_sharding_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_sharding_proto_goTypes = []interface{}{
+	(*ShardGroup)(nil), // 0: communication.ShardGroup
+	(*ShardMap)(nil),   // 1: communication.ShardMap
+}
+var file_sharding_proto_depIdxs = []int32{
+	0, // 0: communication.ShardMap.groups:type_name -> communication.ShardGroup
+	1, // [1:1] is the sub-list for method output_type
+	1, // [1:1] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_sharding_proto_init() }
+func file_sharding_proto_init() {
+	if File_sharding_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_sharding_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ShardGroup); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_sharding_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ShardMap); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_sharding_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_sharding_proto_goTypes,
+		DependencyIndexes: file_sharding_proto_depIdxs,
+		MessageInfos:      file_sharding_proto_msgTypes,
+	}.Build()
+	File_sharding_proto = out.File
+	file_sharding_proto_rawDesc = nil
+	file_sharding_proto_goTypes = nil
+	file_sharding_proto_depIdxs = nil
+}
@@ -0,0 +1,129 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/chettriyuvraj/distributed-kv-store/internal/hashing"
+	"github.com/chettriyuvraj/distributed-kv-store/protobuf/github.com/chettriyuvraj/distributed-kv-store/communication"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	The keyspace is split with consistent hashing: every group gets VirtualNodes points on a ring of 64-bit hashes,
+	and a key belongs to the group owning the first point at or after the key's hash (wrapping around). Each point
+	starts a shard, the range of hashes up to the previous point.
+
+	Spreading a group over many points evens out how much of the ring each group gets, and adding or removing a
+	group only moves the keys on the shards next to its points: roughly 1/n of the keyspace for n groups.
+
+	Servers and clients have to agree on the map, so it carries a version: a node turns away keys it doesn't own
+	with WRONG_SHARD and its own map, which the client switches to if it is newer than the one it routed by.
+*/
+
+const DEFAULT_VIRTUAL_NODES = 128
+
+var ErrNoGroups = errors.New("shard map has no groups")
+var ErrDuplicateGroup = errors.New("group is in the shard map twice")
+
+type Group struct {
+	ID    string
+	Seeds []string /* host:port of the group's nodes */
+}
+
+type point struct {
+	hash  uint64
+	group int /* Index into Groups */
+}
+
+/* Immutable once built, safe for concurrent use */
+type ShardMap struct {
+	Version      uint64
+	Groups       []Group
+	VirtualNodes int
+	ring         []point /* Sorted by hash */
+}
+
+/* Build the ring for groups, virtualNodes <= 0 means DEFAULT_VIRTUAL_NODES */
+func NewShardMap(version uint64, groups []Group, virtualNodes int) (*ShardMap, error) {
+	if len(groups) == 0 {
+		return nil, ErrNoGroups
+	}
+	if virtualNodes <= 0 {
+		virtualNodes = DEFAULT_VIRTUAL_NODES
+	}
+
+	m := &ShardMap{Version: version, Groups: groups, VirtualNodes: virtualNodes}
+	seen := map[string]bool{}
+	for i, group := range groups {
+		if seen[group.ID] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateGroup, group.ID)
+		}
+		seen[group.ID] = true
+
+		for v := 0; v < virtualNodes; v++ {
+			m.ring = append(m.ring, point{hash: hash([]byte(group.ID + "#" + strconv.Itoa(v))), group: i})
+		}
+	}
+
+	/* Ties (vanishingly unlikely) go to the group listed first so that every node builds the same ring */
+	sort.Slice(m.ring, func(i, j int) bool {
+		if m.ring[i].hash != m.ring[j].hash {
+			return m.ring[i].hash < m.ring[j].hash
+		}
+		return m.ring[i].group < m.ring[j].group
+	})
+
+	return m, nil
+}
+
+/* The group owning key */
+func (m *ShardMap) Owner(key []byte) Group {
+	h := hash(key)
+	i := sort.Search(len(m.ring), func(i int) bool { return m.ring[i].hash >= h })
+	if i == len(m.ring) {
+		i = 0
+	}
+	return m.Groups[m.ring[i].group]
+}
+
+func (m *ShardMap) Group(id string) (Group, bool) {
+	for _, group := range m.Groups {
+		if group.ID == id {
+			return group, true
+		}
+	}
+	return Group{}, false
+}
+
+func (m *ShardMap) Encode() ([]byte, error) {
+	pb := &communication.ShardMap{Version: m.Version, VirtualNodes: uint32(m.VirtualNodes)}
+	for _, group := range m.Groups {
+		pb.Groups = append(pb.Groups, &communication.ShardGroup{Id: group.ID, Seeds: group.Seeds})
+	}
+	return proto.Marshal(pb)
+}
+
+func Decode(data []byte) (*ShardMap, error) {
+	var pb communication.ShardMap
+	err := proto.Unmarshal(data, &pb)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []Group
+	for _, group := range pb.Groups {
+		groups = append(groups, Group{ID: group.Id, Seeds: group.Seeds})
+	}
+	return NewShardMap(pb.Version, groups, int(pb.VirtualNodes))
+}
+
+/* FNV-1a, with the bits mixed afterwards: on its own it spreads names differing only in their last few bytes poorly */
+func hash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return hashing.Mix(h.Sum64())
+}
@@ -0,0 +1,91 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testGroups(n int) []Group {
+	var groups []Group
+	for i := 0; i < n; i++ {
+		groups = append(groups, Group{ID: fmt.Sprintf("g%d", i), Seeds: []string{fmt.Sprintf("localhost:%d", 4000+i)}})
+	}
+	return groups
+}
+
+func TestNewShardMap(t *testing.T) {
+	_, err := NewShardMap(1, nil, 0)
+	require.ErrorIs(t, err, ErrNoGroups)
+
+	_, err = NewShardMap(1, []Group{{ID: "g0"}, {ID: "g0"}}, 0)
+	require.ErrorIs(t, err, ErrDuplicateGroup)
+
+	m, err := NewShardMap(1, testGroups(3), 0)
+	require.NoError(t, err)
+	require.Equal(t, DEFAULT_VIRTUAL_NODES, m.VirtualNodes)
+	require.Len(t, m.ring, 3*DEFAULT_VIRTUAL_NODES)
+
+	group, ok := m.Group("g1")
+	require.True(t, ok)
+	require.Equal(t, []string{"localhost:4001"}, group.Seeds)
+	_, ok = m.Group("g3")
+	require.False(t, ok)
+}
+
+/* Every group gets a fair share of the keys, and maps built from the same groups agree on all of them */
+func TestOwnerBalanced(t *testing.T) {
+	m, err := NewShardMap(1, testGroups(4), 0)
+	require.NoError(t, err)
+	same, err := NewShardMap(1, testGroups(4), 0)
+	require.NoError(t, err)
+
+	const keys = 40000
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		owner := m.Owner(key)
+		require.Equal(t, owner.ID, same.Owner(key).ID)
+		counts[owner.ID]++
+	}
+
+	require.Len(t, counts, 4)
+	for id, count := range counts {
+		require.InDelta(t, keys/4, count, keys/4*0.25, "group %s", id)
+	}
+}
+
+/* Adding a group only moves keys over to it, and about its fair share of them */
+func TestOwnerMinimalMovement(t *testing.T) {
+	before, err := NewShardMap(1, testGroups(3), 0)
+	require.NoError(t, err)
+	after, err := NewShardMap(2, testGroups(4), 0)
+	require.NoError(t, err)
+
+	const keys = 40000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		from, to := before.Owner(key), after.Owner(key)
+		if from.ID != to.ID {
+			require.Equal(t, "g3", to.ID)
+			moved++
+		}
+	}
+	require.InDelta(t, keys/4, moved, keys/4*0.25)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	m, err := NewShardMap(7, testGroups(3), 16)
+	require.NoError(t, err)
+	data, err := m.Encode()
+	require.NoError(t, err)
+
+	got, err := Decode(data)
+	require.NoError(t, err)
+	require.Equal(t, m, got)
+
+	_, err = Decode([]byte("garbage"))
+	require.Error(t, err)
+}